@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+type APIKeyController struct {
+	APIKeyService model.APIKeyRepository
+}
+
+func NewAPIKeyController(apiKeyService model.APIKeyRepository) *APIKeyController {
+	return &APIKeyController{APIKeyService: apiKeyService}
+}
+
+// apiKeyExcludedScopes cannot be granted to API keys: keys are for
+// integrations, not for managing users or other keys.
+var apiKeyExcludedScopes = map[string]bool{
+	model.PermUsersManage:   true,
+	model.PermAPIKeysManage: true,
+}
+
+type apiKeyRequest struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	AllowedIPs []string `json:"allowed_ips"`
+	ExpiresAt  string   `json:"expires_at"`
+}
+
+// APIKeys lists API keys (GET), creates one (POST) or revokes the key given
+// by the "id" query parameter (DELETE). A key can only be given scopes its
+// creator holds; the secret key is returned once, when it is created.
+func (kc *APIKeyController) APIKeys(w http.ResponseWriter, r *http.Request) {
+	claims := utils.ClaimsFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := kc.APIKeyService.ListAPIKeys()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   keys,
+		})
+
+	case http.MethodPost:
+		var request apiKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		newKey := model.NewAPIKey{Name: strings.TrimSpace(request.Name), Scopes: []string{}, CreatedBy: claims.UserID}
+		if newKey.Name == "" {
+			http.Error(w, "Missing name in request body", http.StatusBadRequest)
+			return
+		}
+		seen := map[string]bool{}
+		for _, scope := range request.Scopes {
+			scope = strings.TrimSpace(scope)
+			if scope == "" || seen[scope] {
+				continue
+			}
+			if apiKeyExcludedScopes[scope] {
+				http.Error(w, "Scope "+scope+" cannot be granted to an API key", http.StatusBadRequest)
+				return
+			}
+			if !claims.HasPermission(scope) {
+				http.Error(w, "You cannot grant the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			seen[scope] = true
+			newKey.Scopes = append(newKey.Scopes, scope)
+		}
+		if len(newKey.Scopes) == 0 {
+			http.Error(w, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		allowedIPs, err := model.NormalizeAllowedIPs(request.AllowedIPs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		newKey.AllowedIPs = allowedIPs
+		if request.ExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, request.ExpiresAt)
+			if err != nil || !expiresAt.After(time.Now()) {
+				http.Error(w, "expires_at must be a future RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			newKey.ExpiresAt = &expiresAt
+		}
+
+		key, secretKey, err := kc.APIKeyService.CreateAPIKey(newKey)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"status":  "success",
+			"message": "API key created, store it now as it is not shown again",
+			"data": map[string]interface{}{
+				"api_key": key,
+				"key":     secretKey,
+			},
+		})
+
+	case http.MethodDelete:
+		revoked, err := kc.APIKeyService.RevokeAPIKey(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !revoked {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "API key revoked",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+type consentRequest struct {
+	CustomerGID string `json:"customer_gid"`
+	Status      string `json:"status"`
+	Note        string `json:"note"`
+}
+
+// CustomerConsent returns the consent history of the customer given by the
+// "id" query parameter (GET) or records a consent change (POST).
+func (customer *CustomerController) CustomerConsent(w http.ResponseWriter, r *http.Request) {
+	claims := utils.ClaimsFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		events, err := customer.ConsentService.ConsentHistory(r.URL.Query().Get("id"))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   events,
+		})
+
+	case http.MethodPost:
+		var request consentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		consent, err := model.ParseConsent(request.Status)
+		if err != nil || consent == "" {
+			http.Error(w, "Invalid status, use opted_in or opted_out", http.StatusBadRequest)
+			return
+		}
+
+		found, err := customer.ConsentService.SetConsent(request.CustomerGID, model.ConsentChange{
+			Status:      consent,
+			Source:      model.ConsentSourceAPI,
+			ChangedBy:   claims.UserID,
+			RequestedIP: clientIP(r),
+			Note:        request.Note,
+		})
+		if err == model.ErrKeywordOptOut {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Customer not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "Consent updated",
+			"data": map[string]interface{}{
+				"customer_gid":  request.CustomerGID,
+				"opt_in_status": consent,
+			},
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"whatbot/utils"
+)
+
+type customerGIDRequest struct {
+	CustomerGID string `json:"customer_gid"`
+}
+
+// DeleteCustomer archives a customer. Archived customers are hidden from
+// listing and export unless asked for with "archived".
+func (customer *CustomerController) DeleteCustomer(w http.ResponseWriter, r *http.Request) {
+	customer.setArchived(w, r, true)
+}
+
+// RestoreCustomer brings an archived customer back.
+func (customer *CustomerController) RestoreCustomer(w http.ResponseWriter, r *http.Request) {
+	customer.setArchived(w, r, false)
+}
+
+func (customer *CustomerController) setArchived(w http.ResponseWriter, r *http.Request, archive bool) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request customerGIDRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var changed bool
+	var err error
+	message := "Customer archived"
+	if archive {
+		changed, err = customer.CustomerService.ArchiveCustomer(request.CustomerGID, claims.UserID)
+	} else {
+		changed, err = customer.CustomerService.RestoreCustomer(request.CustomerGID)
+		message = "Customer restored"
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": message,
+	})
+}
@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	envconfig "whatbot/dbConfig"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+func validEmail(email *string) bool {
+	if email == nil || strings.TrimSpace(*email) == "" {
+		return true
+	}
+	_, err := mail.ParseAddress(strings.TrimSpace(*email))
+	return err == nil
+}
+
+type customerRequest struct {
+	CountryCode int                    `json:"country_code"`
+	PhoneNumber string                 `json:"phone_number"`
+	Name        *string                `json:"name"`
+	Email       *string                `json:"email"`
+	Tags        []string               `json:"tags"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	OptIn       string                 `json:"opt_in"`
+	Language    *string                `json:"language"`
+	Timezone    *string                `json:"timezone"`
+}
+
+// locale validates the language and timezone of the request, normalizing
+// them in place.
+func (request *customerRequest) locale() error {
+	if request.Language != nil {
+		language, err := model.ParseLanguage(*request.Language)
+		if err != nil {
+			return err
+		}
+		request.Language = &language
+	}
+	if request.Timezone != nil {
+		timezone, err := model.ParseTimezone(*request.Timezone)
+		if err != nil {
+			return err
+		}
+		request.Timezone = &timezone
+	}
+	return nil
+}
+
+// businessID is the tenant whose attribute schema applies.
+func businessID() (string, error) {
+	config, err := envconfig.LoadConfig("config.json")
+	if err != nil {
+		return "", err
+	}
+	return config.BusinessId, nil
+}
+
+func (customer *CustomerController) attributeSchema() (model.AttributeSchema, error) {
+	business, err := businessID()
+	if err != nil {
+		return nil, err
+	}
+	schema, err := customer.AttributeService.GetSchema(business)
+	if err != nil {
+		log.Println("Error loading attribute schema:", err)
+		return nil, err
+	}
+	return schema, nil
+}
+
+// CustomerAttributes lists the attribute schema (GET), creates or replaces a
+// definition (POST) or deletes the one named by the "key" query parameter
+// (DELETE).
+func (customer *CustomerController) CustomerAttributes(w http.ResponseWriter, r *http.Request) {
+	claims := utils.ClaimsFromContext(r.Context())
+	business, err := businessID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		defs, err := customer.AttributeService.ListAttributes(business)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   defs,
+		})
+
+	case http.MethodPost:
+		var def model.AttributeDefinition
+		if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		def.CreatedBy = claims.UserID
+		err := customer.AttributeService.SaveAttribute(business, &def)
+		if errors.Is(err, model.ErrInvalidAttribute) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   def,
+		})
+
+	case http.MethodDelete:
+		deleted, err := customer.AttributeService.DeleteAttribute(business, r.URL.Query().Get("key"))
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Attribute not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "Attribute deleted",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CreateCustomer adds a single customer; attributes are checked against the
+// schema.
+func (customer *CustomerController) CreateCustomer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request customerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.PhoneNumber) == "" {
+		http.Error(w, "Missing phone_number in request body", http.StatusBadRequest)
+		return
+	}
+	if !validEmail(request.Email) {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	consent, err := model.ParseConsent(request.OptIn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := request.locale(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	schema, err := customer.attributeSchema()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	attributes, err := schema.Validate(request.Attributes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contact := &model.Contacts{
+		COUNTRY_CODE: request.CountryCode,
+		PHONE_NUMBER: strings.TrimSpace(request.PhoneNumber),
+		TAGS:         model.NormalizeTags(request.Tags),
+		ATTRIBUTES:   attributes,
+		CONSENT:      consent,
+	}
+	if request.Name != nil {
+		contact.NAME = strings.TrimSpace(*request.Name)
+	}
+	if request.Email != nil {
+		contact.EMAIL = strings.TrimSpace(*request.Email)
+	}
+	if request.Language != nil {
+		contact.LANGUAGE = *request.Language
+	}
+	if request.Timezone != nil {
+		contact.TIMEZONE = *request.Timezone
+	}
+	for key, value := range contact.ATTRIBUTES {
+		if value == nil {
+			delete(contact.ATTRIBUTES, key)
+		}
+	}
+
+	created, err := customer.CustomerService.CreateCustomer(contact, claims.UserID, clientIP(r))
+	if err == model.ErrDuplicateCustomer || err == model.ErrTombstoned {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Error creating customer:", err)
+		http.Error(w, "Invalid phone number or country code", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status": "success",
+		"data":   customerResponse(created),
+	})
+}
+
+// UpdateCustomer changes the name, email, language, timezone or attributes of
+// the customer given by the "id" query parameter. A null attribute value
+// removes the attribute.
+func (customer *CustomerController) UpdateCustomer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request customerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !validEmail(request.Email) {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	if err := request.locale(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	schema, err := customer.attributeSchema()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	attributes, err := schema.Validate(request.Attributes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := customer.CustomerService.UpdateCustomer(r.URL.Query().Get("id"), model.CustomerUpdate{
+		Name:       request.Name,
+		Email:      request.Email,
+		Language:   request.Language,
+		Timezone:   request.Timezone,
+		Attributes: attributes,
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   customerResponse(updated),
+	})
+}
@@ -2,32 +2,77 @@ package controller
 
 import (
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
-	"net"
 	"strings"
-	"time"
 	"whatbot/model"
 	"whatbot/utils"
-
-	"github.com/golang-jwt/jwt/v4"
 )
 
 // CustomerController handles HTTP requests related to customers
 type CustomerController struct {
-	CustomerService model.CustomerRepository
-	CSVService      model.CSVRepository
-	CountryService  model.CountryRepository
+	CustomerService  model.CustomerRepository
+	ImportService    model.ContactImporter
+	CountryService   model.CountryRepository
+	JobService       model.ImportJobRepository
+	TagService       model.TagRepository
+	SegmentService   model.SegmentRepository
+	AttributeService model.AttributeSchemaRepository
+	ConsentService   model.ConsentRepository
+	MergeService     model.CustomerMergeRepository
+	PrivacyService   model.PrivacyRepository
 }
 
 type Customer struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	PhoneNumber string `json:"phone_number"`
-	CreatedDate string `json:"created_date"`
-	GID         string `json:"gid"`
+	ID              int                    `json:"id"`
+	Name            string                 `json:"name"`
+	PhoneNumber     string                 `json:"phone_number"`
+	NormalizedPhone string                 `json:"normalized_phone"`
+	CountryCode     int                    `json:"country_code"`
+	Email           string                 `json:"email"`
+	Attributes      map[string]interface{} `json:"attributes"`
+	OptInStatus     string                 `json:"opt_in_status"`
+	Language        string                 `json:"language"`
+	Timezone        string                 `json:"timezone"`
+	WaProfileName   string                 `json:"wa_profile_name"`
+	FirstSeenAt     string                 `json:"first_seen_at,omitempty"`
+	LastSeenAt      string                 `json:"last_seen_at,omitempty"`
+	DeletedAt       string                 `json:"deleted_at,omitempty"`
+	CreatedDate     string                 `json:"created_date"`
+	GID             string                 `json:"gid"`
+}
+
+func customerResponse(c *model.Customer) Customer {
+	response := Customer{
+		ID:              c.ID,
+		Name:            c.NAME,
+		PhoneNumber:     c.PHONE_NUMBER,
+		NormalizedPhone: c.NORMALIZED_PHONE.String,
+		CountryCode:     c.COUNTRY_CODE,
+		Email:           c.EMAIL,
+		Attributes:      c.ATTRIBUTES,
+		OptInStatus:     c.OPT_IN_STATUS,
+		Language:        c.LANGUAGE,
+		Timezone:        c.TIMEZONE,
+		WaProfileName:   c.WA_PROFILE_NAME,
+		CreatedDate:     c.CREATED_DATE.Format("2006-01-02"),
+		GID:             c.GID,
+	}
+	if c.FIRST_SEEN_AT.Valid {
+		response.FirstSeenAt = c.FIRST_SEEN_AT.Time.Format(time.RFC3339)
+	}
+	if c.LAST_SEEN_AT.Valid {
+		response.LastSeenAt = c.LAST_SEEN_AT.Time.Format(time.RFC3339)
+	}
+	if c.DELETED_AT.Valid {
+		response.DeletedAt = c.DELETED_AT.Time.Format(time.RFC3339)
+	}
+	return response
 }
 
 type Pagination struct {
@@ -57,11 +102,18 @@ type ResponsePayload struct {
 	} `json:"payload"`
 }
 
-func NewCustomerController(customerService model.CustomerRepository, csvService model.CSVRepository, countryService model.CountryRepository) *CustomerController {
+func NewCustomerController(customerService model.CustomerRepository, importService model.ContactImporter, countryService model.CountryRepository, jobService model.ImportJobRepository, tagService model.TagRepository, segmentService model.SegmentRepository, attributeService model.AttributeSchemaRepository, consentService model.ConsentRepository, mergeService model.CustomerMergeRepository, privacyService model.PrivacyRepository) *CustomerController {
 	return &CustomerController{
-		CustomerService: customerService,
-		CSVService:      csvService,
-		CountryService:  countryService,
+		CustomerService:  customerService,
+		ImportService:    importService,
+		CountryService:   countryService,
+		JobService:       jobService,
+		TagService:       tagService,
+		SegmentService:   segmentService,
+		AttributeService: attributeService,
+		ConsentService:   consentService,
+		MergeService:     mergeService,
+		PrivacyService:   privacyService,
 	}
 }
 
@@ -80,22 +132,21 @@ func (customer *CustomerController) ListAllCustomer(w http.ResponseWriter, r *ht
 	}
 	offset := (page - 1) * pageSize
 
-	customers, totalCustomers, err := customer.CustomerService.CustomerList(offset, pageSize)
+	filter, err := customerFilterFromQuery(r)
 	if err != nil {
-		log.Println("Error fetching customers:", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	customers, totalCustomers, err := customer.CustomerService.CustomerList(filter, offset, pageSize)
+	if err != nil {
+		writeFilterError(w, err)
 		return
 	}
 
 	var responseCustomers []Customer
 	for _, c := range customers {
-		responseCustomers = append(responseCustomers, Customer{
-			ID:          c.ID,
-			Name:        c.NAME,
-			PhoneNumber: c.PHONE_NUMBER,
-			CreatedDate: c.CREATED_DATE.Format("2006-01-02"),
-			GID:         c.GID,
-		})
+		responseCustomers = append(responseCustomers, customerResponse(c))
 	}
 	lastPage := (totalCustomers + pageSize - 1) / pageSize
 	var links []Link
@@ -164,120 +215,170 @@ func (customer *CustomerController) ReadCsv(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Get the uploaded file
-	file, _, err := r.FormFile("file")
+	file, fileHeader, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "Failed to get file from form", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	tokenString := r.FormValue("token")
-	if tokenString == "" {
-		http.Error(w, "Token is required", http.StatusBadRequest)
+	format, err := model.ParseContactFormat(r.FormValue("format"), fileHeader.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	ip := r.Header.Get("X-Real-IP")
-	if ip == "" {
-		ip = r.Header.Get("X-Forwarded-For")
-		if ip == "" {
-			ip = r.RemoteAddr
-		}
+	mode, err := model.ParseImportMode(r.FormValue("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	if strings.Contains(ip, ":") {
-		host, _, err := net.SplitHostPort(ip)
-		if err == nil {
-			ip = host
-		}
+	onDuplicate, err := model.ParseDuplicatePolicy(r.FormValue("on_duplicate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	// token  validation part -starts
-
-	// tokenValidationErr := utils.IsTokenValid(tokenString)
-	// if tokenValidationErr != nil {
-	// 	http.Error(w, tokenValidationErr.Error(), http.StatusUnauthorized)
-	// 	return
-	// }
-
-	claims := &Claims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return utils.GetClientPublicKey(), nil
-	})
+	mapping, err := model.ParseColumnMapping(r.FormValue("mapping"))
 	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			http.Error(w, "Invalid token signature", http.StatusUnauthorized)
-			return
-		}
-		http.Error(w, "Failed to parse token", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	header, err := model.ParseHeaderMode(r.FormValue("header"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Check if token is expired
-	if claims.ExpiresAt.Time.Before(time.Now()) {
-		http.Error(w, "Token has expired", http.StatusUnauthorized)
+	delimiter, err := model.ParseDelimiter(r.FormValue("delimiter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	if claims.CreationDate.IsZero() || time.Now().Before(claims.CreationDate) {
-		http.Error(w, "Invalid token creation date", http.StatusUnauthorized)
+	encoding, err := model.ParseEncoding(r.FormValue("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	consent, err := model.ParseConsent(r.FormValue("consent"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var defaultCountryCode int
+	if value := r.FormValue("default_country_code"); value != "" {
+		defaultCountryCode, err = strconv.Atoi(strings.TrimPrefix(value, "+"))
+		if err != nil || defaultCountryCode <= 0 {
+			http.Error(w, "Invalid default_country_code", http.StatusBadRequest)
+			return
+		}
+	}
 
-	// token validation-ends
+	claims := utils.ClaimsFromContext(r.Context())
 
-	_, successResponse, err := customer.CSVService.ReadDataFromCSVFile(file, claims.UserID, ip)
+	schema, err := customer.attributeSchema()
 	if err != nil {
-		log.Println("Error reading data from CSV:", err)
-		http.Error(w, "Error reading data from CSV", http.StatusInternalServerError)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	// Keep a copy of the upload; the multipart file is gone once we return
+	upload, err := os.CreateTemp("", "contact-import-*")
+	if err != nil {
+		log.Println("Error creating temporary import file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(upload, file); err != nil {
+		upload.Close()
+		os.Remove(upload.Name())
+		log.Println("Error saving uploaded file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	upload.Close()
+
+	job := &model.ImportJob{
+		Format:      format,
+		Mode:        mode,
+		OnDuplicate: onDuplicate,
+		FileName:    fileHeader.Filename,
+		CreatedBy:   claims.UserID,
+		RequestedIP: clientIP(r),
+	}
+	if err := customer.JobService.CreateJob(job); err != nil {
+		os.Remove(upload.Name())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	go customer.runImportJob(job, upload.Name(), model.ImportOptions{
+		Mode:               mode,
+		OnDuplicate:        onDuplicate,
+		Mapping:            mapping,
+		Header:             header,
+		Delimiter:          delimiter,
+		Encoding:           encoding,
+		DefaultCountryCode: defaultCountryCode,
+		Tags:               model.SplitTags(r.FormValue("tags")),
+		Schema:             schema,
+		Consent:            consent,
+		Sheet:              r.FormValue("sheet"),
+	})
+
 	// Create a response map
 	response := map[string]interface{}{
 		"status":  "success",
-		"message": "Data retrieved successfully",
+		"message": "Import job created",
 		"data": map[string]interface{}{
-			"success": successResponse,
+			"job": job,
 		},
 	}
 
 	// Return the response as JSON
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(response)
 }
 
+// clientIP returns the address of the caller, preferring the headers set by
+// our reverse proxy.
+func clientIP(r *http.Request) string {
+	return utils.ClientIP(r)
+}
+
+// CountriesHandler lists countries. "code" filters by numeric calling code,
+// "iso" finds one country by ISO-3166 alpha-2 or alpha-3 code and "q"
+// searches by name prefix.
 func (customer *CustomerController) CountriesHandler(w http.ResponseWriter, r *http.Request) {
-	
-	countryCode := r.URL.Query().Get("code")
-	if countryCode != "" {
-		countries, err := customer.CountryService.GetCountriesByCode(countryCode)
-		if err != nil {
-			http.Error(w, "Failed to fetch countries", http.StatusInternalServerError)
+	query := r.URL.Query()
+
+	var countries []model.Country
+	var err error
+	switch {
+	case query.Get("code") != "":
+		countryCode, convErr := strconv.Atoi(strings.TrimPrefix(query.Get("code"), "+"))
+		if convErr != nil || countryCode <= 0 {
+			http.Error(w, "Invalid country code", http.StatusBadRequest)
 			return
 		}
-
-		if len(countries) == 0 {
-			http.Error(w, "No countries found", http.StatusNotFound)
-			return
+		countries, err = customer.CountryService.GetCountriesByCode(countryCode)
+	case query.Get("iso") != "":
+		var country *model.Country
+		country, err = customer.CountryService.GetCountryByISO(query.Get("iso"))
+		if country != nil {
+			countries = []model.Country{*country}
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(countries)
-		return
+	case query.Get("q") != "":
+		countries, err = customer.CountryService.SearchCountries(query.Get("q"))
+	default:
+		countries, err = customer.CountryService.GetAllCountries()
 	}
-	countries, err := customer.CountryService.GetAllCountries()
 	if err != nil {
+		log.Println("Error fetching countries:", err)
 		http.Error(w, "Failed to fetch countries", http.StatusInternalServerError)
 		return
 	}
 
-	if countries == nil {
+	if len(countries) == 0 {
 		http.Error(w, "No countries found", http.StatusNotFound)
 		return
 	}
@@ -285,4 +386,3 @@ func (customer *CustomerController) CountriesHandler(w http.ResponseWriter, r *h
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(countries)
 }
-
@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"whatbot/model"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// exportFlushInterval is how many rows are written between flushes to the client.
+const exportFlushInterval = 500
+
+var exportColumns = []string{"id", "gid", "name", "phone_number", "normalized_phone", "country_code", "email", "tags", "opt_in_status", "language", "timezone", "wa_profile_name", "first_seen_at", "last_seen_at", "created_date", "last_inbound_at", "attributes"}
+
+// customerFilterFromQuery reads the customer filters shared by listing and export.
+func customerFilterFromQuery(r *http.Request) (model.CustomerFilter, error) {
+	query := r.URL.Query()
+	filter := model.CustomerFilter{
+		Search:  strings.TrimSpace(query.Get("q")),
+		Tags:    model.NormalizeTags(query["tag"]),
+		Segment: query.Get("segment"),
+	}
+
+	switch archived := query.Get("archived"); archived {
+	case "", "false":
+	case "true", model.ArchivedOnly:
+		filter.Archived = model.ArchivedOnly
+	case model.ArchivedInclude:
+		filter.Archived = model.ArchivedInclude
+	default:
+		return filter, fmt.Errorf("invalid archived %q, use only or all", archived)
+	}
+
+	// attr.<key>=value matches a custom attribute
+	for name, values := range query {
+		if key := strings.TrimPrefix(name, "attr."); key != name && key != "" && len(values) > 0 {
+			if filter.Attributes == nil {
+				filter.Attributes = make(map[string]string)
+			}
+			filter.Attributes[key] = values[0]
+		}
+	}
+
+	if value := query.Get("country_code"); value != "" {
+		code, err := strconv.Atoi(strings.TrimPrefix(value, "+"))
+		if err != nil {
+			return filter, fmt.Errorf("invalid country_code %q", value)
+		}
+		filter.CountryCode = code
+	}
+	if value := query.Get("created_from"); value != "" {
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid created_from %q, expected YYYY-MM-DD", value)
+		}
+		filter.CreatedFrom = date
+	}
+	if value := query.Get("created_to"); value != "" {
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid created_to %q, expected YYYY-MM-DD", value)
+		}
+		// created_to is inclusive of the whole day
+		filter.CreatedTo = date.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+// writeFilterError answers with the status matching a filter error.
+func writeFilterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, model.ErrSegmentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, model.ErrInvalidExpression):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println("Error fetching customers:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// formatTime formats an optional timestamp, leaving missing ones empty.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func exportRecord(c *model.CustomerExport) []string {
+	attributes, _ := json.Marshal(c.Attributes)
+	return []string{
+		strconv.Itoa(c.ID),
+		c.GID,
+		c.Name,
+		c.PhoneNumber,
+		c.NormalizedPhone,
+		strconv.Itoa(c.CountryCode),
+		c.Email,
+		strings.Join(c.Tags, ";"),
+		c.OptInStatus,
+		c.Language,
+		c.Timezone,
+		c.WaProfileName,
+		formatTime(c.FirstSeenAt),
+		formatTime(c.LastSeenAt),
+		c.CreatedDate.Format(time.RFC3339),
+		formatTime(c.LastInboundAt),
+		string(attributes),
+	}
+}
+
+// ExportCustomers streams the filtered customer set as CSV, XLSX or NDJSON,
+// selected with the "format" query parameter.
+func (customer *CustomerController) ExportCustomers(w http.ResponseWriter, r *http.Request) {
+	filter, err := customerFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "csv"
+	}
+	filename := "customers-" + time.Now().Format("20060102-150405")
+	flusher, _ := w.(http.Flusher)
+
+	// begin sends the headers; it runs with the first row so that filter
+	// errors can still be answered with a proper status.
+	var begin func()
+	var writeOne func(c *model.CustomerExport) error
+	finish := func() error { return nil }
+
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		begin = func() {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+			writer.Write(exportColumns)
+		}
+		count := 0
+		writeOne = func(c *model.CustomerExport) error {
+			if err := writer.Write(exportRecord(c)); err != nil {
+				return err
+			}
+			if count++; count%exportFlushInterval == 0 {
+				writer.Flush()
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			return nil
+		}
+		finish = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+
+	case "ndjson", "json":
+		encoder := json.NewEncoder(w)
+		begin = func() {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".ndjson"))
+		}
+		count := 0
+		writeOne = func(c *model.CustomerExport) error {
+			if err := encoder.Encode(c); err != nil {
+				return err
+			}
+			if count++; count%exportFlushInterval == 0 && flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+	case "xlsx":
+		// The stream writer spills rows to a temporary file instead of
+		// building the whole sheet in memory.
+		workbook := excelize.NewFile()
+		defer workbook.Close()
+		stream, err := workbook.NewStreamWriter(workbook.GetSheetName(0))
+		if err != nil {
+			log.Println("Error creating XLSX stream writer:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		row := 1
+		writeRow := func(values []string) error {
+			cells := make([]interface{}, len(values))
+			for i, value := range values {
+				cells[i] = value
+			}
+			cell, _ := excelize.CoordinatesToCellName(1, row)
+			row++
+			return stream.SetRow(cell, cells)
+		}
+		begin = func() {
+			writeRow(exportColumns)
+		}
+		writeOne = func(c *model.CustomerExport) error {
+			return writeRow(exportRecord(c))
+		}
+		finish = func() error {
+			if err := stream.Flush(); err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".xlsx"))
+			return workbook.Write(w)
+		}
+
+	default:
+		http.Error(w, "Unsupported format, use csv, xlsx or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	started := false
+	err = customer.CustomerService.ExportCustomers(filter, func(c *model.CustomerExport) error {
+		if !started {
+			begin()
+			started = true
+		}
+		return writeOne(c)
+	})
+	if err != nil && !started {
+		writeFilterError(w, err)
+		return
+	}
+	if err != nil {
+		log.Println("Error exporting customers:", err)
+		if format == "xlsx" {
+			// Nothing has been sent yet for spreadsheets
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !started {
+		begin()
+	}
+	if err := finish(); err != nil {
+		log.Println("Error exporting customers:", err)
+	}
+}
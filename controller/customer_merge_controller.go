@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+type mergeRequest struct {
+	SurvivorGID string   `json:"survivor_gid"`
+	MergedGIDs  []string `json:"merged_gids"`
+}
+
+// FindDuplicates lists groups of customers that look like the same person.
+// "match" is a comma separated list of phone, email and name (all by
+// default); "limit" caps the number of groups.
+func (customer *CustomerController) FindDuplicates(w http.ResponseWriter, r *http.Request) {
+	matches := []string{model.MatchPhone, model.MatchEmail, model.MatchName}
+	if value := r.URL.Query().Get("match"); value != "" {
+		matches = nil
+		for _, match := range strings.Split(value, ",") {
+			matches = append(matches, strings.ToLower(strings.TrimSpace(match)))
+		}
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	groups, err := customer.MergeService.FindDuplicates(matches, limit)
+	if errors.Is(err, model.ErrUnknownMatch) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   groups,
+	})
+}
+
+// MergeCustomers merges the listed customers into the survivor.
+func (customer *CustomerController) MergeCustomers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request mergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	survivor, err := customer.MergeService.MergeCustomers(request.SurvivorGID, request.MergedGIDs, claims.UserID, clientIP(r))
+	if errors.Is(err, model.ErrInvalidMerge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Customers merged",
+		"data": map[string]interface{}{
+			"customer": customerResponse(survivor),
+			"merged":   request.MergedGIDs,
+		},
+	})
+}
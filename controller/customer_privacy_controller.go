@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+type eraseRequest struct {
+	CustomerGID string `json:"customer_gid"`
+	Mode        string `json:"mode"`
+	Reason      string `json:"reason"`
+}
+
+// ExportCustomerData answers a subject access request with a zip of
+// everything stored about the customer given by the "id" query parameter.
+// The archive is streamed, so a failure part way through truncates it.
+func (customer *CustomerController) ExportCustomerData(w http.ResponseWriter, r *http.Request) {
+	gid := r.URL.Query().Get("id")
+	started := false
+	err := customer.PrivacyService.ExportCustomerData(gid, func() io.Writer {
+		started = true
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "customer-"+gid+".zip"))
+		return w
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error exporting customer data:", err)
+		if !started {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+	}
+}
+
+// EraseCustomer deletes ("erase") or pseudonymizes ("pseudonymize") a
+// customer and blocks its phone number from being added again.
+func (customer *CustomerController) EraseCustomer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request eraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	mode := strings.ToLower(strings.TrimSpace(request.Mode))
+	if mode == "" {
+		mode = model.ErasureDelete
+	}
+	if mode != model.ErasureDelete && mode != model.ErasurePseudonymize {
+		http.Error(w, "Invalid mode, use erase or pseudonymize", http.StatusBadRequest)
+		return
+	}
+
+	err := customer.PrivacyService.EraseCustomer(request.CustomerGID, mode, request.Reason, claims.UserID, clientIP(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error erasing customer:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Customer " + mode + "d",
+	})
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+// jobProgressInterval is how many rows are written between progress updates.
+const jobProgressInterval = 200
+
+// runImportJob processes an uploaded contact file in the background and
+// records the outcome on the job. The file at path is removed afterwards.
+func (customer *CustomerController) runImportJob(job *model.ImportJob, path string, opts model.ImportOptions) {
+	defer os.Remove(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Println("Error opening import file:", err)
+		customer.JobService.FinishJob(job.GID, model.JobFailed, nil, err.Error())
+		return
+	}
+	defer file.Close()
+
+	if err := customer.JobService.StartJob(job.GID); err != nil {
+		log.Println("Error starting import job:", err)
+	}
+
+	opts.Progress = func(phase string, processed, total int) error {
+		// Checking reports once per batch; writing reports every row
+		if phase == model.ImportPhaseWriting && processed != 0 && processed != total && processed%jobProgressInterval != 0 {
+			return nil
+		}
+		cancelRequested, err := customer.JobService.UpdateProgress(job.GID, phase, processed, total)
+		if err != nil {
+			log.Println("Error updating import job progress:", err)
+			return nil
+		}
+		if cancelRequested {
+			return model.ErrImportCancelled
+		}
+		return nil
+	}
+
+	report, err := customer.ImportService.ImportContacts(file, job.Format, job.CreatedBy, job.RequestedIP, opts)
+	status, message := model.JobCompleted, ""
+	switch {
+	case err == model.ErrImportCancelled:
+		status, message = model.JobCancelled, err.Error()
+	case err != nil:
+		log.Println("Error importing contacts:", err)
+		status, message = model.JobFailed, err.Error()
+	}
+	customer.JobService.FinishJob(job.GID, status, report, message)
+}
+
+// ownJob returns the import job given by gid when it was started by the
+// request's user or the user is an admin, answering the request otherwise.
+func (customer *CustomerController) ownJob(w http.ResponseWriter, r *http.Request, gid string) (*model.ImportJob, bool) {
+	claims := utils.ClaimsFromContext(r.Context())
+
+	job, err := customer.JobService.GetJob(gid)
+	if err == nil && job.CreatedBy != claims.UserID && !claims.HasRole(model.RoleAdmin) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Println("Error fetching import job:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return job, true
+}
+
+// ImportJobStatus returns the progress and result of an import job. Only
+// the user who started the job and admins can see it.
+func (customer *CustomerController) ImportJobStatus(w http.ResponseWriter, r *http.Request) {
+	gid := r.URL.Query().Get("id")
+	if gid == "" {
+		http.Error(w, "Missing id in query", http.StatusBadRequest)
+		return
+	}
+
+	job, ok := customer.ownJob(w, r, gid)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   job,
+	})
+}
+
+// CancelImportJob asks a queued or running import job to stop. Rows already
+// written by a best_effort import are kept; atomic imports are rolled back.
+// Only the user who started the job and admins can cancel it.
+func (customer *CustomerController) CancelImportJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gid := r.FormValue("id")
+	if gid == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := customer.ownJob(w, r, gid); !ok {
+		return
+	}
+	cancelled, err := customer.JobService.RequestCancel(gid)
+	if err != nil {
+		log.Println("Error cancelling import job:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		http.Error(w, "Import job not found or already finished", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Cancellation requested",
+	})
+}
@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"whatbot/model"
+	"whatbot/utils"
+
+	"github.com/lib/pq"
+)
+
+// tagRequest selects customers by GID or by segment and lists tags to add or
+// remove.
+type tagRequest struct {
+	Tags         []string `json:"tags"`
+	CustomerGIDs []string `json:"customer_gids"`
+	Segment      string   `json:"segment"`
+}
+
+type segmentRequest struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListTags returns every tag with the number of customers carrying it.
+func (customer *CustomerController) ListTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := customer.TagService.ListTags()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   tags,
+	})
+}
+
+// AssignTags adds tags to the selected customers.
+func (customer *CustomerController) AssignTags(w http.ResponseWriter, r *http.Request) {
+	customer.changeTags(w, r, true)
+}
+
+// RemoveTags removes tags from the selected customers.
+func (customer *CustomerController) RemoveTags(w http.ResponseWriter, r *http.Request) {
+	customer.changeTags(w, r, false)
+}
+
+func (customer *CustomerController) changeTags(w http.ResponseWriter, r *http.Request, assign bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request tagRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	tags := model.NormalizeTags(request.Tags)
+	if len(tags) == 0 {
+		http.Error(w, "Missing tags in request body", http.StatusBadRequest)
+		return
+	}
+	if len(request.CustomerGIDs) == 0 && request.Segment == "" {
+		http.Error(w, "Provide customer_gids or a segment", http.StatusBadRequest)
+		return
+	}
+
+	filter := model.CustomerFilter{Segment: request.Segment}
+	if len(request.CustomerGIDs) > 0 {
+		filter.GIDs = request.CustomerGIDs
+	}
+
+	var affected int64
+	var err error
+	if assign {
+		affected, err = customer.TagService.AssignTags(filter, tags, claims.UserID)
+	} else {
+		affected, err = customer.TagService.RemoveTags(filter, tags)
+	}
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"tags":     tags,
+			"affected": affected,
+		},
+	})
+}
+
+// Segments lists saved segments (GET), creates one (POST) or deletes the
+// segment named by the "id" query parameter (DELETE).
+func (customer *CustomerController) Segments(w http.ResponseWriter, r *http.Request) {
+	claims := utils.ClaimsFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		segments, err := customer.SegmentService.ListSegments()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   segments,
+		})
+
+	case http.MethodPost:
+		var request segmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || strings.TrimSpace(request.Expression) == "" {
+			http.Error(w, "Missing name or expression in request body", http.StatusBadRequest)
+			return
+		}
+
+		segment := &model.Segment{Name: request.Name, Expression: request.Expression, CreatedBy: claims.UserID}
+		err := customer.SegmentService.CreateSegment(segment)
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, model.ErrInvalidExpression):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.As(err, &pqErr) && pqErr.Code == "23505":
+			http.Error(w, "A segment with this name already exists", http.StatusConflict)
+			return
+		case err != nil:
+			log.Println("Error creating segment:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"status": "success",
+			"data":   segment,
+		})
+
+	case http.MethodDelete:
+		deleted, err := customer.SegmentService.DeleteSegment(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, "Segment not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "Segment deleted",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PreviewSegment evaluates an expression, or a saved segment given by "id",
+// and returns the number of matching customers with the first few of them.
+func (customer *CustomerController) PreviewSegment(w http.ResponseWriter, r *http.Request) {
+	filter := model.CustomerFilter{Expression: r.URL.Query().Get("expression")}
+	if id := r.URL.Query().Get("id"); id != "" {
+		segment, err := customer.SegmentService.GetSegment(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Segment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		filter.Expression = segment.Expression
+	}
+	if strings.TrimSpace(filter.Expression) == "" {
+		http.Error(w, "Missing expression or id in query", http.StatusBadRequest)
+		return
+	}
+
+	customers, total, err := customer.CustomerService.CustomerList(filter, 0, 10)
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"total":     total,
+			"customers": customers,
+		},
+	})
+}
@@ -0,0 +1,361 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	envconfig "whatbot/dbConfig"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+// Second factors accepted by LoginVerify.
+const (
+	MethodWhatsAppOTP  = "whatsapp_otp"
+	MethodTOTP         = "totp"
+	MethodRecoveryCode = "recovery_code"
+)
+
+// sendOTP sends a new one-time code for purpose to the user's mobile over
+// WhatsApp.
+func (uc *UserController) sendOTP(user *model.User, purpose string) error {
+	config, err := envconfig.LoadConfig("config.json")
+	if err != nil {
+		return err
+	}
+	code, err := uc.TwoFactorService.CreateOTP(user.ID, purpose)
+	if err != nil {
+		return err
+	}
+	language := config.OTPTemplateLanguage
+	if language == "" {
+		language = model.DefaultTemplateLanguage
+	}
+	if _, err := model.SendAuthenticationCode(config.OTPTemplateName, strings.TrimPrefix(user.Mobile, "+"), language, code); err != nil {
+		log.Println("Error sending one-time code:", err)
+		return err
+	}
+	return nil
+}
+
+// writeOTPError answers a failed sendOTP or VerifyOTP.
+func writeOTPError(w http.ResponseWriter, err error) {
+	switch err {
+	case model.ErrOTPRateLimited:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case model.ErrInvalidCode, model.ErrOTPAttemptsExceeded:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, "Failed to send code", http.StatusBadGateway)
+	}
+}
+
+// loginMethods lists the second factors the user can log in with; none
+// means the password is enough.
+func loginMethods(user *model.User) []string {
+	methods := []string{}
+	if user.MobileOTPEnabled && user.MobileVerified && user.Mobile != "" {
+		methods = append(methods, MethodWhatsAppOTP)
+	}
+	if user.TOTPEnabled {
+		methods = append(methods, MethodTOTP, MethodRecoveryCode)
+	}
+	return methods
+}
+
+// startLoginChallenge answers a login whose password was right but which
+// needs a second factor, sending the WhatsApp code when that is the only
+// one.
+func (uc *UserController) startLoginChallenge(w http.ResponseWriter, r *http.Request, user *model.User, methods []string) {
+	token, err := uc.TwoFactorService.CreateLoginChallenge(user.ID, clientIP(r))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(methods) == 1 && methods[0] == MethodWhatsAppOTP {
+		if err := uc.sendOTP(user, model.OTPPurposeLogin); err != nil {
+			writeOTPError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"methods":      methods,
+	})
+}
+
+type loginVerifyRequest struct {
+	MfaToken string `json:"mfa_token"`
+	Method   string `json:"method"`
+	Code     string `json:"code"`
+}
+
+// LoginVerify completes a two-step login with a second factor and answers
+// with the tokens Login would have issued.
+func (uc *UserController) LoginVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request loginVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.MfaToken == "" || strings.TrimSpace(request.Code) == "" {
+		http.Error(w, "Missing mfa_token or code in request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := uc.TwoFactorService.LoginChallengeUser(request.MfaToken)
+	if err == model.ErrInvalidChallenge {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user, err := uc.UserService.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := user.LoginAllowed(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	methods := loginMethods(user)
+	method := request.Method
+	if method == "" && len(methods) > 0 {
+		method = methods[0]
+	}
+	allowed := false
+	for _, m := range methods {
+		allowed = allowed || m == method
+	}
+	if !allowed {
+		http.Error(w, "Unsupported method", http.StatusBadRequest)
+		return
+	}
+
+	// Wrong codes count as failed logins of the account, so that new
+	// challenges cannot be used to keep guessing
+	attempt, ok := uc.beginLoginAttempt(w, user.LoginUserName, clientIP(r))
+	if !ok {
+		return
+	}
+
+	switch method {
+	case MethodWhatsAppOTP:
+		err = uc.TwoFactorService.VerifyOTP(user.ID, model.OTPPurposeLogin, strings.TrimSpace(request.Code))
+	case MethodTOTP:
+		err = uc.TwoFactorService.VerifyTOTP(user.ID, request.Code)
+	case MethodRecoveryCode:
+		err = uc.TwoFactorService.UseRecoveryCode(user.ID, request.Code)
+	}
+	if err == model.ErrInvalidCode || err == model.ErrOTPAttemptsExceeded {
+		if err := uc.TwoFactorService.FailLoginChallenge(request.MfaToken); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := uc.TwoFactorService.CompleteLoginChallenge(request.MfaToken); err != nil {
+		if err == model.ErrInvalidChallenge {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := uc.LoginAttempts.SucceedLoginAttempt(attempt); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	uc.issueTokens(w, r, user)
+}
+
+// LoginResendCode sends a new WhatsApp code for a pending login.
+func (uc *UserController) LoginResendCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request loginVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.MfaToken == "" {
+		http.Error(w, "Missing mfa_token in request body", http.StatusBadRequest)
+		return
+	}
+	userID, err := uc.TwoFactorService.LoginChallengeUser(request.MfaToken)
+	if err == model.ErrInvalidChallenge {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user, err := uc.UserService.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !user.MobileOTPEnabled || !user.MobileVerified {
+		http.Error(w, "Unsupported method", http.StatusBadRequest)
+		return
+	}
+	if err := uc.sendOTP(user, model.OTPPurposeLogin); err != nil {
+		writeOTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Code sent",
+	})
+}
+
+// SendMobileVerification sends a verification code to the current user's
+// mobile number over WhatsApp.
+func (uc *UserController) SendMobileVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	user, err := uc.UserService.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if user.Mobile == "" {
+		http.Error(w, "No mobile number on this account", http.StatusBadRequest)
+		return
+	}
+	if user.MobileVerified {
+		http.Error(w, "Mobile number is already verified", http.StatusConflict)
+		return
+	}
+	if err := uc.sendOTP(user, model.OTPPurposeMobile); err != nil {
+		writeOTPError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Verification code sent",
+	})
+}
+
+// VerifyMobile checks the code sent by SendMobileVerification and marks the
+// current user's mobile number as verified.
+func (uc *UserController) VerifyMobile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request loginVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Code) == "" {
+		http.Error(w, "Missing code in request body", http.StatusBadRequest)
+		return
+	}
+	err := uc.TwoFactorService.VerifyOTP(claims.UserID, model.OTPPurposeMobile, strings.TrimSpace(request.Code))
+	if err == model.ErrInvalidCode || err == model.ErrOTPAttemptsExceeded {
+		writeOTPError(w, err)
+		return
+	}
+	if err == nil {
+		err = uc.TwoFactorService.SetMobileVerified(claims.UserID)
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Mobile number verified",
+	})
+}
+
+// MobileLoginCodes turns WhatsApp login codes on or off for the current
+// user. The password is asked for again, and the mobile number must be
+// verified to turn them on.
+func (uc *UserController) MobileLoginCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request struct {
+		Enabled  bool   `json:"enabled"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user, ok := uc.confirmPassword(w, r, claims.UserID, request.Password)
+	if !ok {
+		return
+	}
+	if request.Enabled && !user.MobileVerified {
+		http.Error(w, "Verify your mobile number first", http.StatusConflict)
+		return
+	}
+	if err := uc.TwoFactorService.SetMobileOTP(user.ID, request.Enabled); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	message := "WhatsApp login codes disabled"
+	if request.Enabled {
+		message = "WhatsApp login codes enabled"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": message,
+	})
+}
+
+// confirmPassword checks the password of the current user before a
+// security setting is changed, answering the request when it is wrong.
+// Wrong passwords count as failed logins of the account, so that a stolen
+// session cannot be used to guess the password.
+func (uc *UserController) confirmPassword(w http.ResponseWriter, r *http.Request, userID int, password string) (*model.User, bool) {
+	user, err := uc.UserService.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	attempt, ok := uc.beginLoginAttempt(w, user.LoginUserName, clientIP(r))
+	if !ok {
+		return nil, false
+	}
+	authenticated, err := uc.UserService.AuthenticateUser(user.LoginUserName, password)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if authenticated == nil || authenticated.ID != user.ID {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return nil, false
+	}
+	if err := uc.LoginAttempts.SucceedLoginAttempt(attempt); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
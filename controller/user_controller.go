@@ -3,13 +3,23 @@
 package controller
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	envconfig "whatbot/dbConfig"
+	"whatbot/mailer"
 	"whatbot/model"
 	"whatbot/utils"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 )
 
 type AuthResponse struct {
@@ -18,20 +28,20 @@ type AuthResponse struct {
 	UserName string `json:"username"`
 }
 
-type Claims struct {
-	UserID       int       `json:"userId"`
-	Username     string    `json:"username"`
-	UserGid      string    `json:"gid"`
-	CreationDate time.Time `json:"creation_date"`
-	jwt.RegisteredClaims
-}
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,50}$`)
 
 type UserController struct {
-	UserService model.UserRepository
+	UserService      model.UserRepository
+	SessionService   model.SessionRepository
+	InviteService    model.InviteRepository
+	TwoFactorService model.TwoFactorRepository
+	RoleService      model.RoleRepository
+	LoginAttempts    model.LoginAttemptRepository
+	Mailer           mailer.Mailer
 }
 
-func NewUserController(userService model.UserRepository) *UserController {
-	return &UserController{UserService: userService}
+func NewUserController(userService model.UserRepository, sessionService model.SessionRepository, inviteService model.InviteRepository, twoFactorService model.TwoFactorRepository, roleService model.RoleRepository, loginAttempts model.LoginAttemptRepository, mail mailer.Mailer) *UserController {
+	return &UserController{UserService: userService, SessionService: sessionService, InviteService: inviteService, TwoFactorService: twoFactorService, RoleService: roleService, LoginAttempts: loginAttempts, Mailer: mail}
 }
 
 func (uc *UserController) Login(w http.ResponseWriter, r *http.Request) {
@@ -55,99 +65,420 @@ func (uc *UserController) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Slow down and lock out repeated failures of the account or address
+	attempt, ok := uc.beginLoginAttempt(w, username, clientIP(r))
+	if !ok {
+		return
+	}
+
 	// Authenticate user
 	authenticated, err := uc.UserService.AuthenticateUser(username, password)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if authenticated == nil {
+		// Authentication failed
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err := authenticated.LoginAllowed(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// The attempt only succeeds, and clears the failures of the account,
+	// once the second factor has been given too
+	if methods := loginMethods(authenticated); len(methods) > 0 {
+		uc.startLoginChallenge(w, r, authenticated, methods)
+		return
+	}
+	if err := uc.LoginAttempts.SucceedLoginAttempt(attempt); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	uc.issueTokens(w, r, authenticated)
+}
+
+// beginLoginAttempt records a login attempt for username, answering with
+// 429 when earlier failures of the account or address require a wait.
+func (uc *UserController) beginLoginAttempt(w http.ResponseWriter, username, ip string) (int64, bool) {
+	attempt, wait, err := uc.LoginAttempts.BeginLoginAttempt(username, ip)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+		return 0, false
+	}
+	return attempt, true
+}
+
+// issueTokens starts a new session for the user and answers with its
+// tokens.
+func (uc *UserController) issueTokens(w http.ResponseWriter, r *http.Request, user *model.User) {
+	access := newAccessToken()
+	accessToken, err := signAccessToken(user, access)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	_, refreshLifetime := tokenLifetimes()
+	refreshToken, err := uc.SessionService.StartSession(user.ID, access, time.Now().Add(refreshLifetime), sessionClient(r))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, accessToken, access, refreshToken, user.ChangePassword)
+}
 
-	if authenticated != nil {
-		// Generate JWT token
-		token := jwt.New(jwt.SigningMethodRS256)
-		claims := &Claims{
-			UserID:       123,
-			Username:     authenticated.UserName,
-			UserGid:      authenticated.GID,
-			CreationDate: time.Now(),
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
-			},
+// tokenLifetimes returns how long access and refresh tokens are valid.
+func tokenLifetimes() (time.Duration, time.Duration) {
+	access, refresh := 15*time.Minute, 30*24*time.Hour
+	if config, err := envconfig.LoadConfig("config.json"); err == nil {
+		if config.AccessTokenMinutes > 0 {
+			access = time.Duration(config.AccessTokenMinutes) * time.Minute
+		}
+		if config.RefreshTokenDays > 0 {
+			refresh = time.Duration(config.RefreshTokenDays) * 24 * time.Hour
 		}
-		token.Claims = claims
+	}
+	return access, refresh
+}
+
+// newAccessToken picks the ID and expiry of a new access token.
+func newAccessToken() model.AccessToken {
+	accessLifetime, _ := tokenLifetimes()
+	return model.AccessToken{JTI: uuid.New().String(), ExpiresAt: time.Now().Add(accessLifetime)}
+}
+
+// signAccessToken issues the access token for the user.
+func signAccessToken(user *model.User, access model.AccessToken) (string, error) {
+	now := time.Now()
+	token := jwt.New(jwt.SigningMethodRS256)
+	token.Claims = &utils.Claims{
+		UserID:       user.ID,
+		Username:     user.UserName,
+		UserGid:      user.GID,
+		CreationDate: now,
+		// Until the password is changed the token only opens /password/change
+		PasswordChangeRequired: user.ChangePassword,
+		Roles:                  user.Roles,
+		Permissions:            user.Permissions,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        access.JTI,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(access.ExpiresAt),
+		},
+	}
+
+	// Sign the token with the RSA private key
+	tokenString, err := token.SignedString(utils.GetClientPrivateKey())
+	if err != nil {
+		log.Println("Error signing access token:", err)
+		return "", err
+	}
+	return tokenString, nil
+}
+
+func sessionClient(r *http.Request) model.SessionClient {
+	return model.SessionClient{IP: clientIP(r), UserAgent: r.UserAgent()}
+}
+
+// writeTokens answers with an access token and the refresh token that
+// replaces it once it expires.
+func writeTokens(w http.ResponseWriter, accessToken string, access model.AccessToken, refreshToken string, changePassword bool) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":           accessToken,
+		"token_type":      "Bearer",
+		"expires_in":      int(time.Until(access.ExpiresAt).Seconds()),
+		"refresh_token":   refreshToken,
+		"change_password": changePassword,
+	})
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh
+// token. Each refresh token can be used once.
+func (uc *UserController) Refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var requestBody struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if requestBody.RefreshToken == "" {
+		http.Error(w, "Missing refresh_token in request body", http.StatusBadRequest)
+		return
+	}
+
+	// The new access token's ID is recorded with the new refresh token, so
+	// it is decided before the token is signed
+	access := newAccessToken()
+	userID, refreshToken, err := uc.SessionService.RotateRefreshToken(requestBody.RefreshToken, access, sessionClient(r))
+	if err == model.ErrInvalidRefreshToken || err == model.ErrRefreshTokenReused {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := uc.UserService.GetUserByID(userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, model.ErrInvalidRefreshToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := user.LoginAllowed(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	accessToken, err := signAccessToken(user, access)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, accessToken, access, refreshToken, user.ChangePassword)
+}
 
-		// Sign the token with the RSA private key
-		tokenString, err := token.SignedString(utils.GetClientPrivateKey())
+// Logout revokes the request's access token and its session.
+func (uc *UserController) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	access := model.AccessToken{JTI: claims.ID, ExpiresAt: claims.ExpiresAt.Time}
+	if err := uc.SessionService.EndSession(claims.UserID, access); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Logged out",
+	})
+}
+
+// RevokeAllSessions signs the current user out everywhere, including the
+// session making the request.
+func (uc *UserController) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	sessions, err := uc.SessionService.RevokeAllSessions(claims.UserID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "All sessions revoked",
+		"data":    map[string]interface{}{"revoked": sessions},
+	})
+}
+
+// userProfile is the public view of a user; credentials are never included.
+type userProfile struct {
+	ID             int        `json:"id"`
+	GID            string     `json:"gid"`
+	Name           string     `json:"name"`
+	Username       string     `json:"username"`
+	Email          string     `json:"email"`
+	Mobile         string     `json:"mobile"`
+	Gender         string     `json:"gender"`
+	DateOfBirth    *time.Time `json:"date_of_birth"`
+	Active         bool       `json:"active"`
+	EmailVerified  bool       `json:"email_verified"`
+	MobileVerified bool       `json:"mobile_verified"`
+	ChangePassword bool       `json:"change_password"`
+	MFAMethods     []string   `json:"mfa_methods"`
+	Roles          []string   `json:"roles"`
+	Permissions    []string   `json:"permissions"`
+	CreatedDate    *time.Time `json:"created_date"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func userProfileResponse(user *model.User) userProfile {
+	return userProfile{
+		ID:             user.ID,
+		GID:            user.GID,
+		Name:           user.UserName,
+		Username:       user.LoginUserName,
+		Email:          user.Email,
+		Mobile:         user.Mobile,
+		Gender:         user.Gender,
+		DateOfBirth:    optionalTime(user.DateOfBirth),
+		Active:         user.Active,
+		EmailVerified:  user.EmailVerified,
+		MobileVerified: user.MobileVerified,
+		ChangePassword: user.ChangePassword,
+		MFAMethods:     loginMethods(user),
+		Roles:          user.Roles,
+		Permissions:    user.Permissions,
+		CreatedDate:    optionalTime(user.CreatedDate),
+	}
+}
+
+// Me returns the profile of the user the request's token was issued to.
+func (uc *UserController) Me(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	user, err := uc.UserService.GetUserByID(claims.UserID)
+	if err == sql.ErrNoRows || (err == nil && user.GID != claims.UserGid) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   userProfileResponse(user),
+	})
+}
+
+type registrationRequest struct {
+	Name            string `json:"name"`
+	Username        string `json:"username"`
+	Gender          string `json:"gender"`
+	DateOfBirth     string `json:"dob"`
+	CountryCode     int    `json:"country_code"`
+	Mobile          string `json:"mobile"`
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	RetypedPassword string `json:"retypedPassword"`
+	InviteToken     string `json:"invite_token"`
+}
+
+// UserRegistration creates an account. Without self-registration enabled an
+// invitation token is required, and the email must be the invited one.
+func (uc *UserController) UserRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var requestBody registrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	registration := model.Registration{
+		Name:        strings.TrimSpace(requestBody.Name),
+		Username:    strings.TrimSpace(requestBody.Username),
+		Email:       strings.TrimSpace(requestBody.Email),
+		Gender:      strings.TrimSpace(requestBody.Gender),
+		Password:    requestBody.Password,
+		InviteToken: strings.TrimSpace(requestBody.InviteToken),
+	}
+	switch {
+	case registration.Username == "":
+		http.Error(w, "Missing username in request body", http.StatusBadRequest)
+		return
+	case registration.Email == "":
+		http.Error(w, "Missing email in request body", http.StatusBadRequest)
+		return
+	case strings.TrimSpace(requestBody.Mobile) == "":
+		http.Error(w, "Missing mobile in request body", http.StatusBadRequest)
+		return
+	case requestBody.Password == "":
+		http.Error(w, "Missing password in request body", http.StatusBadRequest)
+		return
+	case requestBody.RetypedPassword != requestBody.Password:
+		http.Error(w, "Passwords do not match", http.StatusBadRequest)
+		return
+	}
+
+	if registration.InviteToken == "" {
+		config, err := envconfig.LoadConfig("config.json")
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-
-		// Set the JWT token in the response
-		response := map[string]string{
-			"token": tokenString,
+		if !config.AllowSelfRegistration {
+			http.Error(w, "Registration requires an invitation", http.StatusForbidden)
+			return
 		}
+	}
 
-		// Convert the response to JSON format
-		jsonResponse, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if !usernamePattern.MatchString(registration.Username) {
+		http.Error(w, "Username must be 3 to 50 letters, digits, dots, dashes or underscores", http.StatusBadRequest)
+		return
+	}
+	if !validEmail(&registration.Email) {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	mobile, err := utils.NormalizePhone(requestBody.CountryCode, requestBody.Mobile)
+	if err != nil {
+		http.Error(w, "Invalid mobile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	registration.Mobile = mobile
+	if requestBody.DateOfBirth != "" {
+		registration.DateOfBirth, err = time.Parse("2006-01-02", requestBody.DateOfBirth)
+		if err != nil || registration.DateOfBirth.After(time.Now()) {
+			http.Error(w, "Invalid dob, expected YYYY-MM-DD", http.StatusBadRequest)
 			return
 		}
+	}
+	if registration.Name == "" {
+		registration.Name = registration.Username
+	}
+	if err := model.ValidatePassword(registration.Password, registration.Username, registration.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		// Write the JSON response with the JWT token
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(jsonResponse)
-	} else {
-		// Authentication failed
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	user, err := uc.UserService.RegisterUser(registration)
+	switch err {
+	case nil:
+	case model.ErrUsernameTaken, model.ErrEmailTaken:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case model.ErrInvalidInvite, model.ErrInviteEmailMismatch:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !user.EmailVerified {
+		if err := uc.sendEmailVerification(user.ID); err != nil {
+			log.Println("Error sending verification email:", err)
+		}
 	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":  "success",
+		"message": "Registration successful",
+		"data":    userProfileResponse(user),
+	})
 }
-
-// func(uc *UserController) UserRegistration(w.http.http.ResponseWriter,r *http.Request){
-
-// 	var requestBody map[string]string
-// 	err := json.NewDecoder(r.Body).Decode(&requestBody)
-// 	if err != nil {
-// 		http.Error(w, "Invalid request", http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	username, ok := requestBody["username"]
-// 	if !ok {
-// 		http.Error(w, "Missing username in request body", http.StatusBadRequest)
-// 		return
-// 	}
-// 	gender, ok := requestBody["gender"]
-// 	if !ok {
-// 		http.Error(w, "Missing gender in request body", http.StatusBadRequest)
-// 		return
-// 	}
-// 	dob, ok := requestBody["dob"]
-// 	if !ok {
-// 		http.Error(w, "Missing dob in request body", http.StatusBadRequest)
-// 		return
-// 	}
-// 	mobile, ok := requestBody["mobile"]
-// 	if !ok {
-// 		http.Error(w, "Missing mobile in request body", http.StatusBadRequest)
-// 		return
-// 	}
-// 	email, ok := requestBody["email"]
-// 	if !ok {
-// 		http.Error(w, "Missing username in request body", http.StatusBadRequest)
-// 		return
-// 	}
-// 	password, ok := requestBody["password"]
-// 	if !ok {
-// 		http.Error(w, "Missing password in request body", http.StatusBadRequest)
-// 		return
-// 	}
-// 	retypedPassword, ok := requestBody["retypedPassword"]
-// 	if !ok {
-// 		http.Error(w, "Missing retypedPassword in request body", http.StatusBadRequest)
-// 		return
-// 	}
-
-// }
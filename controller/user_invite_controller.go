@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	envconfig "whatbot/dbConfig"
+	"whatbot/mailer"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+type inviteRequest struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+}
+
+// inviteExpiry is how long a new invitation stays valid.
+func inviteExpiry() (time.Duration, error) {
+	config, err := envconfig.LoadConfig("config.json")
+	if err != nil {
+		return 0, err
+	}
+	if config.InviteExpiryHours > 0 {
+		return time.Duration(config.InviteExpiryHours) * time.Hour, nil
+	}
+	return 72 * time.Hour, nil
+}
+
+// Invites lists invitations (GET), invites an email address (POST) or
+// revokes the pending invitation given by the "id" query parameter (DELETE).
+// Invited users register with the invitation's role, read_only unless
+// another is given. The invitation link is mailed; its token is also returned
+// once, when the invitation is created.
+func (uc *UserController) Invites(w http.ResponseWriter, r *http.Request) {
+	claims := utils.ClaimsFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		invites, err := uc.InviteService.ListInvites()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   invites,
+		})
+
+	case http.MethodPost:
+		var request inviteRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		email := strings.TrimSpace(request.Email)
+		if email == "" || !validEmail(&email) {
+			http.Error(w, "Invalid email", http.StatusBadRequest)
+			return
+		}
+		expiry, err := inviteExpiry()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		role := strings.TrimSpace(request.Role)
+		if role == "" {
+			role = model.RoleReadOnly
+		}
+		invite, token, err := uc.InviteService.CreateInvite(email, strings.TrimSpace(request.Name), role, claims.UserID, time.Now().Add(expiry))
+		if err == model.ErrEmailTaken {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err == model.ErrUnknownRole {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		message := "Invitation sent"
+		err = uc.Mailer.Send(mailer.Message{
+			To:      invite.Email,
+			Subject: "You have been invited to WhatBot",
+			Body: fmt.Sprintf("Hello %s,\n\n%s has invited you to WhatBot. Create your account here:\n\n%s\n\nThe invitation expires on %s.\n",
+				invite.Name, claims.Username, appLink("/register", token), invite.ExpiresAt.Format("2 Jan 2006 15:04")),
+		})
+		if err != nil {
+			log.Println("Error sending invitation mail:", err)
+			message = "Invitation created, but the email could not be sent"
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"status":  "success",
+			"message": message,
+			"data": map[string]interface{}{
+				"invite": invite,
+				"token":  token,
+			},
+		})
+
+	case http.MethodDelete:
+		revoked, err := uc.InviteService.RevokeInvite(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !revoked {
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "Invitation revoked",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// InviteDetails returns the email and name of the pending invitation given
+// by the "token" query parameter, so the registration form can be filled in.
+func (uc *UserController) InviteDetails(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	invite, err := uc.InviteService.GetInvite(r.URL.Query().Get("token"))
+	if err == model.ErrInvalidInvite {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"email":      invite.Email,
+			"name":       invite.Name,
+			"expires_at": invite.ExpiresAt,
+		},
+	})
+}
@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	envconfig "whatbot/dbConfig"
+	"whatbot/mailer"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+const (
+	passwordResetExpiry     = time.Hour
+	emailVerificationExpiry = 24 * time.Hour
+)
+
+// appLink returns the dashboard URL of path with the code as a query
+// parameter.
+func appLink(path, code string) string {
+	base := ""
+	if config, err := envconfig.LoadConfig("config.json"); err == nil {
+		base = strings.TrimRight(config.AppURL, "/")
+	}
+	return base + path + "?code=" + url.QueryEscape(code)
+}
+
+// sendEmailVerification mails a new verification code to the user.
+func (uc *UserController) sendEmailVerification(userID int) error {
+	user, code, err := uc.UserService.CreateEmailVerification(userID, time.Now().Add(emailVerificationExpiry))
+	if err != nil {
+		return err
+	}
+	return uc.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\nor entering this code: %s\n\nThe code expires in 24 hours.\n",
+			user.UserName, appLink("/verify-email", code), code),
+	})
+}
+
+type passwordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+	RetypedPassword string `json:"retypedPassword"`
+	Code            string `json:"code"`
+}
+
+func (request *passwordRequest) check(w http.ResponseWriter) bool {
+	if request.Password == "" {
+		http.Error(w, "Missing password in request body", http.StatusBadRequest)
+		return false
+	}
+	if request.RetypedPassword != request.Password {
+		http.Error(w, "Passwords do not match", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// ChangePassword replaces the current user's password. Every session is
+// ended and the caller gets fresh tokens, which also lifts a forced password
+// change.
+func (uc *UserController) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !request.check(w) {
+		return
+	}
+
+	err := uc.UserService.ChangePassword(claims.UserID, request.CurrentPassword, request.Password)
+	if err == model.ErrWrongPassword {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if _, ok := err.(*model.PasswordPolicyError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := uc.SessionService.RevokeAllSessions(claims.UserID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user, err := uc.UserService.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	uc.issueTokens(w, r, user)
+}
+
+// ForgotPassword mails a password reset link to the user with the given
+// username or email. The answer is the same whether or not such a user
+// exists.
+func (uc *UserController) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Login) == "" {
+		http.Error(w, "Missing login in request body", http.StatusBadRequest)
+		return
+	}
+
+	user, code, err := uc.UserService.CreatePasswordReset(request.Login, clientIP(r), time.Now().Add(passwordResetExpiry))
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if user != nil {
+		// Sent in the background so the response time does not tell
+		// whether the account exists
+		go func() {
+			err := uc.Mailer.Send(mailer.Message{
+				To:      user.Email,
+				Subject: "Reset your password",
+				Body: fmt.Sprintf("Hello %s,\n\nWe received a request to reset your password. Open this link to choose a new one:\n\n%s\n\nor enter this code: %s\n\nThe code expires in 1 hour and can be used once. If you did not ask for this, ignore this email.\n",
+					user.UserName, appLink("/reset-password", code), code),
+			})
+			if err != nil {
+				log.Println("Error sending password reset mail:", err)
+			}
+		}()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "If the account exists, a reset link has been sent to its email address",
+	})
+}
+
+// ResetPassword sets a new password using a code from ForgotPassword.
+func (uc *UserController) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Code) == "" {
+		http.Error(w, "Missing code in request body", http.StatusBadRequest)
+		return
+	}
+	if !request.check(w) {
+		return
+	}
+
+	_, err := uc.UserService.ResetPassword(strings.TrimSpace(request.Code), request.Password)
+	if err == model.ErrInvalidCode {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := err.(*model.PasswordPolicyError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Password has been reset, please log in",
+	})
+}
+
+// SendEmailVerification mails a new verification code to the current user.
+func (uc *UserController) SendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	user, err := uc.UserService.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if user.EmailVerified {
+		http.Error(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+	if user.Email == "" {
+		http.Error(w, "No email address on this account", http.StatusBadRequest)
+		return
+	}
+	if err := uc.sendEmailVerification(user.ID); err != nil {
+		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Verification email sent",
+	})
+}
+
+// VerifyEmail marks the email of the user owning the code as verified.
+func (uc *UserController) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Code) == "" {
+		http.Error(w, "Missing code in request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := uc.UserService.VerifyEmail(strings.TrimSpace(request.Code))
+	if err == model.ErrInvalidCode {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Email verified",
+		"data":    userProfileResponse(user),
+	})
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+// Roles lists the roles with the permissions they grant.
+func (uc *UserController) Roles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	roles, err := uc.RoleService.ListRoles()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   roles,
+	})
+}
+
+type userRolesRequest struct {
+	UserID int      `json:"user_id"`
+	Roles  []string `json:"roles"`
+}
+
+// UserRoles lists every user with their roles (GET) or replaces the roles of
+// one user (PUT or POST). The user is signed out so that their next login
+// picks up the new permissions.
+func (uc *UserController) UserRoles(w http.ResponseWriter, r *http.Request) {
+	claims := utils.ClaimsFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		users, err := uc.RoleService.ListUserRoles()
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   users,
+		})
+
+	case http.MethodPut, http.MethodPost:
+		var request userRolesRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserID <= 0 {
+			http.Error(w, "Missing user_id in request body", http.StatusBadRequest)
+			return
+		}
+		roles := []string{}
+		for _, role := range request.Roles {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+		if len(roles) == 0 {
+			http.Error(w, "At least one role is required", http.StatusBadRequest)
+			return
+		}
+
+		err := uc.RoleService.SetUserRoles(request.UserID, roles, claims.UserID)
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		case model.ErrUnknownRole:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case model.ErrLastAdmin:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":  "success",
+			"message": "Roles updated",
+			"data":    map[string]interface{}{"user_id": request.UserID, "roles": roles},
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
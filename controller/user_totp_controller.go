@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"whatbot/model"
+	"whatbot/utils"
+)
+
+// totpIssuer is the account issuer shown by authenticator apps.
+const totpIssuer = "WhatBot"
+
+// writeTOTPError answers a failed authenticator or recovery code call.
+func writeTOTPError(w http.ResponseWriter, err error) {
+	switch err {
+	case model.ErrTOTPEnabled, model.ErrTOTPNotPending:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case model.ErrInvalidCode:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case model.ErrNoTOTPKey:
+		http.Error(w, "Authenticator apps are not available", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// TOTPSetup starts authenticator app enrollment for the current user after
+// asking for the password again. The secret is returned with an otpauth URI
+// for the QR code; TOTP is only turned on by TOTPConfirm.
+func (uc *UserController) TOTPSetup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user, ok := uc.confirmPassword(w, r, claims.UserID, request.Password)
+	if !ok {
+		return
+	}
+	secret, err := uc.TwoFactorService.BeginTOTPEnrollment(user.ID)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	uri := utils.TOTPURI(totpIssuer, user.LoginUserName, secret)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Scan the QR code with your authenticator app and confirm with a code",
+		"data": map[string]interface{}{
+			"secret":      secret,
+			"otpauth_uri": uri,
+			"qr_payload":  uri,
+		},
+	})
+}
+
+// TOTPConfirm turns the authenticator app on with a first code and returns
+// the recovery codes, which are not shown again.
+func (uc *UserController) TOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request loginVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Code) == "" {
+		http.Error(w, "Missing code in request body", http.StatusBadRequest)
+		return
+	}
+	codes, err := uc.TwoFactorService.ConfirmTOTP(claims.UserID, request.Code)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Authenticator app enabled, store the recovery codes somewhere safe",
+		"data":    map[string]interface{}{"recovery_codes": codes},
+	})
+}
+
+// TOTPDisable turns the current user's authenticator app off after asking
+// for the password again.
+func (uc *UserController) TOTPDisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user, ok := uc.confirmPassword(w, r, claims.UserID, request.Password)
+	if !ok {
+		return
+	}
+	if err := uc.TwoFactorService.DisableTOTP(user.ID); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Authenticator app disabled",
+	})
+}
+
+// RecoveryCodes replaces the current user's recovery codes after asking for
+// the password again.
+func (uc *UserController) RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := utils.ClaimsFromContext(r.Context())
+
+	var request passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	user, ok := uc.confirmPassword(w, r, claims.UserID, request.Password)
+	if !ok {
+		return
+	}
+	codes, err := uc.TwoFactorService.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "New recovery codes created, the old ones no longer work",
+		"data":    map[string]interface{}{"recovery_codes": codes},
+	})
+}
+
+// ResetTwoFactor turns every second factor of another user off and signs
+// them out, for users who lost their device.
+func (uc *UserController) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserID <= 0 {
+		http.Error(w, "Missing user_id in request body", http.StatusBadRequest)
+		return
+	}
+	err := uc.TwoFactorService.ResetTwoFactor(request.UserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Two-factor authentication reset",
+	})
+}
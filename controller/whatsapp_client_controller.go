@@ -8,7 +8,11 @@ import (
 	"whatbot/model"
 )
 
-type TemplateController struct{}
+type TemplateController struct {
+	CustomerService model.CustomerRepository
+	ConsentService  model.ConsentRepository
+	MessageLog      model.OutboundMessageRepository
+}
 
 func (tc *TemplateController) GetAllTemplatesHandler(w http.ResponseWriter, r *http.Request) {
 	// Load configuration using the new envconfig package
@@ -1,31 +1,125 @@
 package controller
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"time"
+	envconfig "whatbot/dbConfig"
 	"whatbot/model"
+	"whatbot/utils"
 )
 
+type sendMsgRequest struct {
+	RecNumber    string                    `json:"recNumber"`
+	TemplateName string                    `json:"templateName"`
+	Parameters   []model.TemplateParameter `json:"parameters"`
+	// Language defaults to the recipient's preferred language.
+	Language string `json:"language"`
+	// IgnoreQuietHours sends even inside the recipient's quiet hours.
+	IgnoreQuietHours bool `json:"ignore_quiet_hours"`
+}
+
 func (tc *TemplateController) SendsingleMsg(w http.ResponseWriter, r *http.Request) {
 
-	var requestBody map[string]string
+	var requestBody sendMsgRequest
 	err := json.NewDecoder(r.Body).Decode(&requestBody)
 	if err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	recNumber, ok := requestBody["recNumber"]
-	if !ok {
+	recNumber := requestBody.RecNumber
+	if recNumber == "" {
 		http.Error(w, "Missing recNumber in request body", http.StatusBadRequest)
 		return
 	}
 
-	templateName, ok := requestBody["templateName"]
-	if !ok {
+	templateName := requestBody.TemplateName
+	if templateName == "" {
 		http.Error(w, "Missing templatename in request body", http.StatusBadRequest)
 		return
 	}
-	msgsend, err := model.SendMsg(templateName, recNumber)
+
+	normalized, err := utils.NormalizePhone(0, "+"+strings.TrimPrefix(recNumber, "+"))
+	if err != nil {
+		http.Error(w, "Invalid recNumber", http.StatusBadRequest)
+		return
+	}
+	err = tc.ConsentService.CheckSendAllowed(normalized)
+	if err == model.ErrOptedOut || err == model.ErrRecipientArchived {
+		tc.MessageLog.LogOutbound(&model.OutboundMessage{RecipientPhone: normalized, TemplateName: templateName, Status: model.OutboundBlocked, ErrorMessage: err.Error()})
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Println("Error checking recipient consent:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	language, err := model.ParseLanguage(requestBody.Language)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The recipient's record supplies sourced parameters, its language and
+	// its timezone; unknown recipients use the defaults
+	recipient, err := tc.CustomerService.GetCustomerByPhone(normalized)
+	if err == sql.ErrNoRows {
+		recipient, err = nil, nil
+	}
+	if err != nil {
+		log.Println("Error fetching recipient:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	parameters, err := model.ResolveTemplateParameters(recipient, requestBody.Parameters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timezone := ""
+	if recipient != nil {
+		timezone = recipient.TIMEZONE
+		if language == "" {
+			language = recipient.LANGUAGE
+		}
+	}
+	if language == "" {
+		language = model.DefaultTemplateLanguage
+	}
+
+	if !requestBody.IgnoreQuietHours {
+		config, err := envconfig.LoadConfig("config.json")
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		quiet := model.QuietHours{Start: config.QuietHoursStart, End: config.QuietHoursEnd}
+		inside, until, err := quiet.Contains(time.Now(), timezone, config.DefaultTimezone)
+		if err != nil {
+			log.Println("Error checking quiet hours:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if inside {
+			http.Error(w, fmt.Sprintf("Recipient is in quiet hours until %s", until.Format(time.RFC3339)), http.StatusConflict)
+			return
+		}
+	}
+
+	msgsend, err := model.SendMsg(templateName, recNumber, language, parameters)
+	outbound := &model.OutboundMessage{RecipientPhone: normalized, TemplateName: templateName, Parameters: parameters, Status: model.OutboundSent}
+	if err != nil {
+		outbound.Status, outbound.ErrorMessage = model.OutboundFailed, err.Error()
+	} else if len(msgsend.Messages) > 0 {
+		outbound.WaMessageID = msgsend.Messages[0].ID
+	}
+	tc.MessageLog.LogOutbound(outbound)
 	if err != nil {
 		http.Error(w, "Failed to Send Message", http.StatusBadRequest)
 		return
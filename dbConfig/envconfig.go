@@ -14,6 +14,52 @@ type Config struct {
 	WabaId        string `json:"WABA-ID"`
 	Version       string `json:"Version"`
 	Url           string `json:"Url"`
+	// Inbound messages consisting of one of these keywords opt the sender
+	// out of (or back into) messages.
+	OptOutKeywords []string `json:"Opt-Out-Keywords"`
+	OptInKeywords  []string `json:"Opt-In-Keywords"`
+	// Archived customers are purged after this many days; 0 keeps them.
+	CustomerRetentionDays int `json:"Customer-Retention-Days"`
+	// Template messages are held back between these local times ("HH:MM")
+	// of the recipient, whose timezone defaults to DefaultTimezone.
+	QuietHoursStart string `json:"Quiet-Hours-Start"`
+	QuietHoursEnd   string `json:"Quiet-Hours-End"`
+	DefaultTimezone string `json:"Default-Timezone"`
+	// Lifetimes of login tokens; zero uses 15 minutes and 30 days.
+	AccessTokenMinutes int `json:"Access-Token-Minutes"`
+	RefreshTokenDays   int `json:"Refresh-Token-Days"`
+	// Without self-registration, accounts can only be created from an
+	// invitation, which is valid for InviteExpiryHours (72 when zero).
+	AllowSelfRegistration bool `json:"Allow-Self-Registration"`
+	InviteExpiryHours     int  `json:"Invite-Expiry-Hours"`
+	// Mail is sent over SMTP when Mail-Backend is "smtp"; otherwise it is
+	// written to Mail-Log-File, or the log, for local testing.
+	MailBackend  string `json:"Mail-Backend"`
+	MailFrom     string `json:"Mail-From"`
+	MailLogFile  string `json:"Mail-Log-File"`
+	SMTPHost     string `json:"SMTP-Host"`
+	SMTPPort     int    `json:"SMTP-Port"`
+	SMTPUsername string `json:"SMTP-Username"`
+	SMTPPassword string `json:"SMTP-Password"`
+	// TombstoneSecret keys the hash of erased phone numbers, which could
+	// otherwise be recovered by hashing every possible number. Changing it
+	// forgets every erasure. Like TOTPEncryptionKey it must never be
+	// committed; both are normally set with the WHATBOT_TOMBSTONE_SECRET
+	// and WHATBOT_TOTP_ENCRYPTION_KEY environment variables, which take
+	// precedence over config.json.
+	TombstoneSecret string `json:"Tombstone-Secret"`
+	// TOTPEncryptionKey is the base64 encoded 32-byte AES key that
+	// authenticator secrets are encrypted with.
+	TOTPEncryptionKey string `json:"TOTP-Encryption-Key"`
+	// Forwarding headers are only believed from these proxy addresses or
+	// CIDR ranges; otherwise the peer address identifies the client.
+	TrustedProxies []string `json:"Trusted-Proxies"`
+	// AppURL is the dashboard address used in links sent by email.
+	AppURL string `json:"App-URL"`
+	// One-time login and verification codes are sent with this
+	// authentication template.
+	OTPTemplateName     string `json:"OTP-Template-Name"`
+	OTPTemplateLanguage string `json:"OTP-Template-Language"`
 }
 
 // LoadConfig reads the configuration from config.json and returns a Config instance.
@@ -35,6 +81,12 @@ func LoadConfig(path string) (*Config, error) {
 		log.Printf("Error unmarshalling config data: %v", err)
 		return nil, err
 	}
+	if secret := os.Getenv("WHATBOT_TOMBSTONE_SECRET"); secret != "" {
+		config.TombstoneSecret = secret
+	}
+	if key := os.Getenv("WHATBOT_TOTP_ENCRYPTION_KEY"); key != "" {
+		config.TOTPEncryptionKey = key
+	}
 
 	return &config, nil
 }
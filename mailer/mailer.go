@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	envconfig "whatbot/dbConfig"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Backends selectable with "Mail-Backend".
+const (
+	BackendSMTP = "smtp"
+	BackendLog  = "log"
+)
+
+// New returns the mailer configured by "Mail-Backend": SMTP, or by default
+// the log backend, which is meant for local testing.
+func New(config *envconfig.Config) Mailer {
+	if strings.EqualFold(config.MailBackend, BackendSMTP) {
+		return &SMTPMailer{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+			From:     config.MailFrom,
+		}
+	}
+	return &LogMailer{Path: config.MailLogFile, From: config.MailFrom}
+}
+
+// SMTPMailer sends mail through an SMTP server, using STARTTLS when the
+// server offers it.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	port := m.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := fmt.Sprintf("%s:%d", m.Host, port)
+	if err := smtp.SendMail(addr, auth, m.From, []string{msg.To}, format(m.From, msg)); err != nil {
+		log.Println("Error sending mail:", err)
+		return err
+	}
+	return nil
+}
+
+// LogMailer appends messages to a file, or writes them to the log when Path
+// is empty, instead of sending them.
+type LogMailer struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	if m.Path == "" {
+		log.Printf("Mail to %s: %s\n%s\n", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Error opening mail log:", err)
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(format(m.From, msg), "\r\n"...))
+	return err
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -6,9 +6,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 	"whatbot/controller"
 	dbconfig "whatbot/dbConfig"
+	"whatbot/mailer"
 	"whatbot/model"
+	"whatbot/utils"
 	"whatbot/webhook"
 
 	_ "github.com/lib/pq"
@@ -26,6 +31,21 @@ func main() {
 	}
 	defer db.Close()
 
+	// Secrets are read once; they are never committed to config.json
+	config, err := dbconfig.LoadConfig("config.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.TombstoneSecret == "" {
+		log.Fatal("Tombstone-Secret is not set, set WHATBOT_TOMBSTONE_SECRET to a long random value")
+	}
+	model.SetTombstoneSecret(config.TombstoneSecret)
+	if config.TOTPEncryptionKey == "" {
+		log.Println("TOTP-Encryption-Key is not set, authenticator apps are disabled until WHATBOT_TOTP_ENCRYPTION_KEY is set")
+	} else if err := model.SetTOTPEncryptionKey(config.TOTPEncryptionKey); err != nil {
+		log.Fatal(err)
+	}
+
 	// Start the webhook server
 	go StartWebhookServer(db)
 
@@ -94,12 +114,16 @@ func webhookHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, payload
 			return
 		}
 
+		// Customers are saved first so the stored message links to them
+		touchInboundContacts(db, contactResponses, messageResponses)
+
 		err = webhook.InsertWhatsappMsgData(db, jsonResponse)
 		if err != nil {
 			fmt.Println("Error inserting data:", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		applyConsentKeywords(db, messageResponses)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(jsonResponse)
@@ -108,28 +132,141 @@ func webhookHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, payload
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
+// touchInboundContacts creates or refreshes a customer for every contact of
+// an inbound message.
+func touchInboundContacts(db *sql.DB, contacts, messages []map[string]interface{}) {
+	customerRepository := model.NewCustomerRepository(db)
+	for _, contact := range contacts {
+		waID, _ := contact["waID"].(string)
+		profileName, _ := contact["profileName"].(string)
+		if waID == "" {
+			continue
+		}
+
+		seenAt := time.Now()
+		for _, message := range messages {
+			if from, _ := message["from"].(string); from != waID {
+				continue
+			}
+			timestamp, _ := message["timestamp"].(string)
+			if seconds, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+				seenAt = time.Unix(seconds, 0)
+			}
+		}
+
+		if _, err := customerRepository.TouchInboundContact(waID, profileName, seenAt); err != nil {
+			log.Println("Error saving inbound contact:", err)
+		}
+	}
+}
+
+// applyConsentKeywords opts senders in or out when their whole message is one
+// of the configured keywords.
+func applyConsentKeywords(db *sql.DB, messages []map[string]interface{}) {
+	config, err := dbconfig.LoadConfig("config.json")
+	if err != nil {
+		return
+	}
+	consentRepository := model.NewConsentRepository(db)
+	for _, message := range messages {
+		from, _ := message["from"].(string)
+		body, _ := message["msgBody"].(string)
+		status := model.MatchConsentKeyword(body, config.OptOutKeywords, config.OptInKeywords)
+		if status == "" || from == "" {
+			continue
+		}
+		_, err := consentRepository.SetConsentByPhone("+"+strings.TrimPrefix(from, "+"), model.ConsentChange{
+			Status: status,
+			Source: model.ConsentSourceWebhook,
+			Note:   "keyword " + strings.ToUpper(strings.TrimSpace(body)),
+		})
+		if err != nil {
+			log.Println("Error applying consent keyword:", err)
+		}
+	}
+}
+
 func StartWebhookServer(db *sql.DB) {
 	http.HandleFunc("/webhook", webhook.WebhookHandler(webhookHandler, db))
 	log.Println("Webhook server started")
 	log.Fatal(http.ListenAndServe(":3000", nil))
 }
 
+// runCustomerRetention purges customers archived for longer than
+// Customer-Retention-Days, once at startup and then daily.
+func runCustomerRetention(customerRepository model.CustomerRepository) {
+	for {
+		config, err := dbconfig.LoadConfig("config.json")
+		if err == nil && config.CustomerRetentionDays > 0 {
+			before := time.Now().AddDate(0, 0, -config.CustomerRetentionDays)
+			purged, err := customerRepository.PurgeArchived(before)
+			if err != nil {
+				log.Println("Error running customer retention:", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d archived customers\n", purged)
+			}
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// runTokenCleanup drops expired refresh tokens, denylist entries and old
+// login attempts every hour.
+func runTokenCleanup(sessionRepository model.SessionRepository, loginAttemptRepository model.LoginAttemptRepository) {
+	for {
+		if _, err := sessionRepository.PurgeExpiredTokens(); err != nil {
+			log.Println("Error purging expired tokens:", err)
+		}
+		if _, err := loginAttemptRepository.PurgeLoginAttempts(); err != nil {
+			log.Println("Error purging login attempts:", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
 func StartHTTPServer(db *sql.DB) {
 	userRepository := model.NewUserRepository(db)
-	userController := controller.NewUserController(userRepository)
+	sessionRepository := model.NewSessionRepository(db)
+	inviteRepository := model.NewInviteRepository(db)
+	var mail mailer.Mailer = &mailer.LogMailer{}
+	if config, err := dbconfig.LoadConfig("config.json"); err == nil {
+		mail = mailer.New(config)
+		if err := utils.SetTrustedProxies(config.TrustedProxies); err != nil {
+			log.Fatal("Error reading Trusted-Proxies: ", err)
+		}
+	}
+	twoFactorRepository := model.NewTwoFactorRepository(db)
+	roleRepository := model.NewRoleRepository(db)
+	loginAttemptRepository := model.NewLoginAttemptRepository(db)
+	go runTokenCleanup(sessionRepository, loginAttemptRepository)
+	apiKeyRepository := model.NewAPIKeyRepository(db)
+	apiKeyController := controller.NewAPIKeyController(apiKeyRepository)
+	userController := controller.NewUserController(userRepository, sessionRepository, inviteRepository, twoFactorRepository, roleRepository, loginAttemptRepository, mail)
 
 	customerRepository := model.NewCustomerRepository(db)
-	csvRepository := model.NewCsvRepository(db)
-	countryRepo := model.NewCountryRepository(db)  // Add this line
-	customerController := controller.NewCustomerController(customerRepository, csvRepository,countryRepo)
+	go runCustomerRetention(customerRepository)
+	contactImporter := model.NewContactImporter(db)
+	countryRepo := model.NewCachedCountryRepository(model.NewCountryRepository(db), time.Hour)
+	importJobRepository := model.NewImportJobRepository(db)
+	if err := importJobRepository.FailInterruptedJobs(); err != nil {
+		log.Println("Error failing interrupted import jobs:", err)
+	}
+	tagRepository := model.NewTagRepository(db)
+	segmentRepository := model.NewSegmentRepository(db)
+	attributeSchemaRepository := model.NewAttributeSchemaRepository(db)
+	consentRepository := model.NewConsentRepository(db)
+	customerMergeRepository := model.NewCustomerMergeRepository(db)
+	outboundMessageRepository := model.NewOutboundMessageRepository(db)
+	privacyRepository := model.NewPrivacyRepository(db)
+	customerController := controller.NewCustomerController(customerRepository, contactImporter, countryRepo, importJobRepository, tagRepository, segmentRepository, attributeSchemaRepository, consentRepository, customerMergeRepository, privacyRepository)
 
-	whatsappController := controller.TemplateController{}
+	whatsappController := controller.TemplateController{CustomerService: customerRepository, ConsentService: consentRepository, MessageLog: outboundMessageRepository}
 
 	corsMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -141,11 +278,75 @@ func StartHTTPServer(db *sql.DB) {
 	}
 
 	http.Handle("/login", corsMiddleware(http.HandlerFunc(userController.Login)))
-	http.Handle("/customer/list", corsMiddleware(http.HandlerFunc(customerController.ListAllCustomer)))
-	http.Handle("/templates/", corsMiddleware(http.HandlerFunc(whatsappController.GetAllTemplatesHandler)))
-	http.Handle("/sendmessage/", corsMiddleware(http.HandlerFunc(whatsappController.SendsingleMsg)))
-	http.Handle("/customer/data/csv/", corsMiddleware(http.HandlerFunc(customerController.ReadCsv)))
-	http.Handle("/countries", corsMiddleware(http.HandlerFunc(customerController.CountriesHandler)))
+	http.Handle("/token/refresh", corsMiddleware(http.HandlerFunc(userController.Refresh)))
+	http.Handle("/register", corsMiddleware(http.HandlerFunc(userController.UserRegistration)))
+	http.Handle("/register/invite", corsMiddleware(http.HandlerFunc(userController.InviteDetails)))
+
+	http.Handle("/login/verify", corsMiddleware(http.HandlerFunc(userController.LoginVerify)))
+	http.Handle("/login/resend-code", corsMiddleware(http.HandlerFunc(userController.LoginResendCode)))
+	http.Handle("/password/forgot", corsMiddleware(http.HandlerFunc(userController.ForgotPassword)))
+	http.Handle("/password/reset", corsMiddleware(http.HandlerFunc(userController.ResetPassword)))
+	http.Handle("/email/verify", corsMiddleware(http.HandlerFunc(userController.VerifyEmail)))
+
+	// Every other route needs a valid Bearer token. Users who must change
+	// their password can only reach the routes using authenticated.
+	authMiddleware := utils.AuthMiddleware(sessionRepository, nil)
+	authenticated := func(handler http.HandlerFunc) http.Handler {
+		return corsMiddleware(authMiddleware(handler))
+	}
+	protected := func(handler http.HandlerFunc) http.Handler {
+		return corsMiddleware(authMiddleware(utils.PasswordChangeGuard(handler)))
+	}
+	// require and requireByMethod also check the permission the route needs,
+	// and accept API keys as well as tokens
+	apiAuthMiddleware := utils.AuthMiddleware(sessionRepository, apiKeyRepository)
+	require := func(permission string, handler http.HandlerFunc) http.Handler {
+		return corsMiddleware(apiAuthMiddleware(utils.PasswordChangeGuard(utils.RequirePermission(permission)(handler))))
+	}
+	requireByMethod := func(read, write string, handler http.HandlerFunc) http.Handler {
+		return corsMiddleware(apiAuthMiddleware(utils.PasswordChangeGuard(utils.RequireMethodPermission(read, write)(handler))))
+	}
+	http.Handle("/me", authenticated(userController.Me))
+	http.Handle("/logout", authenticated(userController.Logout))
+	http.Handle("/sessions/revoke-all", authenticated(userController.RevokeAllSessions))
+	http.Handle("/password/change", authenticated(userController.ChangePassword))
+	http.Handle("/email/verify/send", protected(userController.SendEmailVerification))
+	http.Handle("/mobile/verify/send", protected(userController.SendMobileVerification))
+	http.Handle("/mobile/verify", protected(userController.VerifyMobile))
+	http.Handle("/mfa/whatsapp", protected(userController.MobileLoginCodes))
+	http.Handle("/mfa/totp/setup", protected(userController.TOTPSetup))
+	http.Handle("/mfa/totp/confirm", protected(userController.TOTPConfirm))
+	http.Handle("/mfa/totp/disable", protected(userController.TOTPDisable))
+	http.Handle("/mfa/recovery-codes", protected(userController.RecoveryCodes))
+	http.Handle("/roles", require(model.PermUsersManage, userController.Roles))
+	http.Handle("/users/roles", require(model.PermUsersManage, userController.UserRoles))
+	http.Handle("/users/mfa/reset", require(model.PermUsersManage, userController.ResetTwoFactor))
+	http.Handle("/users/invites", require(model.PermUsersManage, userController.Invites))
+	http.Handle("/api-keys", require(model.PermAPIKeysManage, apiKeyController.APIKeys))
+	http.Handle("/customer/list", require(model.PermCustomersRead, customerController.ListAllCustomer))
+	http.Handle("/customer/create", require(model.PermCustomersWrite, customerController.CreateCustomer))
+	http.Handle("/customer/update", require(model.PermCustomersWrite, customerController.UpdateCustomer))
+	http.Handle("/customer/duplicates", require(model.PermCustomersRead, customerController.FindDuplicates))
+	http.Handle("/customer/merge", require(model.PermCustomersWrite, customerController.MergeCustomers))
+	http.Handle("/customer/delete", require(model.PermCustomersDelete, customerController.DeleteCustomer))
+	http.Handle("/customer/restore", require(model.PermCustomersDelete, customerController.RestoreCustomer))
+	http.Handle("/customer/data-export", require(model.PermPrivacyManage, customerController.ExportCustomerData))
+	http.Handle("/customer/erase", require(model.PermPrivacyManage, customerController.EraseCustomer))
+	http.Handle("/customer/consent", requireByMethod(model.PermCustomersRead, model.PermCustomersWrite, customerController.CustomerConsent))
+	http.Handle("/customer/attributes", requireByMethod(model.PermCustomersRead, model.PermAttributesManage, customerController.CustomerAttributes))
+	http.Handle("/customer/export", require(model.PermCustomersExport, customerController.ExportCustomers))
+	http.Handle("/customer/tags/assign", require(model.PermCustomersWrite, customerController.AssignTags))
+	http.Handle("/customer/tags/remove", require(model.PermCustomersWrite, customerController.RemoveTags))
+	http.Handle("/tags", require(model.PermCustomersRead, customerController.ListTags))
+	http.Handle("/segments", requireByMethod(model.PermCustomersRead, model.PermSegmentsManage, customerController.Segments))
+	http.Handle("/segments/preview", require(model.PermCustomersRead, customerController.PreviewSegment))
+	http.Handle("/templates/", require(model.PermTemplatesRead, whatsappController.GetAllTemplatesHandler))
+	http.Handle("/sendmessage/", require(model.PermMessagesSend, whatsappController.SendsingleMsg))
+	http.Handle("/customer/data/csv/", require(model.PermCustomersImport, customerController.ReadCsv))
+	http.Handle("/customer/data/import/", require(model.PermCustomersImport, customerController.ReadCsv))
+	http.Handle("/customer/import/job", require(model.PermCustomersImport, customerController.ImportJobStatus))
+	http.Handle("/customer/import/job/cancel", require(model.PermCustomersImport, customerController.CancelImportJob))
+	http.Handle("/countries", protected(customerController.CountriesHandler))
 
 	log.Printf("Starting HTTP server on port %d...\n", PORT)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", PORT), nil))
@@ -0,0 +1,32 @@
+-- Store every customer phone number in E.164 form and make it unique so that
+-- re-uploading the same file does not create duplicate customers.
+
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS normalized_phone VARCHAR(16);
+
+-- Mirrors utils.NormalizePhone for national numbers.
+WITH digits AS (
+    SELECT id,
+           country_code::text AS cc,
+           regexp_replace(regexp_replace(phone_number, '\D', '', 'g'), '^0+', '') AS d
+    FROM public.customer
+    WHERE normalized_phone IS NULL
+)
+UPDATE public.customer c
+SET normalized_phone = '+' || digits.cc ||
+    CASE WHEN length(digits.d) > 10 AND digits.d LIKE digits.cc || '%'
+         THEN substr(digits.d, length(digits.cc) + 1)
+         ELSE digits.d
+    END
+FROM digits
+WHERE c.id = digits.id;
+
+-- Existing duplicates keep the oldest record; the others are left without a
+-- normalized phone so they can be reviewed and merged by hand.
+UPDATE public.customer c
+SET normalized_phone = NULL
+FROM public.customer keep
+WHERE c.normalized_phone = keep.normalized_phone
+  AND c.id > keep.id;
+
+ALTER TABLE public.customer
+    ADD CONSTRAINT customer_normalized_phone_key UNIQUE (normalized_phone);
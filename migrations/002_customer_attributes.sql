@@ -0,0 +1,4 @@
+-- Custom attributes for customers. Columns of an uploaded file that are not
+-- mapped to a contact field are stored here, keyed by their header name.
+
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}'::jsonb;
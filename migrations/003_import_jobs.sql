@@ -0,0 +1,29 @@
+-- Background contact imports. Uploads are stored as jobs and processed
+-- asynchronously; progress and results are recorded here.
+
+CREATE TABLE IF NOT EXISTS public.import_jobs (
+    id               SERIAL PRIMARY KEY,
+    gid              UUID NOT NULL UNIQUE,
+    status           VARCHAR(20) NOT NULL DEFAULT 'queued',
+    format           VARCHAR(10) NOT NULL,
+    mode             VARCHAR(20) NOT NULL,
+    on_duplicate     VARCHAR(20) NOT NULL,
+    file_name        TEXT NOT NULL DEFAULT '',
+    total_rows       INTEGER NOT NULL DEFAULT 0,
+    processed_rows   INTEGER NOT NULL DEFAULT 0,
+    created_count    INTEGER NOT NULL DEFAULT 0,
+    updated_count    INTEGER NOT NULL DEFAULT 0,
+    skipped_count    INTEGER NOT NULL DEFAULT 0,
+    invalid_count    INTEGER NOT NULL DEFAULT 0,
+    errors           JSONB NOT NULL DEFAULT '[]'::jsonb,
+    report           JSONB,
+    error_message    TEXT NOT NULL DEFAULT '',
+    cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+    created_by       INTEGER NOT NULL,
+    requested_ip     VARCHAR(64) NOT NULL DEFAULT '',
+    created_date     TIMESTAMP NOT NULL DEFAULT now(),
+    started_at       TIMESTAMP,
+    finished_at      TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS import_jobs_created_by_idx ON public.import_jobs (created_by, created_date DESC);
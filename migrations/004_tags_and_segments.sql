@@ -0,0 +1,28 @@
+-- Customer tags (many-to-many) and saved segments.
+
+CREATE TABLE IF NOT EXISTS public.tags (
+    id           SERIAL PRIMARY KEY,
+    name         VARCHAR(100) NOT NULL,
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS tags_name_key ON public.tags ((lower(name)));
+
+CREATE TABLE IF NOT EXISTS public.customer_tags (
+    customer_id  INTEGER NOT NULL REFERENCES public.customer (id) ON DELETE CASCADE,
+    tag_id       INTEGER NOT NULL REFERENCES public.tags (id) ON DELETE CASCADE,
+    created_by   INTEGER,
+    created_date TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (customer_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS customer_tags_tag_id_idx ON public.customer_tags (tag_id);
+
+CREATE TABLE IF NOT EXISTS public.segments (
+    id           SERIAL PRIMARY KEY,
+    gid          UUID NOT NULL UNIQUE,
+    name         VARCHAR(150) NOT NULL UNIQUE,
+    expression   TEXT NOT NULL,
+    created_by   INTEGER NOT NULL,
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
@@ -0,0 +1,16 @@
+-- Typed custom attributes. Each business declares the attributes it keeps on
+-- its customers; values live in public.customer.attributes (see 002).
+
+CREATE TABLE IF NOT EXISTS public.customer_attribute_schema (
+    id           SERIAL PRIMARY KEY,
+    business_id  VARCHAR(50) NOT NULL,
+    key          VARCHAR(64) NOT NULL,
+    label        VARCHAR(150) NOT NULL DEFAULT '',
+    type         VARCHAR(10) NOT NULL,
+    options      TEXT[] NOT NULL DEFAULT '{}',
+    created_by   INTEGER,
+    created_date TIMESTAMP NOT NULL DEFAULT now(),
+    UNIQUE (business_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS customer_attributes_idx ON public.customer USING GIN (attributes);
@@ -0,0 +1,17 @@
+-- WhatsApp opt-in state per customer and the history of every change.
+
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS opt_in_status VARCHAR(10) NOT NULL DEFAULT 'unknown';
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS opt_in_updated_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS public.customer_consent_history (
+    id           SERIAL PRIMARY KEY,
+    customer_id  INTEGER NOT NULL REFERENCES public.customer (id) ON DELETE CASCADE,
+    status       VARCHAR(10) NOT NULL,
+    source       VARCHAR(20) NOT NULL,
+    changed_by   INTEGER,
+    requested_ip VARCHAR(45) NOT NULL DEFAULT '',
+    note         TEXT NOT NULL DEFAULT '',
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS customer_consent_history_customer_id_idx ON public.customer_consent_history (customer_id, created_date);
@@ -0,0 +1,40 @@
+-- Link inbound and outbound messages to customers by GID so that they follow
+-- a customer through merges, and keep an audit trail of every merge.
+
+ALTER TABLE whatsapp_data ADD COLUMN IF NOT EXISTS customer_gid UUID;
+
+UPDATE whatsapp_data w
+SET customer_gid = c.gid
+FROM public.customer c
+WHERE w.customer_gid IS NULL
+  AND c.normalized_phone = '+' || w.sender_phone_number;
+
+CREATE INDEX IF NOT EXISTS whatsapp_data_customer_gid_idx ON whatsapp_data (customer_gid);
+
+CREATE TABLE IF NOT EXISTS public.outbound_messages (
+    id              SERIAL PRIMARY KEY,
+    gid             UUID NOT NULL UNIQUE,
+    customer_gid    UUID,
+    recipient_phone VARCHAR(16) NOT NULL,
+    template_name   VARCHAR(512) NOT NULL,
+    parameters      JSONB NOT NULL DEFAULT '[]',
+    wa_message_id   VARCHAR(128) NOT NULL DEFAULT '',
+    status          VARCHAR(20) NOT NULL,
+    error_message   TEXT NOT NULL DEFAULT '',
+    sent_by         INTEGER,
+    created_date    TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS outbound_messages_customer_gid_idx ON public.outbound_messages (customer_gid);
+
+CREATE TABLE IF NOT EXISTS public.customer_merge_audit (
+    id            SERIAL PRIMARY KEY,
+    survivor_gid  UUID NOT NULL,
+    merged_gid    UUID NOT NULL,
+    merged_data   JSONB NOT NULL,
+    merged_by     INTEGER NOT NULL,
+    requested_ip  VARCHAR(45) NOT NULL DEFAULT '',
+    created_date  TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS customer_merge_audit_survivor_gid_idx ON public.customer_merge_audit (survivor_gid);
@@ -0,0 +1,14 @@
+-- Erased customers leave a tombstone holding only a keyed hash (HMAC with
+-- Tombstone-Secret) of their phone number, so that imports and API calls
+-- cannot bring them back.
+
+CREATE TABLE IF NOT EXISTS public.customer_tombstones (
+    id           SERIAL PRIMARY KEY,
+    phone_hash   CHAR(64) NOT NULL UNIQUE,
+    erased_gid   UUID NOT NULL,
+    mode         VARCHAR(20) NOT NULL,
+    reason       TEXT NOT NULL DEFAULT '',
+    erased_by    INTEGER NOT NULL,
+    requested_ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
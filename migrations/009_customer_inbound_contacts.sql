@@ -0,0 +1,18 @@
+-- Customers created or refreshed from inbound WhatsApp messages. The profile
+-- name WhatsApp reports is kept apart from the name we hold.
+
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS wa_profile_name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS first_seen_at TIMESTAMP;
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP;
+
+UPDATE public.customer c
+SET first_seen_at = seen.first_seen, last_seen_at = seen.last_seen
+FROM (
+    SELECT customer_gid,
+           MIN(to_timestamp((message_data::jsonb -> 'messages' -> 0 ->> 'timestamp')::bigint)) AS first_seen,
+           MAX(to_timestamp((message_data::jsonb -> 'messages' -> 0 ->> 'timestamp')::bigint)) AS last_seen
+    FROM whatsapp_data
+    WHERE customer_gid IS NOT NULL
+    GROUP BY customer_gid
+) seen
+WHERE c.gid = seen.customer_gid AND c.first_seen_at IS NULL;
@@ -0,0 +1,6 @@
+-- Deleted customers are archived first and purged later by the retention job.
+
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS deleted_by INTEGER;
+
+CREATE INDEX IF NOT EXISTS customer_deleted_at_idx ON public.customer (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,57 @@
+-- ISO-3166 codes, dialing prefixes and national number lengths for
+-- public.country_codes. Rows are matched on the country name; countries not
+-- listed here keep NULLs until filled in by hand.
+
+ALTER TABLE public.country_codes ADD COLUMN IF NOT EXISTS iso2 CHAR(2);
+ALTER TABLE public.country_codes ADD COLUMN IF NOT EXISTS iso3 CHAR(3);
+ALTER TABLE public.country_codes ADD COLUMN IF NOT EXISTS dial_prefix VARCHAR(10);
+ALTER TABLE public.country_codes ADD COLUMN IF NOT EXISTS min_length SMALLINT;
+ALTER TABLE public.country_codes ADD COLUMN IF NOT EXISTS max_length SMALLINT;
+
+UPDATE public.country_codes c
+SET iso2 = v.iso2, iso3 = v.iso3, dial_prefix = '+' || c.country_code::text, min_length = v.min_length, max_length = v.max_length
+FROM (VALUES
+    ('india', 'IN', 'IND', 10, 10),
+    ('united arab emirates', 'AE', 'ARE', 8, 9),
+    ('saudi arabia', 'SA', 'SAU', 9, 9),
+    ('qatar', 'QA', 'QAT', 8, 8),
+    ('kuwait', 'KW', 'KWT', 8, 8),
+    ('bahrain', 'BH', 'BHR', 8, 8),
+    ('oman', 'OM', 'OMN', 8, 8),
+    ('united kingdom', 'GB', 'GBR', 9, 10),
+    ('ireland', 'IE', 'IRL', 7, 9),
+    ('germany', 'DE', 'DEU', 6, 11),
+    ('france', 'FR', 'FRA', 9, 9),
+    ('spain', 'ES', 'ESP', 9, 9),
+    ('italy', 'IT', 'ITA', 6, 11),
+    ('netherlands', 'NL', 'NLD', 9, 9),
+    ('belgium', 'BE', 'BEL', 8, 9),
+    ('switzerland', 'CH', 'CHE', 9, 9),
+    ('austria', 'AT', 'AUT', 4, 13),
+    ('portugal', 'PT', 'PRT', 9, 9),
+    ('sweden', 'SE', 'SWE', 7, 9),
+    ('norway', 'NO', 'NOR', 8, 8),
+    ('denmark', 'DK', 'DNK', 8, 8),
+    ('poland', 'PL', 'POL', 9, 9),
+    ('united states', 'US', 'USA', 10, 10),
+    ('canada', 'CA', 'CAN', 10, 10),
+    ('australia', 'AU', 'AUS', 9, 9),
+    ('new zealand', 'NZ', 'NZL', 8, 10),
+    ('singapore', 'SG', 'SGP', 8, 8),
+    ('malaysia', 'MY', 'MYS', 9, 10),
+    ('sri lanka', 'LK', 'LKA', 9, 9),
+    ('pakistan', 'PK', 'PAK', 10, 10),
+    ('bangladesh', 'BD', 'BGD', 10, 10),
+    ('nepal', 'NP', 'NPL', 10, 10),
+    ('philippines', 'PH', 'PHL', 10, 10),
+    ('indonesia', 'ID', 'IDN', 9, 12),
+    ('china', 'CN', 'CHN', 11, 11),
+    ('japan', 'JP', 'JPN', 10, 10),
+    ('egypt', 'EG', 'EGY', 10, 10),
+    ('south africa', 'ZA', 'ZAF', 9, 9),
+    ('kenya', 'KE', 'KEN', 9, 9),
+    ('nigeria', 'NG', 'NGA', 10, 10)
+) AS v(name, iso2, iso3, min_length, max_length)
+WHERE lower(c.country_name) = v.name;
+
+CREATE INDEX IF NOT EXISTS country_codes_iso2_idx ON public.country_codes (iso2);
@@ -0,0 +1,61 @@
+-- Preferred language (WhatsApp template language code, e.g. en_US) and IANA
+-- timezone per customer, with per-country defaults used when a customer has
+-- none.
+
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS language VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE public.customer ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NOT NULL DEFAULT '';
+
+ALTER TABLE public.country_codes ADD COLUMN IF NOT EXISTS default_language VARCHAR(10);
+ALTER TABLE public.country_codes ADD COLUMN IF NOT EXISTS default_timezone VARCHAR(64);
+
+UPDATE public.country_codes c
+SET default_language = v.language, default_timezone = v.timezone
+FROM (VALUES
+    ('IN', 'en', 'Asia/Kolkata'),
+    ('AE', 'ar', 'Asia/Dubai'),
+    ('SA', 'ar', 'Asia/Riyadh'),
+    ('QA', 'ar', 'Asia/Qatar'),
+    ('KW', 'ar', 'Asia/Kuwait'),
+    ('BH', 'ar', 'Asia/Bahrain'),
+    ('OM', 'ar', 'Asia/Muscat'),
+    ('GB', 'en_GB', 'Europe/London'),
+    ('IE', 'en_GB', 'Europe/Dublin'),
+    ('DE', 'de', 'Europe/Berlin'),
+    ('FR', 'fr', 'Europe/Paris'),
+    ('ES', 'es_ES', 'Europe/Madrid'),
+    ('IT', 'it', 'Europe/Rome'),
+    ('NL', 'nl', 'Europe/Amsterdam'),
+    ('BE', 'nl', 'Europe/Brussels'),
+    ('CH', 'de', 'Europe/Zurich'),
+    ('AT', 'de', 'Europe/Vienna'),
+    ('PT', 'pt_PT', 'Europe/Lisbon'),
+    ('SE', 'sv', 'Europe/Stockholm'),
+    ('NO', 'nb', 'Europe/Oslo'),
+    ('DK', 'da', 'Europe/Copenhagen'),
+    ('PL', 'pl', 'Europe/Warsaw'),
+    ('US', 'en_US', 'America/New_York'),
+    ('CA', 'en_US', 'America/Toronto'),
+    ('AU', 'en', 'Australia/Sydney'),
+    ('NZ', 'en', 'Pacific/Auckland'),
+    ('SG', 'en', 'Asia/Singapore'),
+    ('MY', 'ms', 'Asia/Kuala_Lumpur'),
+    ('LK', 'en', 'Asia/Colombo'),
+    ('PK', 'ur', 'Asia/Karachi'),
+    ('BD', 'bn', 'Asia/Dhaka'),
+    ('NP', 'en', 'Asia/Kathmandu'),
+    ('PH', 'en', 'Asia/Manila'),
+    ('ID', 'id', 'Asia/Jakarta'),
+    ('CN', 'zh_CN', 'Asia/Shanghai'),
+    ('JP', 'ja', 'Asia/Tokyo'),
+    ('EG', 'ar', 'Africa/Cairo'),
+    ('ZA', 'en', 'Africa/Johannesburg'),
+    ('KE', 'en', 'Africa/Nairobi'),
+    ('NG', 'en', 'Africa/Lagos')
+) AS v(iso2, language, timezone)
+WHERE c.iso2 = v.iso2;
+
+-- Infer for existing customers
+UPDATE public.customer cu
+SET language = COALESCE((SELECT default_language FROM public.country_codes cc WHERE cc.country_code = cu.country_code AND cc.default_language IS NOT NULL ORDER BY cc.id LIMIT 1), ''),
+    timezone = COALESCE((SELECT default_timezone FROM public.country_codes cc WHERE cc.country_code = cu.country_code AND cc.default_timezone IS NOT NULL ORDER BY cc.id LIMIT 1), '')
+WHERE cu.language = '' AND cu.timezone = '';
@@ -0,0 +1,32 @@
+-- Refresh tokens, stored as SHA-256 hashes. Each refresh replaces the token
+-- with a new one of the same family; presenting a used token again revokes
+-- the whole family. access_jti is the access token issued alongside, so that
+-- revoking a session also revokes its access token.
+
+CREATE TABLE IF NOT EXISTS public.user_refresh_tokens (
+    id                SERIAL PRIMARY KEY,
+    user_id           INTEGER NOT NULL,
+    family_id         UUID NOT NULL,
+    token_hash        CHAR(64) NOT NULL UNIQUE,
+    access_jti        UUID NOT NULL,
+    access_expires_at TIMESTAMP NOT NULL,
+    expires_at        TIMESTAMP NOT NULL,
+    used_at           TIMESTAMP,
+    revoked_at        TIMESTAMP,
+    requested_ip      VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent        TEXT NOT NULL DEFAULT '',
+    created_date      TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_refresh_tokens_user_idx ON public.user_refresh_tokens (user_id);
+CREATE INDEX IF NOT EXISTS user_refresh_tokens_family_idx ON public.user_refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS user_refresh_tokens_access_jti_idx ON public.user_refresh_tokens (access_jti);
+
+-- Access tokens revoked before they expire. Rows can be dropped once
+-- expires_at has passed.
+CREATE TABLE IF NOT EXISTS public.revoked_tokens (
+    jti          UUID PRIMARY KEY,
+    user_id      INTEGER NOT NULL,
+    expires_at   TIMESTAMP NOT NULL,
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
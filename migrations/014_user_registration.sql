@@ -0,0 +1,21 @@
+-- Self-registration and admin invitations. Invitation tokens are stored as
+-- SHA-256 hashes and can be accepted once before they expire.
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_login_user_name_key ON public.users ((lower(login_user_name)));
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON public.users ((lower(email))) WHERE email <> '';
+
+CREATE TABLE IF NOT EXISTS public.user_invites (
+    id               SERIAL PRIMARY KEY,
+    gid              UUID NOT NULL UNIQUE,
+    email            VARCHAR(255) NOT NULL,
+    name             VARCHAR(150) NOT NULL DEFAULT '',
+    token_hash       CHAR(64) NOT NULL UNIQUE,
+    invited_by       INTEGER NOT NULL,
+    expires_at       TIMESTAMP NOT NULL,
+    accepted_at      TIMESTAMP,
+    accepted_user_id INTEGER,
+    revoked_at       TIMESTAMP,
+    created_date     TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_invites_email_idx ON public.user_invites ((lower(email)));
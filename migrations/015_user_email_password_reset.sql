@@ -0,0 +1,17 @@
+-- Email verification codes are stored as SHA-256 hashes in the existing
+-- users columns; password reset codes get their own table so that several
+-- requests do not overwrite each other.
+
+ALTER TABLE public.users ALTER COLUMN email_verification_code TYPE VARCHAR(64);
+
+CREATE TABLE IF NOT EXISTS public.password_resets (
+    id           SERIAL PRIMARY KEY,
+    user_id      INTEGER NOT NULL,
+    token_hash   CHAR(64) NOT NULL UNIQUE,
+    expires_at   TIMESTAMP NOT NULL,
+    used_at      TIMESTAMP,
+    requested_ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_idx ON public.password_resets (user_id);
@@ -0,0 +1,29 @@
+-- One-time codes sent over WhatsApp, stored as bcrypt hashes, and pending
+-- two-step logins. A login challenge is created once the password has been
+-- checked and is exchanged for tokens when the second factor is verified.
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS mobile_otp_enabled BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS public.user_otp_codes (
+    id           SERIAL PRIMARY KEY,
+    user_id      INTEGER NOT NULL,
+    purpose      VARCHAR(20) NOT NULL,
+    code_hash    VARCHAR(72) NOT NULL,
+    attempts     INTEGER NOT NULL DEFAULT 0,
+    expires_at   TIMESTAMP NOT NULL,
+    consumed_at  TIMESTAMP,
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_otp_codes_user_idx ON public.user_otp_codes (user_id, purpose, created_date);
+
+CREATE TABLE IF NOT EXISTS public.login_challenges (
+    id           SERIAL PRIMARY KEY,
+    token_hash   CHAR(64) NOT NULL UNIQUE,
+    user_id      INTEGER NOT NULL,
+    attempts     INTEGER NOT NULL DEFAULT 0,
+    expires_at   TIMESTAMP NOT NULL,
+    completed_at TIMESTAMP,
+    requested_ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
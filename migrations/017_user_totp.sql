@@ -0,0 +1,18 @@
+-- Authenticator app (TOTP) second factor and single-use recovery codes.
+-- totp_secret holds a pending secret until the first code confirms it;
+-- totp_last_step stops a code from being used twice.
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_enabled_date TIMESTAMP;
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS public.user_recovery_codes (
+    id           SERIAL PRIMARY KEY,
+    user_id      INTEGER NOT NULL,
+    code_hash    CHAR(64) NOT NULL,
+    used_at      TIMESTAMP,
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_recovery_codes_user_idx ON public.user_recovery_codes (user_id);
@@ -0,0 +1,80 @@
+-- Roles and the permissions they grant. Users get the union of the
+-- permissions of their roles, which is copied into their access tokens.
+
+CREATE TABLE IF NOT EXISTS public.roles (
+    name         VARCHAR(50) PRIMARY KEY,
+    description  VARCHAR(255) NOT NULL DEFAULT '',
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS public.permissions (
+    name        VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS public.role_permissions (
+    role_name  VARCHAR(50) NOT NULL REFERENCES public.roles (name) ON DELETE CASCADE,
+    permission VARCHAR(50) NOT NULL REFERENCES public.permissions (name) ON DELETE CASCADE,
+    PRIMARY KEY (role_name, permission)
+);
+
+CREATE TABLE IF NOT EXISTS public.user_roles (
+    user_id      INTEGER NOT NULL,
+    role_name    VARCHAR(50) NOT NULL REFERENCES public.roles (name) ON DELETE CASCADE,
+    assigned_by  INTEGER,
+    created_date TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, role_name)
+);
+
+INSERT INTO public.roles (name, description) VALUES
+    ('admin', 'Full access, including user and role management'),
+    ('campaign_manager', 'Manages customers, segments and templates and sends campaigns'),
+    ('agent', 'Works with customers and sends messages'),
+    ('read_only', 'Views customers and templates')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO public.permissions (name, description) VALUES
+    ('customers:read', 'List and view customers, tags, segments and imports'),
+    ('customers:write', 'Create, update, merge and tag customers and record consent'),
+    ('customers:delete', 'Archive and restore customers'),
+    ('customers:import', 'Import customers from CSV and Excel files'),
+    ('customers:export', 'Export customers'),
+    ('attributes:manage', 'Manage the customer attribute schema'),
+    ('segments:manage', 'Create and delete segments'),
+    ('privacy:manage', 'Export and erase the personal data of a customer'),
+    ('messages:send', 'Send WhatsApp messages'),
+    ('templates:read', 'View WhatsApp templates'),
+    ('templates:manage', 'Manage WhatsApp templates'),
+    ('users:manage', 'Invite users, manage their roles and reset their second factors')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO public.role_permissions (role_name, permission)
+SELECT 'admin', name FROM public.permissions
+ON CONFLICT DO NOTHING;
+
+INSERT INTO public.role_permissions (role_name, permission) VALUES
+    ('campaign_manager', 'customers:read'),
+    ('campaign_manager', 'customers:write'),
+    ('campaign_manager', 'customers:delete'),
+    ('campaign_manager', 'customers:import'),
+    ('campaign_manager', 'customers:export'),
+    ('campaign_manager', 'segments:manage'),
+    ('campaign_manager', 'messages:send'),
+    ('campaign_manager', 'templates:read'),
+    ('campaign_manager', 'templates:manage'),
+    ('agent', 'customers:read'),
+    ('agent', 'customers:write'),
+    ('agent', 'messages:send'),
+    ('agent', 'templates:read'),
+    ('read_only', 'customers:read'),
+    ('read_only', 'templates:read')
+ON CONFLICT DO NOTHING;
+
+-- Every existing user could do everything so far; they keep that access
+-- until an admin assigns them a narrower role
+INSERT INTO public.user_roles (user_id, role_name)
+SELECT u.id, 'admin' FROM public.users u
+WHERE NOT EXISTS (SELECT 1 FROM public.user_roles ur WHERE ur.user_id = u.id);
+
+-- The role an invited user is registered with
+ALTER TABLE public.user_invites ADD COLUMN IF NOT EXISTS role_name VARCHAR(50) NOT NULL DEFAULT 'read_only' REFERENCES public.roles (name);
@@ -0,0 +1,28 @@
+-- API keys for server-to-server integrations. Keys are stored as SHA-256
+-- hashes; the prefix identifies a key in listings and logs. A key acts for
+-- the user who created it, limited to its scopes and to that user's current
+-- permissions.
+
+CREATE TABLE IF NOT EXISTS public.api_keys (
+    id           SERIAL PRIMARY KEY,
+    gid          UUID NOT NULL UNIQUE,
+    name         VARCHAR(100) NOT NULL,
+    prefix       VARCHAR(20) NOT NULL UNIQUE,
+    key_hash     CHAR(64) NOT NULL UNIQUE,
+    scopes       TEXT[] NOT NULL DEFAULT '{}',
+    allowed_ips  TEXT[] NOT NULL DEFAULT '{}',
+    expires_at   TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(64),
+    created_by   INTEGER NOT NULL,
+    created_date TIMESTAMP NOT NULL DEFAULT now(),
+    revoked_at   TIMESTAMP
+);
+
+INSERT INTO public.permissions (name, description) VALUES
+    ('api_keys:manage', 'Create and revoke API keys')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO public.role_permissions (role_name, permission) VALUES
+    ('admin', 'api_keys:manage')
+ON CONFLICT DO NOTHING;
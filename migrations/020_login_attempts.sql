@@ -0,0 +1,13 @@
+-- Login attempts, used to slow down and lock out password guessing per
+-- account and per client address. Rows older than a day are purged.
+
+CREATE TABLE IF NOT EXISTS public.login_attempts (
+    id           BIGSERIAL PRIMARY KEY,
+    username     VARCHAR(255) NOT NULL,
+    ip           VARCHAR(64) NOT NULL,
+    succeeded    BOOLEAN NOT NULL,
+    created_date TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON public.login_attempts (username, created_date);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON public.login_attempts (ip, created_date);
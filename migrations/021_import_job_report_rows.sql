@@ -0,0 +1,11 @@
+-- Import jobs used to keep every row of the upload in their report. Only the
+-- failed rows, already kept in errors, are left, except on dry runs whose
+-- rows are the preview; those only lose the uploaded contacts.
+
+UPDATE public.import_jobs SET report = jsonb_set(report, '{rows}', errors)
+WHERE report IS NOT NULL AND report ? 'rows' AND mode <> 'dry_run';
+
+UPDATE public.import_jobs SET report = jsonb_set(report, '{rows}',
+    COALESCE((SELECT jsonb_agg(r.item - 'contact' ORDER BY r.ordinality)
+              FROM jsonb_array_elements(report -> 'rows') WITH ORDINALITY AS r(item, ordinality)), '[]'::jsonb))
+WHERE report IS NOT NULL AND jsonb_typeof(report -> 'rows') = 'array' AND mode = 'dry_run';
@@ -0,0 +1,4 @@
+-- Import jobs first check every row against existing customers, then write
+-- them; processed_rows counts rows within the current phase.
+
+ALTER TABLE public.import_jobs ADD COLUMN IF NOT EXISTS phase VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- Password reset requests are limited per requesting address.
+
+CREATE INDEX IF NOT EXISTS password_resets_ip_idx ON public.password_resets (requested_ip, created_date);
@@ -0,0 +1,12 @@
+-- Authenticator secrets are now stored encrypted with TOTP-Encryption-Key,
+-- which needs a wider column. Secrets stored in plain text before this
+-- migration cannot be encrypted here, so those users have to set up their
+-- authenticator app again.
+
+ALTER TABLE public.users ALTER COLUMN totp_secret TYPE VARCHAR(128);
+
+DELETE FROM public.user_recovery_codes
+WHERE user_id IN (SELECT id FROM public.users WHERE length(totp_secret) <= 32);
+
+UPDATE public.users SET totp_enabled = false, totp_secret = NULL, totp_enabled_date = NULL, totp_last_step = 0
+WHERE length(totp_secret) <= 32;
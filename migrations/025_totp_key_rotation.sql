@@ -0,0 +1,9 @@
+-- The first TOTP-Encryption-Key was published with the sample config.json
+-- and has been replaced. Secrets encrypted with it are exposed and cannot be
+-- read with the new key, so every authenticator app has to be set up again.
+
+DELETE FROM public.user_recovery_codes
+WHERE user_id IN (SELECT id FROM public.users WHERE totp_secret IS NOT NULL);
+
+UPDATE public.users SET totp_enabled = false, totp_secret = NULL, totp_enabled_date = NULL, totp_last_step = 0
+WHERE totp_secret IS NOT NULL;
@@ -0,0 +1,8 @@
+-- Last inbound times and the archive purge only look at customer_gid, so
+-- link messages stored before their sender became a customer.
+
+UPDATE whatsapp_data w
+SET customer_gid = c.gid
+FROM public.customer c
+WHERE w.customer_gid IS NULL
+  AND c.normalized_phone = '+' || w.sender_phone_number;
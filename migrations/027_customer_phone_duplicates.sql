@@ -0,0 +1,57 @@
+-- Migration 001 left duplicate customers without a normalized phone. Record
+-- each of them with the customer that kept the number so they can be merged
+-- (they are also listed by the phone match of the duplicates check), and
+-- carry their opt-outs over to that customer, which is the one messages to
+-- the number are checked against.
+
+CREATE TABLE IF NOT EXISTS public.customer_phone_duplicates (
+    id               SERIAL PRIMARY KEY,
+    customer_id      INTEGER NOT NULL UNIQUE REFERENCES public.customer (id) ON DELETE CASCADE,
+    survivor_id      INTEGER NOT NULL REFERENCES public.customer (id) ON DELETE CASCADE,
+    normalized_phone VARCHAR(16) NOT NULL,
+    created_date     TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- Same normalization as migration 001.
+WITH digits AS (
+    SELECT id,
+           country_code::text AS cc,
+           regexp_replace(regexp_replace(phone_number, '\D', '', 'g'), '^0+', '') AS d
+    FROM public.customer
+    WHERE normalized_phone IS NULL AND country_code IS NOT NULL
+),
+normalized AS (
+    SELECT id,
+           '+' || cc ||
+           CASE WHEN length(d) > 10 AND d LIKE cc || '%'
+                THEN substr(d, length(cc) + 1)
+                ELSE d
+           END AS phone
+    FROM digits
+)
+INSERT INTO public.customer_phone_duplicates (customer_id, survivor_id, normalized_phone)
+SELECT n.id, keep.id, n.phone
+FROM normalized n
+JOIN public.customer keep ON keep.normalized_phone = n.phone
+ON CONFLICT (customer_id) DO NOTHING;
+
+-- The survivor is opted out when any of its duplicates is.
+INSERT INTO public.customer_consent_history (customer_id, status, source, note, created_date)
+SELECT DISTINCT ON (keep.id) keep.id, 'opted_out',
+       COALESCE((SELECT h.source FROM public.customer_consent_history h
+                 WHERE h.customer_id = dup.id ORDER BY h.created_date DESC, h.id DESC LIMIT 1), 'import'),
+       'Opt-out carried over from duplicate customer ' || dup.gid, now()
+FROM public.customer_phone_duplicates d
+JOIN public.customer dup ON dup.id = d.customer_id
+JOIN public.customer keep ON keep.id = d.survivor_id
+WHERE dup.opt_in_status = 'opted_out' AND keep.opt_in_status <> 'opted_out'
+ORDER BY keep.id, dup.opt_in_updated_at DESC NULLS LAST;
+
+UPDATE public.customer keep
+SET opt_in_status = 'opted_out',
+    opt_in_updated_at = now()
+FROM public.customer_phone_duplicates d
+JOIN public.customer dup ON dup.id = d.customer_id
+WHERE keep.id = d.survivor_id
+  AND dup.opt_in_status = 'opted_out'
+  AND keep.opt_in_status <> 'opted_out';
@@ -0,0 +1,228 @@
+package model
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"whatbot/utils"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// apiKeyUsageInterval is how often the last use of a key is written.
+const apiKeyUsageInterval = time.Minute
+
+// ErrInvalidAddress is returned for allow-list entries that are neither an
+// IP address nor a CIDR range.
+var ErrInvalidAddress = errors.New("allowed_ips must contain IP addresses or CIDR ranges")
+
+// APIKey is an API key without its secret.
+type APIKey struct {
+	GID        string     `json:"gid"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	CreatedBy  int        `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_date"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// NewAPIKey is a key to create. A nil ExpiresAt never expires and empty
+// AllowedIPs allow every address.
+type NewAPIKey struct {
+	Name       string
+	Scopes     []string
+	AllowedIPs []string
+	ExpiresAt  *time.Time
+	CreatedBy  int
+}
+
+type APIKeyRepository interface {
+	// CreateAPIKey stores a key and returns it with the secret key, which is
+	// only ever available here.
+	CreateAPIKey(key NewAPIKey) (*APIKey, string, error)
+	ListAPIKeys() ([]APIKey, error)
+	// RevokeAPIKey returns false when there is no active key with this GID.
+	RevokeAPIKey(gid string) (bool, error)
+	// VerifyAPIKey implements utils.APIKeyVerifier.
+	VerifyAPIKey(key, ip string) (*utils.Claims, error)
+}
+
+type apiKeyRepo struct {
+	db *sql.DB
+}
+
+func NewAPIKeyRepository(db *sql.DB) APIKeyRepository {
+	return &apiKeyRepo{db: db}
+}
+
+// NormalizeAllowedIPs turns the entries of an allow-list into CIDR ranges,
+// a single address becoming a /32 or /128 range.
+func NormalizeAllowedIPs(entries []string) ([]string, error) {
+	ranges := []string{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, ErrInvalidAddress
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, ErrInvalidAddress
+		}
+		ranges = append(ranges, network.String())
+	}
+	return ranges, nil
+}
+
+// addressAllowed reports whether ip is in one of the ranges; no ranges
+// allow every address.
+func addressAllowed(ranges []string, ip string) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, r := range ranges {
+		if _, network, err := net.ParseCIDR(r); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+const apiKeyColumns = "gid, name, prefix, scopes, allowed_ips, expires_at, last_used_at, COALESCE(last_used_ip, ''), created_by, created_date, revoked_at"
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	key := &APIKey{}
+	err := row.Scan(&key.GID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), pq.Array(&key.AllowedIPs), &key.ExpiresAt,
+		&key.LastUsedAt, &key.LastUsedIP, &key.CreatedBy, &key.CreatedAt, &key.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (ar *apiKeyRepo) CreateAPIKey(newKey NewAPIKey) (*APIKey, string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	secret, err := newOpaqueToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := utils.APIKeyPrefix + hex.EncodeToString(id)
+	secretKey := prefix + "_" + secret
+
+	key, err := scanAPIKey(ar.db.QueryRow(`INSERT INTO public.api_keys (gid, name, prefix, key_hash, scopes, allowed_ips, expires_at, created_by, created_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING `+apiKeyColumns,
+		uuid.New(), newKey.Name, prefix, hashToken(secretKey), pq.Array(newKey.Scopes), pq.Array(newKey.AllowedIPs),
+		newKey.ExpiresAt, newKey.CreatedBy, time.Now()))
+	if err != nil {
+		log.Println("Error creating API key:", err)
+		return nil, "", err
+	}
+	return key, secretKey, nil
+}
+
+func (ar *apiKeyRepo) ListAPIKeys() ([]APIKey, error) {
+	rows, err := ar.db.Query("SELECT " + apiKeyColumns + " FROM public.api_keys ORDER BY created_date DESC")
+	if err != nil {
+		log.Println("Error listing API keys:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (ar *apiKeyRepo) RevokeAPIKey(gid string) (bool, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return false, nil
+	}
+	result, err := ar.db.Exec("UPDATE public.api_keys SET revoked_at = $1 WHERE gid = $2 AND revoked_at IS NULL", time.Now(), gid)
+	if err != nil {
+		log.Println("Error revoking API key:", err)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// VerifyAPIKey returns claims acting for the user who created the key, with
+// the scopes of the key that user still holds.
+func (ar *apiKeyRepo) VerifyAPIKey(secretKey, ip string) (*utils.Claims, error) {
+	var (
+		id, userID      int
+		prefix, userGid string
+		username        string
+		allowedIPs      []string
+		permissions     []string
+		createdDate     time.Time
+	)
+	err := ar.db.QueryRow(`SELECT k.id, k.prefix, k.allowed_ips, k.created_date, u.id, u.gid, u.users_name,
+			ARRAY(SELECT s FROM unnest(k.scopes) s WHERE s IN (SELECT rp.permission FROM public.user_roles ur
+				JOIN public.role_permissions rp ON rp.role_name = ur.role_name WHERE ur.user_id = u.id))
+		FROM public.api_keys k JOIN public.users u ON u.id = k.created_by
+		WHERE k.key_hash = $1 AND k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > $2)
+			AND COALESCE(u.active, false) AND (u.start_date IS NULL OR u.start_date <= $2) AND (u.end_date IS NULL OR u.end_date > $2)`,
+		hashToken(secretKey), time.Now()).
+		Scan(&id, &prefix, pq.Array(&allowedIPs), &createdDate, &userID, &userGid, &username, pq.Array(&permissions))
+	if err == sql.ErrNoRows {
+		return nil, utils.ErrInvalidAPIKey
+	}
+	if err != nil {
+		log.Println("Error reading API key:", err)
+		return nil, err
+	}
+	if !addressAllowed(allowedIPs, ip) {
+		return nil, utils.ErrAPIKeyAddressNotAllowed
+	}
+
+	_, err = ar.db.Exec(`UPDATE public.api_keys SET last_used_at = $1, last_used_ip = $2
+		WHERE id = $3 AND (last_used_at IS NULL OR last_used_at < $4 OR last_used_ip IS DISTINCT FROM $2)`,
+		time.Now(), ip, id, time.Now().Add(-apiKeyUsageInterval))
+	if err != nil {
+		log.Println("Error recording API key use:", err)
+	}
+
+	return &utils.Claims{
+		UserID:       userID,
+		Username:     username,
+		UserGid:      userGid,
+		CreationDate: createdDate,
+		Permissions:  permissions,
+		APIKey:       prefix,
+	}, nil
+}
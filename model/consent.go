@@ -0,0 +1,259 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Consent states of a customer.
+const (
+	ConsentUnknown  = "unknown"
+	ConsentOptedIn  = "opted_in"
+	ConsentOptedOut = "opted_out"
+)
+
+// Where a consent change came from.
+const (
+	ConsentSourceImport  = "import"
+	ConsentSourceAPI     = "api"
+	ConsentSourceWebhook = "webhook"
+)
+
+// Keywords used when config.json does not set Opt-Out-Keywords or
+// Opt-In-Keywords.
+var (
+	DefaultOptOutKeywords = []string{"STOP", "STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT"}
+	DefaultOptInKeywords  = []string{"START", "SUBSCRIBE", "UNSTOP"}
+)
+
+var (
+	// ErrOptedOut is returned when a message is addressed to a customer who
+	// has opted out.
+	ErrOptedOut = errors.New("recipient has opted out of messages")
+	// ErrRecipientArchived is returned when a message is addressed to an
+	// archived customer.
+	ErrRecipientArchived = errors.New("recipient is archived")
+)
+
+// ErrKeywordOptOut is returned when an import or an API call would opt a
+// customer back in who opted out by sending a keyword. Only the customer can
+// reverse that, by sending an opt-in keyword.
+var ErrKeywordOptOut = errors.New("customer opted out by keyword and can only opt in themselves")
+
+// ConsentChange describes a new consent state and who set it.
+type ConsentChange struct {
+	Status      string
+	Source      string
+	ChangedBy   int
+	RequestedIP string
+	Note        string
+}
+
+// ConsentEvent is one entry of a customer's consent history.
+type ConsentEvent struct {
+	ID          int       `json:"id"`
+	Status      string    `json:"status"`
+	Source      string    `json:"source"`
+	ChangedBy   int       `json:"changed_by,omitempty"`
+	RequestedIP string    `json:"requested_ip,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+type ConsentRepository interface {
+	// SetConsent changes the consent of a customer. It returns false when no
+	// customer has the GID and ErrKeywordOptOut when an opt-in would reverse
+	// a keyword opt-out.
+	SetConsent(customerGID string, change ConsentChange) (bool, error)
+	// SetConsentByPhone is SetConsent for the customer with the normalized phone.
+	SetConsentByPhone(normalizedPhone string, change ConsentChange) (bool, error)
+	ConsentHistory(customerGID string) ([]ConsentEvent, error)
+	// CheckSendAllowed returns ErrOptedOut when the number belongs to a
+	// customer who opted out and ErrRecipientArchived when it belongs to an
+	// archived customer.
+	CheckSendAllowed(normalizedPhone string) error
+}
+
+type consentRepo struct {
+	db *sql.DB
+}
+
+func NewConsentRepository(db *sql.DB) ConsentRepository {
+	return &consentRepo{db: db}
+}
+
+// ParseConsent accepts the consent states and the usual yes/no spellings. An
+// empty value means "leave consent unchanged".
+func ParseConsent(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return "", nil
+	case ConsentOptedIn, "opt_in", "optin", "yes", "y", "true", "1":
+		return ConsentOptedIn, nil
+	case ConsentOptedOut, "opt_out", "optout", "no", "n", "false", "0":
+		return ConsentOptedOut, nil
+	}
+	return "", fmt.Errorf("invalid consent %q, use opted_in or opted_out", value)
+}
+
+// MatchConsentKeyword returns the consent state requested by an inbound
+// message, or "" when the whole message is not one of the keywords.
+func MatchConsentKeyword(body string, optOut, optIn []string) string {
+	body = strings.TrimSpace(strings.Trim(strings.TrimSpace(body), ".!"))
+	if body == "" {
+		return ""
+	}
+	if len(optOut) == 0 {
+		optOut = DefaultOptOutKeywords
+	}
+	if len(optIn) == 0 {
+		optIn = DefaultOptInKeywords
+	}
+	for _, keyword := range optOut {
+		if strings.EqualFold(body, strings.TrimSpace(keyword)) {
+			return ConsentOptedOut
+		}
+	}
+	for _, keyword := range optIn {
+		if strings.EqualFold(body, strings.TrimSpace(keyword)) {
+			return ConsentOptedIn
+		}
+	}
+	return ""
+}
+
+// recordConsent sets the consent of a customer and adds a history entry when
+// the state actually changes.
+func recordConsent(db dbExecutor, customerID int, change ConsentChange) error {
+	if change.Status == ConsentOptedIn && change.Source != ConsentSourceWebhook {
+		optedOut, err := optedOutByKeyword(db, "c.id = $1", customerID)
+		if err != nil {
+			return err
+		}
+		if optedOut {
+			return ErrKeywordOptOut
+		}
+	}
+
+	now := time.Now()
+	result, err := db.Exec("UPDATE public.customer SET opt_in_status = $1, opt_in_updated_at = $2 WHERE id = $3 AND opt_in_status <> $1",
+		change.Status, now, customerID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return err
+	}
+
+	var changedBy interface{}
+	if change.ChangedBy != 0 {
+		changedBy = change.ChangedBy
+	}
+	_, err = db.Exec("INSERT INTO public.customer_consent_history (customer_id, status, source, changed_by, requested_ip, note, created_date) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		customerID, change.Status, change.Source, changedBy, change.RequestedIP, change.Note, now)
+	return err
+}
+
+// optedOutByKeyword reports whether the customer matching condition on the
+// customer table aliased "c" is opted out and the latest change came from an
+// inbound keyword.
+func optedOutByKeyword(db dbExecutor, condition string, key interface{}) (bool, error) {
+	var optedOut bool
+	err := db.QueryRow(`SELECT c.opt_in_status = $2 AND COALESCE((SELECT h.source FROM public.customer_consent_history h
+			WHERE h.customer_id = c.id ORDER BY h.created_date DESC, h.id DESC LIMIT 1), '') = $3
+		FROM public.customer c WHERE `+condition, key, ConsentOptedOut, ConsentSourceWebhook).Scan(&optedOut)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return optedOut, err
+}
+
+func (cr *consentRepo) setConsent(query string, key interface{}, change ConsentChange) (bool, error) {
+	if change.Status != ConsentOptedIn && change.Status != ConsentOptedOut {
+		return false, fmt.Errorf("invalid consent %q", change.Status)
+	}
+	tx, err := cr.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var customerID int
+	err = tx.QueryRow(query, key).Scan(&customerID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := recordConsent(tx, customerID, change); err != nil {
+		if err != ErrKeywordOptOut {
+			log.Println("Error recording consent:", err)
+		}
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (cr *consentRepo) SetConsent(customerGID string, change ConsentChange) (bool, error) {
+	if _, err := uuid.Parse(customerGID); err != nil {
+		return false, nil
+	}
+	return cr.setConsent("SELECT id FROM public.customer WHERE gid = $1 FOR UPDATE", customerGID, change)
+}
+
+func (cr *consentRepo) SetConsentByPhone(normalizedPhone string, change ConsentChange) (bool, error) {
+	return cr.setConsent("SELECT id FROM public.customer WHERE normalized_phone = $1 FOR UPDATE", normalizedPhone, change)
+}
+
+func (cr *consentRepo) ConsentHistory(customerGID string) ([]ConsentEvent, error) {
+	if _, err := uuid.Parse(customerGID); err != nil {
+		return nil, sql.ErrNoRows
+	}
+	var customerID int
+	if err := cr.db.QueryRow("SELECT id FROM public.customer WHERE gid = $1", customerGID).Scan(&customerID); err != nil {
+		return nil, err
+	}
+
+	rows, err := cr.db.Query("SELECT id, status, source, COALESCE(changed_by, 0), requested_ip, note, created_date FROM public.customer_consent_history WHERE customer_id = $1 ORDER BY created_date, id", customerID)
+	if err != nil {
+		log.Println("Error retrieving consent history:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ConsentEvent{}
+	for rows.Next() {
+		var event ConsentEvent
+		if err := rows.Scan(&event.ID, &event.Status, &event.Source, &event.ChangedBy, &event.RequestedIP, &event.Note, &event.CreatedDate); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (cr *consentRepo) CheckSendAllowed(normalizedPhone string) error {
+	var status string
+	var archived bool
+	err := cr.db.QueryRow("SELECT opt_in_status, deleted_at IS NOT NULL FROM public.customer WHERE normalized_phone = $1", normalizedPhone).Scan(&status, &archived)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status == ConsentOptedOut {
+		return ErrOptedOut
+	}
+	if archived {
+		return ErrRecipientArchived
+	}
+	return nil
+}
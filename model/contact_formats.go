@@ -0,0 +1,202 @@
+package model
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ContactFormat identifies the file type of an uploaded contact list.
+type ContactFormat string
+
+const (
+	FormatCSV   ContactFormat = "csv"
+	FormatXLSX  ContactFormat = "xlsx"
+	FormatVCard ContactFormat = "vcf"
+)
+
+// ParseContactFormat picks the format from the "format" form value, falling
+// back to the extension of the uploaded file name.
+func ParseContactFormat(value, filename string) (ContactFormat, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		value = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch value {
+	case "", "csv", "txt":
+		return FormatCSV, nil
+	case "xlsx":
+		return FormatXLSX, nil
+	case "vcf", "vcard":
+		return FormatVCard, nil
+	}
+	return "", fmt.Errorf("unsupported contact format %q", value)
+}
+
+// recordSource yields the raw records of a contact file together with the
+// line (or spreadsheet row) each one came from.
+type recordSource interface {
+	Read() (record []string, line int, err error)
+}
+
+type csvSource struct {
+	reader *csv.Reader
+}
+
+func newCSVSource(file io.Reader, opts ImportOptions) *csvSource {
+	reader := csv.NewReader(decodeReader(file, opts.Encoding))
+	reader.FieldsPerRecord = -1
+	if opts.Delimiter != 0 {
+		reader.Comma = opts.Delimiter
+	}
+	return &csvSource{reader: reader}
+}
+
+func (s *csvSource) Read() ([]string, int, error) {
+	record, err := s.reader.Read()
+	if err != nil {
+		return nil, 0, err
+	}
+	line, _ := s.reader.FieldPos(0)
+	return record, line, nil
+}
+
+// sliceSource serves records that were parsed up front.
+type sliceSource struct {
+	records [][]string
+	lines   []int
+	next    int
+}
+
+func (s *sliceSource) Read() ([]string, int, error) {
+	if s.next >= len(s.records) {
+		return nil, 0, io.EOF
+	}
+	s.next++
+	return s.records[s.next-1], s.lines[s.next-1], nil
+}
+
+// newXLSXSource reads the named sheet, or the first sheet when sheet is empty.
+// Completely empty rows are skipped.
+func newXLSXSource(file io.Reader, sheet string) (*sliceSource, error) {
+	workbook, err := excelize.OpenReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer workbook.Close()
+
+	if sheet == "" {
+		sheet = workbook.GetSheetName(0)
+	}
+	if index, err := workbook.GetSheetIndex(sheet); err != nil || index < 0 {
+		return nil, fmt.Errorf("sheet %q not found", sheet)
+	}
+
+	rows, err := workbook.GetRows(sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &sliceSource{}
+	for i, row := range rows {
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		source.records = append(source.records, row)
+		source.lines = append(source.lines, i+1)
+	}
+	return source, nil
+}
+
+// vCardHeader is the synthetic header used for records built from vCards.
+var vCardHeader = []string{"name", "phone", "email", "organization", "title"}
+
+// newVCardSource parses vCard 3.0 and 4.0 files into one record per card. The
+// first mobile number of a card is used, or its first number of any kind.
+func newVCardSource(file io.Reader) (*sliceSource, error) {
+	scanner := bufio.NewScanner(decodeReader(file, EncodingUTF8))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	// Unfold continuation lines, remembering where each logical line began
+	var lines []string
+	var starts []int
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) {
+			lines[len(lines)-1] += text[1:]
+			continue
+		}
+		lines = append(lines, text)
+		starts = append(starts, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	source := &sliceSource{records: [][]string{vCardHeader}, lines: []int{0}}
+	var card map[string]string
+	var cardLine int
+	for i, text := range lines {
+		name, params, value := splitVCardLine(text)
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			card = make(map[string]string)
+			cardLine = starts[i]
+		case name == "END" && strings.EqualFold(value, "VCARD") && card != nil:
+			source.records = append(source.records, []string{card["name"], card["phone"], card["email"], card["organization"], card["title"]})
+			source.lines = append(source.lines, cardLine)
+			card = nil
+		case card == nil:
+			continue
+		case name == "FN":
+			card["name"] = value
+		case name == "N" && card["name"] == "":
+			// N is family;given;additional;prefix;suffix
+			parts := strings.Split(value, ";")
+			if len(parts) > 1 {
+				card["name"] = strings.TrimSpace(parts[1] + " " + parts[0])
+			} else {
+				card["name"] = value
+			}
+		case name == "TEL":
+			value = strings.TrimPrefix(value, "tel:")
+			mobile := strings.Contains(strings.ToLower(params), "cell")
+			if card["phone"] == "" || (mobile && card["mobile"] == "") {
+				card["phone"] = value
+				if mobile {
+					card["mobile"] = value
+				}
+			}
+		case name == "EMAIL" && card["email"] == "":
+			card["email"] = value
+		case name == "ORG":
+			card["organization"] = strings.TrimRight(strings.ReplaceAll(value, ";", ", "), ", ")
+		case name == "TITLE":
+			card["title"] = value
+		}
+	}
+	return source, nil
+}
+
+// splitVCardLine splits "item1.TEL;TYPE=CELL:+91 95623 89444" into the
+// upper-cased property name, its raw parameters and the unescaped value.
+func splitVCardLine(line string) (name, params, value string) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return "", "", ""
+	}
+	name, value = line[:colon], line[colon+1:]
+	if semi := strings.Index(name, ";"); semi >= 0 {
+		name, params = name[:semi], name[semi+1:]
+	}
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		name = name[dot+1:]
+	}
+	value = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`).Replace(value)
+	return strings.ToUpper(name), params, strings.TrimSpace(value)
+}
@@ -0,0 +1,143 @@
+package model
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseContactFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		filename string
+		want     ContactFormat
+		wantErr  bool
+	}{
+		{"form value wins", "vcard", "contacts.csv", FormatVCard, false},
+		{"extension", "", "Contacts.XLSX", FormatXLSX, false},
+		{"text file", "", "contacts.txt", FormatCSV, false},
+		{"no extension", "", "contacts", FormatCSV, false},
+		{"unsupported", "pdf", "contacts.pdf", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseContactFormat(tt.value, tt.filename)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseContactFormat(%q, %q) error = %v, wantErr %v", tt.value, tt.filename, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseContactFormat(%q, %q) = %q, want %q", tt.value, tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLooksLikeHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		record []string
+		want   bool
+	}{
+		{"known names", []string{"Name", "Phone Number"}, true},
+		{"alias with punctuation", []string{"WhatsApp_Number", "x"}, true},
+		{"unknown names without numbers", []string{"Customer", "Reference"}, true},
+		{"data row", []string{"Asha", "9562389444"}, false},
+		{"data row with formatted number", []string{"Asha", "+91 95623 89444"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := looksLikeHeader(tt.record); got != tt.want {
+				t.Errorf("looksLikeHeader(%q) = %v, want %v", tt.record, got, tt.want)
+			}
+		})
+	}
+}
+
+func readAll(t *testing.T, source recordSource) ([][]string, []int) {
+	t.Helper()
+	var records [][]string
+	var lines []int
+	for {
+		record, line, err := source.Read()
+		if err == io.EOF {
+			return records, lines
+		}
+		if err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+}
+
+func TestCSVSourceEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		encoding string
+		want     [][]string
+	}{
+		{"utf-8", "name,phone\nJosé,9562389444\n", EncodingUTF8, [][]string{{"name", "phone"}, {"José", "9562389444"}}},
+		{"utf-8 with byte order mark", "\xef\xbb\xbfname,phone\nAsha,9562389444\n", EncodingUTF8, [][]string{{"name", "phone"}, {"Asha", "9562389444"}}},
+		{"latin-1", "name,phone\nJos\xe9 M\xfcller,9562389444\n", EncodingLatin1, [][]string{{"name", "phone"}, {"José Müller", "9562389444"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, _ := readAll(t, newCSVSource(strings.NewReader(tt.input), ImportOptions{Encoding: tt.encoding}))
+			if !reflect.DeepEqual(records, tt.want) {
+				t.Errorf("records = %q, want %q", records, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSVSourceDelimiter(t *testing.T) {
+	records, lines := readAll(t, newCSVSource(strings.NewReader("name;phone\nAsha;9562389444\n"), ImportOptions{Delimiter: ';'}))
+	want := [][]string{{"name", "phone"}, {"Asha", "9562389444"}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+	if !reflect.DeepEqual(lines, []int{1, 2}) {
+		t.Errorf("lines = %v, want [1 2]", lines)
+	}
+}
+
+func TestVCardSource(t *testing.T) {
+	input := strings.Join([]string{
+		"BEGIN:VCARD",
+		"VERSION:3.0",
+		"N:Nair;Asha;;;",
+		"TEL;TYPE=WORK:+91 484 2345678",
+		"item1.TEL;TYPE=CELL:+91 95623 89444",
+		"TEL;TYPE=CELL:+91 90000 00000",
+		"EMAIL:asha@example.com",
+		"ORG:Example\\, Inc;Sales",
+		"END:VCARD",
+		"BEGIN:VCARD",
+		"VERSION:4.0",
+		"FN:Ravi",
+		"  Kumar",
+		"TEL;VALUE=uri:tel:+44-20-7946-0958",
+		"TITLE:Manager",
+		"END:VCARD",
+	}, "\r\n")
+
+	source, err := newVCardSource(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("newVCardSource error: %v", err)
+	}
+	records, lines := readAll(t, source)
+	want := [][]string{
+		vCardHeader,
+		{"Asha Nair", "+91 95623 89444", "asha@example.com", "Example, Inc, Sales", ""},
+		{"Ravi Kumar", "+44-20-7946-0958", "", "", "Manager"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %q, want %q", records, want)
+	}
+	if !reflect.DeepEqual(lines, []int{0, 1, 10}) {
+		t.Errorf("lines = %v, want [0 1 10]", lines)
+	}
+}
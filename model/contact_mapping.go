@@ -0,0 +1,321 @@
+package model
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Contact fields that a file column can be mapped to.
+const (
+	FieldCountryCode = "country_code"
+	FieldPhone       = "phone"
+	FieldName        = "name"
+	FieldEmail       = "email"
+	FieldTags        = "tags"
+	FieldOptIn       = "opt_in"
+	FieldLanguage    = "language"
+	FieldTimezone    = "timezone"
+)
+
+// HeaderMode tells the importer whether the first line of a file is a header.
+type HeaderMode string
+
+const (
+	HeaderAuto    HeaderMode = "auto"
+	HeaderPresent HeaderMode = "true"
+	HeaderAbsent  HeaderMode = "false"
+)
+
+// Supported file encodings.
+const (
+	EncodingUTF8   = "utf-8"
+	EncodingLatin1 = "latin-1"
+)
+
+// defaultColumnOrder is the layout of files without a header or mapping.
+var defaultColumnOrder = []string{FieldCountryCode, FieldPhone, FieldName, FieldEmail}
+
+// contactFields lists every field a column can be mapped to.
+var contactFields = []string{FieldCountryCode, FieldPhone, FieldName, FieldEmail, FieldTags, FieldOptIn, FieldLanguage, FieldTimezone}
+
+// headerAliases lists the header names recognised for each field, compared
+// after lower-casing and dropping spaces, dashes and underscores.
+var headerAliases = map[string][]string{
+	FieldCountryCode: {"countrycode", "cc", "dialcode", "isd", "isdcode", "callingcode"},
+	FieldPhone:       {"phone", "phonenumber", "mobile", "mobilenumber", "mobilephone", "whatsapp", "whatsappnumber", "contactnumber", "number", "msisdn", "cell"},
+	FieldName:        {"name", "fullname", "contactname", "customername", "displayname"},
+	FieldEmail:       {"email", "emailaddress", "mail"},
+	FieldTags:        {"tags", "tag", "labels", "label"},
+	FieldOptIn:       {"optin", "consent", "optinstatus", "whatsappoptin"},
+	FieldLanguage:    {"language", "lang", "locale", "preferredlanguage"},
+	FieldTimezone:    {"timezone", "tz", "timezonename"},
+}
+
+// columnLayout maps file columns to contact fields and custom attributes.
+type columnLayout struct {
+	fields map[string]int
+	extras map[int]string
+}
+
+// ParseColumnMapping decodes the "mapping" form value, a JSON object from
+// contact field to either a header name or a zero-based column index, e.g.
+// {"phone": "Mobile", "name": 0}.
+func ParseColumnMapping(value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid column mapping: %v", err)
+	}
+	mapping := make(map[string]string, len(raw))
+	for field, column := range raw {
+		if !isContactField(field) {
+			return nil, fmt.Errorf("unknown contact field %q in column mapping", field)
+		}
+		switch c := column.(type) {
+		case string:
+			mapping[field] = c
+		case float64:
+			mapping[field] = strconv.Itoa(int(c))
+		default:
+			return nil, fmt.Errorf("column for %q must be a header name or index", field)
+		}
+	}
+	return mapping, nil
+}
+
+// ParseHeaderMode converts the "header" form value into a HeaderMode.
+func ParseHeaderMode(value string) (HeaderMode, error) {
+	switch HeaderMode(strings.ToLower(strings.TrimSpace(value))) {
+	case "", HeaderAuto:
+		return HeaderAuto, nil
+	case HeaderPresent, "yes":
+		return HeaderPresent, nil
+	case HeaderAbsent, "no":
+		return HeaderAbsent, nil
+	}
+	return "", fmt.Errorf("unknown header mode %q", value)
+}
+
+// ParseDelimiter converts the "delimiter" form value into a field separator.
+func ParseDelimiter(value string) (rune, error) {
+	switch strings.ToLower(value) {
+	case "", ",", "comma":
+		return ',', nil
+	case ";", "semicolon":
+		return ';', nil
+	case "\t", "\\t", "tab":
+		return '\t', nil
+	case "|", "pipe":
+		return '|', nil
+	}
+	return 0, fmt.Errorf("unsupported delimiter %q", value)
+}
+
+// ParseEncoding normalises the "encoding" form value.
+func ParseEncoding(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "utf-8", "utf8":
+		return EncodingUTF8, nil
+	case "latin-1", "latin1", "iso-8859-1":
+		return EncodingLatin1, nil
+	}
+	return "", fmt.Errorf("unsupported encoding %q", value)
+}
+
+// decodeReader returns a UTF-8 reader for file. A UTF-8 byte order mark is
+// dropped; Latin-1 input is transcoded byte by byte.
+func decodeReader(file io.Reader, encoding string) io.Reader {
+	buffered := bufio.NewReader(file)
+	if encoding == EncodingLatin1 {
+		return &latin1Reader{r: buffered}
+	}
+	if bom, err := buffered.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		buffered.Discard(3)
+	}
+	return buffered
+}
+
+type latin1Reader struct {
+	r       io.ByteReader
+	pending []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(l.pending) > 0 {
+			c := copy(p[n:], l.pending)
+			l.pending = l.pending[c:]
+			n += c
+			continue
+		}
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b < utf8.RuneSelf {
+			p[n] = b
+			n++
+			continue
+		}
+		var buf [2]byte
+		utf8.EncodeRune(buf[:], rune(b))
+		l.pending = buf[:]
+	}
+	return n, nil
+}
+
+func isContactField(field string) bool {
+	for _, f := range contactFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func headerKey(name string) string {
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// looksLikeHeader guesses whether the first record of a file is a header: it
+// is if any cell is a known field name, or if no cell looks like a phone
+// number.
+func looksLikeHeader(record []string) bool {
+	for _, cell := range record {
+		key := headerKey(cell)
+		for _, aliases := range headerAliases {
+			for _, alias := range aliases {
+				if key == alias {
+					return true
+				}
+			}
+		}
+	}
+	for _, cell := range record {
+		digits := 0
+		for _, r := range cell {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits >= 6 {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveLayout works out which column holds which field. header is nil when
+// the file has no header row.
+func resolveLayout(header []string, width int, mapping map[string]string) (*columnLayout, error) {
+	layout := &columnLayout{fields: make(map[string]int), extras: make(map[int]string)}
+
+	switch {
+	case len(mapping) > 0:
+		for field, column := range mapping {
+			index := -1
+			for i, name := range header {
+				if headerKey(name) == headerKey(column) {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				n, err := strconv.Atoi(column)
+				if err != nil {
+					return nil, fmt.Errorf("column %q mapped to %s was not found", column, field)
+				}
+				index = n
+			}
+			if index < 0 || index >= width {
+				return nil, fmt.Errorf("column %d mapped to %s is out of range", index, field)
+			}
+			layout.fields[field] = index
+		}
+
+	case header != nil:
+		for i, name := range header {
+			key := headerKey(name)
+			for field, aliases := range headerAliases {
+				if _, taken := layout.fields[field]; taken {
+					continue
+				}
+				for _, alias := range aliases {
+					if key == alias {
+						layout.fields[field] = i
+					}
+				}
+			}
+		}
+	}
+
+	// Without a usable header or mapping, fall back to the historical
+	// country_code, phone, name, email order.
+	if len(mapping) == 0 {
+		if _, ok := layout.fields[FieldPhone]; !ok {
+			layout.fields = make(map[string]int)
+			for i, field := range defaultColumnOrder {
+				if i < width {
+					layout.fields[field] = i
+				}
+			}
+		}
+	}
+
+	if _, ok := layout.fields[FieldPhone]; !ok {
+		return nil, errors.New("no phone column found, provide a column mapping")
+	}
+
+	mapped := make(map[int]bool, len(layout.fields))
+	for _, index := range layout.fields {
+		mapped[index] = true
+	}
+	for i := 0; i < width; i++ {
+		if mapped[i] {
+			continue
+		}
+		key := fmt.Sprintf("column_%d", i+1)
+		if header != nil && i < len(header) && strings.TrimSpace(header[i]) != "" {
+			key = strings.TrimSpace(header[i])
+		}
+		layout.extras[i] = key
+	}
+	return layout, nil
+}
+
+// cell returns the trimmed value of a mapped field, or "" when the field is
+// not mapped or the record is too short.
+func (l *columnLayout) cell(record []string, field string) string {
+	index, ok := l.fields[field]
+	if !ok || index >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[index])
+}
+
+// attributes collects the non-empty unmapped columns of a record.
+func (l *columnLayout) attributes(record []string) map[string]interface{} {
+	var attrs map[string]interface{}
+	for index, key := range l.extras {
+		if index >= len(record) || strings.TrimSpace(record[index]) == "" {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]interface{})
+		}
+		attrs[key] = strings.TrimSpace(record[index])
+	}
+	return attrs
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// countryFlag returns the emoji flag for an ISO-3166 alpha-2 code, built from
+// the two regional indicator symbols.
+func countryFlag(iso2 string) string {
+	iso2 = strings.ToUpper(strings.TrimSpace(iso2))
+	if len(iso2) != 2 || iso2[0] < 'A' || iso2[0] > 'Z' || iso2[1] < 'A' || iso2[1] > 'Z' {
+		return ""
+	}
+	const regionalIndicatorA = 0x1F1E6
+	return string([]rune{rune(regionalIndicatorA + int(iso2[0]-'A')), rune(regionalIndicatorA + int(iso2[1]-'A'))})
+}
+
+// cachedCountryRepo keeps public.country_codes in memory and reloads it once
+// the ttl has passed. Lookups and searches are served from the cache.
+type cachedCountryRepo struct {
+	source CountryRepository
+	ttl    time.Duration
+
+	mu        sync.RWMutex
+	countries []Country
+	loadedAt  time.Time
+}
+
+// NewCachedCountryRepository wraps a country repository with an in-memory
+// cache of the whole table.
+func NewCachedCountryRepository(source CountryRepository, ttl time.Duration) CountryRepository {
+	return &cachedCountryRepo{source: source, ttl: ttl}
+}
+
+func (cr *cachedCountryRepo) GetAllCountries() ([]Country, error) {
+	cr.mu.RLock()
+	if cr.countries != nil && time.Since(cr.loadedAt) < cr.ttl {
+		countries := cr.countries
+		cr.mu.RUnlock()
+		return countries, nil
+	}
+	cr.mu.RUnlock()
+
+	countries, err := cr.source.GetAllCountries()
+	if err != nil {
+		return nil, err
+	}
+	if countries == nil {
+		countries = []Country{}
+	}
+	cr.mu.Lock()
+	cr.countries, cr.loadedAt = countries, time.Now()
+	cr.mu.Unlock()
+	return countries, nil
+}
+
+// filter returns the cached countries accepted by keep.
+func (cr *cachedCountryRepo) filter(keep func(Country) bool) ([]Country, error) {
+	countries, err := cr.GetAllCountries()
+	if err != nil {
+		return nil, err
+	}
+	var matches []Country
+	for _, country := range countries {
+		if keep(country) {
+			matches = append(matches, country)
+		}
+	}
+	return matches, nil
+}
+
+func (cr *cachedCountryRepo) GetCountriesByCode(countryCode int) ([]Country, error) {
+	return cr.filter(func(c Country) bool { return c.CountryCode == countryCode })
+}
+
+func (cr *cachedCountryRepo) GetCountryByISO(iso string) (*Country, error) {
+	iso = strings.ToUpper(strings.TrimSpace(iso))
+	matches, err := cr.filter(func(c Country) bool { return iso != "" && (c.ISO2 == iso || c.ISO3 == iso) })
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+	return &matches[0], nil
+}
+
+func (cr *cachedCountryRepo) SearchCountries(prefix string) ([]Country, error) {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	return cr.filter(func(c Country) bool { return strings.HasPrefix(strings.ToLower(c.CountryName), prefix) })
+}
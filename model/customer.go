@@ -3,56 +3,121 @@ package model
 import (
 	"database/sql"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+	"whatbot/utils"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type Customer struct {
-	ID           int
-	GID          string
-	PHONE_NUMBER string
-	NAME         string
-	CREATED_DATE time.Time
+	ID               int
+	GID              string
+	PHONE_NUMBER     string
+	NORMALIZED_PHONE sql.NullString
+	NAME             string
+	COUNTRY_CODE     int
+	EMAIL            string
+	ATTRIBUTES       map[string]interface{}
+	OPT_IN_STATUS    string
+	LANGUAGE         string
+	TIMEZONE         string
+	WA_PROFILE_NAME  string
+	FIRST_SEEN_AT    sql.NullTime
+	LAST_SEEN_AT     sql.NullTime
+	DELETED_AT       sql.NullTime
+	CREATED_DATE     time.Time
 }
 
+// CustomerUpdate lists the fields to change; nil fields are left alone.
+// Attributes are merged into the stored ones and nil values remove a key.
+type CustomerUpdate struct {
+	Name       *string
+	Email      *string
+	Language   *string
+	Timezone   *string
+	Attributes map[string]interface{}
+}
+
+// ErrDuplicateCustomer is returned when a customer with the same normalized
+// phone number already exists.
+var ErrDuplicateCustomer = errors.New("a customer with this phone number already exists")
+
 type Contacts struct {
-	COUNTRY_CODE int
-	PHONE_NUMBER string
-	NAME         string
-	EMAIL        string
+	COUNTRY_CODE     int
+	PHONE_NUMBER     string
+	NORMALIZED_PHONE string
+	NAME             string
+	EMAIL            string
+	TAGS             []string
+	ATTRIBUTES       map[string]interface{}
+	LANGUAGE         string
+	TIMEZONE         string
+	// CONSENT is the opt-in state to record, or "" to leave it unchanged.
+	CONSENT string
 }
 
 type Country struct {
 	ID          int    `json:"id"`
 	CountryCode int    `json:"country_code"`
 	CountryName string `json:"country_name"`
+	ISO2        string `json:"iso2"`
+	ISO3        string `json:"iso3"`
+	DialPrefix  string `json:"dial_prefix"`
+	// MinLength and MaxLength bound the digits of a national number, 0 when unknown.
+	MinLength int    `json:"min_length"`
+	MaxLength int    `json:"max_length"`
+	Flag      string `json:"flag"`
 }
 
-type CSVRepository interface {
+// ContactImporter loads contact lists in any supported format into
+// public.customer.
+type ContactImporter interface {
 	ReadDataFromCSV(filename string) ([]*Contacts, map[string]interface{}, error)
-	ReadDataFromCSVFile(file multipart.File, userID int, requestedIp string) ([]*Contacts, map[string]interface{}, error) // Modified method signature
+	ReadDataFromCSVFile(file multipart.File, userID int, requestedIp string, opts ImportOptions) (*ImportReport, error)
+	ImportContacts(file io.Reader, format ContactFormat, userID int, requestedIp string, opts ImportOptions) (*ImportReport, error)
 }
 
 type CustomerRepository interface {
-	CustomerList(offset, limit int) ([]*Customer, int, error)
+	CustomerList(filter CustomerFilter, offset, limit int) ([]*Customer, int, error)
+	GetCustomer(gid string) (*Customer, error)
+	GetCustomerByPhone(normalizedPhone string) (*Customer, error)
+	CreateCustomer(contact *Contacts, userID int, requestedIp string) (*Customer, error)
+	UpdateCustomer(gid string, update CustomerUpdate) (*Customer, error)
+	// TouchInboundContact creates or refreshes the customer behind an inbound
+	// WhatsApp contact and reports whether it was created.
+	TouchInboundContact(waID, profileName string, seenAt time.Time) (bool, error)
+	// ArchiveCustomer soft deletes a customer; RestoreCustomer undoes it.
+	ArchiveCustomer(gid string, userID int) (bool, error)
+	RestoreCustomer(gid string) (bool, error)
+	PurgeArchived(before time.Time) (int64, error)
+	ExportCustomers(filter CustomerFilter, fn func(*CustomerExport) error) error
 }
 
 type CountryRepository interface {
 	GetAllCountries() ([]Country, error)
-	GetCountriesByCode(countryCode string) ([]Country, error)
+	GetCountriesByCode(countryCode int) ([]Country, error)
+	// GetCountryByISO finds a country by alpha-2 or alpha-3 code; it returns
+	// nil when there is none.
+	GetCountryByISO(iso string) (*Country, error)
+	// SearchCountries returns the countries whose name starts with prefix.
+	SearchCountries(prefix string) ([]Country, error)
 }
 
 type customerRepo struct {
 	db *sql.DB
 }
 
-type csvRepo struct {
+type contactImporter struct {
 	db *sql.DB
 }
 type countryRepo struct {
@@ -63,17 +128,21 @@ func NewCustomerRepository(db *sql.DB) CustomerRepository {
 	return &customerRepo{db: db}
 }
 
-func NewCsvRepository(db *sql.DB) CSVRepository {
-	return &csvRepo{db: db}
+func NewContactImporter(db *sql.DB) ContactImporter {
+	return &contactImporter{db: db}
 }
 func NewCountryRepository(db *sql.DB) CountryRepository {
 	return &countryRepo{db: db}
 }
 
-func (cu *customerRepo) CustomerList(offset, limit int) ([]*Customer, int, error) {
+func (cu *customerRepo) CustomerList(filter CustomerFilter, offset, limit int) ([]*Customer, int, error) {
 	var customers []*Customer
-	query := "SELECT id, gid, phone_number, name, created_date FROM public.customer LIMIT $1 OFFSET $2"
-	rows, err := cu.db.Query(query, limit, offset)
+	where, args, err := customerWhere(cu.db, filter, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	query := fmt.Sprintf("SELECT "+customerColumns+" FROM public.customer c%s ORDER BY c.id LIMIT $%d OFFSET $%d", where, len(args)+1, len(args)+2)
+	rows, err := cu.db.Query(query, append(args, limit, offset)...)
 	if err != nil {
 		log.Println("Error retrieving customers from database:", err)
 		return nil, 0, err
@@ -81,13 +150,12 @@ func (cu *customerRepo) CustomerList(offset, limit int) ([]*Customer, int, error
 	defer rows.Close()
 
 	for rows.Next() {
-		var customer Customer
-		err := rows.Scan(&customer.ID, &customer.GID, &customer.PHONE_NUMBER, &customer.NAME, &customer.CREATED_DATE)
+		customer, err := scanCustomer(rows)
 		if err != nil {
 			log.Println("Error scanning customer row:", err)
 			continue
 		}
-		customers = append(customers, &customer)
+		customers = append(customers, customer)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -96,7 +164,7 @@ func (cu *customerRepo) CustomerList(offset, limit int) ([]*Customer, int, error
 	}
 
 	var total int
-	err = cu.db.QueryRow("SELECT COUNT(*) FROM public.customer").Scan(&total)
+	err = cu.db.QueryRow("SELECT COUNT(*) FROM public.customer c"+where, args...).Scan(&total)
 	if err != nil {
 		log.Println("Error retrieving customer count from database:", err)
 		return nil, 0, err
@@ -104,94 +172,132 @@ func (cu *customerRepo) CustomerList(offset, limit int) ([]*Customer, int, error
 
 	return customers, total, nil
 }
-func (cu *csvRepo) ReadDataFromCSV(filename string) ([]*Contacts, map[string]interface{}, error) {
-	var contacts []*Contacts
 
-	// Open the CSV file
-	filePath := "C:/Users/HARI KRISHNAN SG/Desktop/democsv/" + filename
-	file, err := os.Open(filePath)
+const customerColumns = "c.id, c.gid, c.phone_number, c.normalized_phone, c.name, COALESCE(c.country_code, 0), COALESCE(c.email, ''), c.attributes, c.opt_in_status, c.language, c.timezone, c.wa_profile_name, c.first_seen_at, c.last_seen_at, c.deleted_at, c.created_date"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCustomer(row rowScanner) (*Customer, error) {
+	customer := &Customer{}
+	var attributes []byte
+	err := row.Scan(&customer.ID, &customer.GID, &customer.PHONE_NUMBER, &customer.NORMALIZED_PHONE, &customer.NAME,
+		&customer.COUNTRY_CODE, &customer.EMAIL, &attributes, &customer.OPT_IN_STATUS, &customer.LANGUAGE, &customer.TIMEZONE,
+		&customer.WA_PROFILE_NAME, &customer.FIRST_SEEN_AT, &customer.LAST_SEEN_AT, &customer.DELETED_AT, &customer.CREATED_DATE)
 	if err != nil {
-		log.Println("Error opening CSV file:", err)
-		return nil, nil, err
+		return nil, err
 	}
-	defer file.Close()
-
-	// Create a CSV reader
-	reader := csv.NewReader(file)
+	if err := json.Unmarshal(attributes, &customer.ATTRIBUTES); err != nil {
+		return nil, err
+	}
+	return customer, nil
+}
 
-	// Skip the header row if it exists
-	if _, err := reader.Read(); err != nil {
-		log.Println("Error reading CSV header:", err)
-		return nil, nil, err
+func (cu *customerRepo) GetCustomer(gid string) (*Customer, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return nil, sql.ErrNoRows
 	}
+	return scanCustomer(cu.db.QueryRow("SELECT "+customerColumns+" FROM public.customer c WHERE c.gid = $1", gid))
+}
 
-	// Prepare the SQL statement for inserting data
-	stmt, err := cu.db.Prepare("INSERT INTO public.customer (gid, phone_number, name, created_date, country_code, email) VALUES ($1, $2, $3, $4, $5, $6)")
+func (cu *customerRepo) GetCustomerByPhone(normalizedPhone string) (*Customer, error) {
+	return scanCustomer(cu.db.QueryRow("SELECT "+customerColumns+" FROM public.customer c WHERE c.normalized_phone = $1", normalizedPhone))
+}
+
+// CreateCustomer adds a single customer. Attributes must already have been
+// checked against the attribute schema.
+func (cu *customerRepo) CreateCustomer(contact *Contacts, userID int, requestedIp string) (*Customer, error) {
+	normalized, err := utils.NormalizePhone(contact.COUNTRY_CODE, contact.PHONE_NUMBER)
 	if err != nil {
-		log.Println("Error preparing SQL statement:", err)
-		return nil, nil, err
+		return nil, err
+	}
+	contact.NORMALIZED_PHONE = normalized
+	erased, err := isTombstoned(cu.db, normalized)
+	if err != nil {
+		return nil, err
+	}
+	if erased {
+		return nil, ErrTombstoned
 	}
-	defer stmt.Close()
-
-	// Read each record from the CSV file
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			// End of file
-			break
-		}
-		if err != nil {
-			log.Println("Error reading CSV record:", err)
-			return nil, nil, err
-		}
 
-		// Check if the record has the expected number of fields
-		if len(record) < 4 {
-			log.Println("Invalid CSV record:", record)
-			continue // Skip this record
+	attributes := []byte("{}")
+	if len(contact.ATTRIBUTES) > 0 {
+		if attributes, err = json.Marshal(contact.ATTRIBUTES); err != nil {
+			return nil, err
 		}
+	}
 
-		// Generate a random UUID for gid
-		gid := uuid.New()
-
-		// Parse the country code
-		countryCode, err := strconv.Atoi(record[0])
-		if err != nil {
-			log.Println("Error converting country code to integer:", err)
-			return nil, nil, err
+	gid := uuid.New().String()
+	var customerID int
+	// Language and timezone default to those of the country
+	err = cu.db.QueryRow("INSERT INTO public.customer (gid, phone_number, name, created_date, country_code, email, uploaded_by, requested_ip, normalized_phone, attributes, language, timezone) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, "+
+		"COALESCE(NULLIF($11, ''), "+countryDefaultSQL("default_language", 5)+"), COALESCE(NULLIF($12, ''), "+countryDefaultSQL("default_timezone", 5)+")) RETURNING id",
+		gid, contact.PHONE_NUMBER, contact.NAME, time.Now(), contact.COUNTRY_CODE, contact.EMAIL, userID, requestedIp, normalized, string(attributes), contact.LANGUAGE, contact.TIMEZONE).Scan(&customerID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return nil, ErrDuplicateCustomer
+	}
+	if err != nil {
+		log.Println("Error creating customer:", err)
+		return nil, err
+	}
+	if err := tagCustomer(cu.db, customerID, contact.TAGS, userID); err != nil {
+		return nil, err
+	}
+	if contact.CONSENT != "" {
+		change := ConsentChange{Status: contact.CONSENT, Source: ConsentSourceAPI, ChangedBy: userID, RequestedIP: requestedIp}
+		if err := recordConsent(cu.db, customerID, change); err != nil {
+			return nil, err
 		}
+	}
+	return cu.GetCustomer(gid)
+}
 
-		// Execute the SQL statement to insert data into the table
-		_, err = stmt.Exec(gid, record[1], record[2], time.Now(), countryCode, record[3])
-		if err != nil {
-			log.Println("Error inserting data into the database:", err)
-			return nil, nil, err
-		}
+func (cu *customerRepo) UpdateCustomer(gid string, update CustomerUpdate) (*Customer, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return nil, sql.ErrNoRows
+	}
 
-		// Create a new contact instance and append it to the contacts slice
-		contact := &Contacts{
-			COUNTRY_CODE: countryCode,
-			PHONE_NUMBER: record[1],
-			NAME:         record[2],
-			EMAIL:        record[3],
+	set := map[string]interface{}{}
+	var remove []string
+	for key, value := range update.Attributes {
+		if value == nil {
+			remove = append(remove, key)
+		} else {
+			set[key] = value
 		}
-		contacts = append(contacts, contact)
 	}
-
-	// Create a success response JSON with contacts
-	response := map[string]interface{}{
-		"status":   "success",
-		"message":  "Data inserted successfully",
-		"date":     time.Now().Format(time.RFC3339),
-		"contacts": contacts,
+	attributes, err := json.Marshal(set)
+	if err != nil {
+		return nil, err
 	}
 
-	return contacts, response, nil
+	result, err := cu.db.Exec(`UPDATE public.customer SET name = COALESCE($1, name), email = COALESCE($2, email),
+		language = COALESCE($3, language), timezone = COALESCE($4, timezone),
+		attributes = (attributes || $5::jsonb) - $6::text[] WHERE gid = $7`,
+		update.Name, update.Email, update.Language, update.Timezone, string(attributes), pq.Array(remove), gid)
+	if err != nil {
+		log.Println("Error updating customer:", err)
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return cu.GetCustomer(gid)
 }
-
-func (cu *csvRepo) ReadDataFromCSVFile(file multipart.File, userID int, requestedIp string) ([]*Contacts, map[string]interface{}, error) {
+func (cu *contactImporter) ReadDataFromCSV(filename string) ([]*Contacts, map[string]interface{}, error) {
 	var contacts []*Contacts
 
+	// Open the CSV file
+	filePath := "C:/Users/HARI KRISHNAN SG/Desktop/democsv/" + filename
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Println("Error opening CSV file:", err)
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	// Create a CSV reader
 	reader := csv.NewReader(file)
 
 	// Skip the header row if it exists
@@ -201,7 +307,7 @@ func (cu *csvRepo) ReadDataFromCSVFile(file multipart.File, userID int, requeste
 	}
 
 	// Prepare the SQL statement for inserting data
-	stmt, err := cu.db.Prepare("INSERT INTO public.customer (gid, phone_number, name, created_date, country_code, email,uploaded_by,requested_ip) VALUES ($1, $2, $3, $4, $5, $6,$7,$8)")
+	stmt, err := cu.db.Prepare("INSERT INTO public.customer (gid, phone_number, name, created_date, country_code, email) VALUES ($1, $2, $3, $4, $5, $6)")
 	if err != nil {
 		log.Println("Error preparing SQL statement:", err)
 		return nil, nil, err
@@ -237,7 +343,7 @@ func (cu *csvRepo) ReadDataFromCSVFile(file multipart.File, userID int, requeste
 		}
 
 		// Execute the SQL statement to insert data into the table
-		_, err = stmt.Exec(gid, record[1], record[2], time.Now(), countryCode, record[3], userID, requestedIp)
+		_, err = stmt.Exec(gid, record[1], record[2], time.Now(), countryCode, record[3])
 		if err != nil {
 			log.Println("Error inserting data into the database:", err)
 			return nil, nil, err
@@ -263,9 +369,15 @@ func (cu *csvRepo) ReadDataFromCSVFile(file multipart.File, userID int, requeste
 
 	return contacts, response, nil
 }
-func (cu *countryRepo) GetAllCountries() ([]Country, error) {
-	query := "SELECT id, country_code, country_name FROM public.country_codes"
-	rows, err := cu.db.Query(query)
+
+func (cu *contactImporter) ReadDataFromCSVFile(file multipart.File, userID int, requestedIp string, opts ImportOptions) (*ImportReport, error) {
+	return cu.ImportContacts(file, FormatCSV, userID, requestedIp, opts)
+}
+
+const countryColumns = "id, country_code, country_name, COALESCE(iso2, ''), COALESCE(iso3, ''), COALESCE(dial_prefix, '+' || country_code::text), COALESCE(min_length, 0), COALESCE(max_length, 0)"
+
+func (cu *countryRepo) queryCountries(where string, args ...interface{}) ([]Country, error) {
+	rows, err := cu.db.Query("SELECT "+countryColumns+" FROM public.country_codes"+where+" ORDER BY country_name", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -274,38 +386,40 @@ func (cu *countryRepo) GetAllCountries() ([]Country, error) {
 	var countries []Country
 	for rows.Next() {
 		var country Country
-		if err := rows.Scan(&country.ID, &country.CountryCode, &country.CountryName); err != nil {
+		if err := rows.Scan(&country.ID, &country.CountryCode, &country.CountryName, &country.ISO2, &country.ISO3,
+			&country.DialPrefix, &country.MinLength, &country.MaxLength); err != nil {
 			return nil, err
 		}
+		country.ISO2 = strings.TrimSpace(country.ISO2)
+		country.ISO3 = strings.TrimSpace(country.ISO3)
+		country.Flag = countryFlag(country.ISO2)
 		countries = append(countries, country)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-
 	return countries, nil
 }
 
-func (cu *countryRepo) GetCountriesByCode(countryCode string) ([]Country, error) {
-	query := "SELECT id, country_code, country_name FROM public.country_codes WHERE country_code = $1"
-	rows, err := cu.db.Query(query, countryCode)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+func (cu *countryRepo) GetAllCountries() ([]Country, error) {
+	return cu.queryCountries("")
+}
 
-	var countries []Country
-	for rows.Next() {
-		var country Country
-		if err := rows.Scan(&country.ID, &country.CountryCode, &country.CountryName); err != nil {
-			return nil, err
-		}
-		countries = append(countries, country)
-	}
+func (cu *countryRepo) GetCountriesByCode(countryCode int) ([]Country, error) {
+	return cu.queryCountries(" WHERE country_code = $1", countryCode)
+}
 
-	if err := rows.Err(); err != nil{
+func (cu *countryRepo) GetCountryByISO(iso string) (*Country, error) {
+	iso = strings.ToUpper(strings.TrimSpace(iso))
+	countries, err := cu.queryCountries(" WHERE iso2 = $1 OR iso3 = $1", iso)
+	if err != nil || len(countries) == 0 {
 		return nil, err
 	}
-	return countries, nil
+	return &countries[0], nil
+}
+
+func (cu *countryRepo) SearchCountries(prefix string) ([]Country, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.TrimSpace(prefix)) + "%"
+	return cu.queryCountries(" WHERE country_name ILIKE $1", pattern)
 }
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Values of CustomerFilter.Archived.
+const (
+	// ArchivedExclude lists active customers only; it is the default.
+	ArchivedExclude = ""
+	// ArchivedOnly lists archived (soft deleted) customers only.
+	ArchivedOnly = "only"
+	// ArchivedInclude lists active and archived customers.
+	ArchivedInclude = "all"
+)
+
+func (cu *customerRepo) ArchiveCustomer(gid string, userID int) (bool, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return false, nil
+	}
+	result, err := cu.db.Exec("UPDATE public.customer SET deleted_at = $1, deleted_by = $2 WHERE gid = $3 AND deleted_at IS NULL", time.Now(), userID, gid)
+	if err != nil {
+		log.Println("Error archiving customer:", err)
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (cu *customerRepo) RestoreCustomer(gid string) (bool, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return false, nil
+	}
+	result, err := cu.db.Exec("UPDATE public.customer SET deleted_at = NULL, deleted_by = NULL WHERE gid = $1 AND deleted_at IS NOT NULL", gid)
+	if err != nil {
+		log.Println("Error restoring customer:", err)
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// PurgeArchived hard deletes customers archived before the given time.
+// Customers with inbound or outbound messages are kept so that conversation
+// history stays linked to a customer.
+func (cu *customerRepo) PurgeArchived(before time.Time) (int64, error) {
+	result, err := cu.db.Exec(`DELETE FROM public.customer c
+		WHERE c.deleted_at IS NOT NULL AND c.deleted_at < $1
+		AND NOT EXISTS (SELECT 1 FROM whatsapp_data w WHERE w.customer_gid = c.gid)
+		AND NOT EXISTS (SELECT 1 FROM public.outbound_messages o WHERE o.customer_gid = c.gid OR o.recipient_phone = c.normalized_phone)`, before)
+	if err != nil {
+		log.Println("Error purging archived customers:", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// archivedCondition is the customerWhere condition for a CustomerFilter.Archived value.
+func archivedCondition(archived string) string {
+	switch archived {
+	case ArchivedOnly:
+		return "c.deleted_at IS NOT NULL"
+	case ArchivedInclude:
+		return ""
+	}
+	return "c.deleted_at IS NULL"
+}
@@ -0,0 +1,233 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AttributeType is the type of a custom customer attribute.
+type AttributeType string
+
+const (
+	AttributeString  AttributeType = "string"
+	AttributeNumber  AttributeType = "number"
+	AttributeDate    AttributeType = "date"
+	AttributeBoolean AttributeType = "boolean"
+	AttributeEnum    AttributeType = "enum"
+)
+
+// AttributeDefinition declares one custom attribute of a business. Date
+// values are stored as YYYY-MM-DD; enum values must be one of Options.
+type AttributeDefinition struct {
+	ID          int           `json:"id"`
+	Key         string        `json:"key"`
+	Label       string        `json:"label"`
+	Type        AttributeType `json:"type"`
+	Options     []string      `json:"options,omitempty"`
+	CreatedBy   int           `json:"created_by"`
+	CreatedDate time.Time     `json:"created_date"`
+}
+
+// AttributeSchema holds the attribute definitions of a business by key.
+// Attributes missing from the schema are kept as strings.
+type AttributeSchema map[string]*AttributeDefinition
+
+// ErrInvalidAttribute wraps every attribute validation error.
+var ErrInvalidAttribute = errors.New("invalid attribute")
+
+var attributeKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+type AttributeSchemaRepository interface {
+	GetSchema(businessID string) (AttributeSchema, error)
+	ListAttributes(businessID string) ([]*AttributeDefinition, error)
+	// SaveAttribute creates the definition or replaces the one with the same key.
+	SaveAttribute(businessID string, def *AttributeDefinition) error
+	DeleteAttribute(businessID, key string) (bool, error)
+}
+
+type attributeSchemaRepo struct {
+	db *sql.DB
+}
+
+func NewAttributeSchemaRepository(db *sql.DB) AttributeSchemaRepository {
+	return &attributeSchemaRepo{db: db}
+}
+
+func (ar *attributeSchemaRepo) ListAttributes(businessID string) ([]*AttributeDefinition, error) {
+	rows, err := ar.db.Query("SELECT id, key, label, type, options, COALESCE(created_by, 0), created_date FROM public.customer_attribute_schema WHERE business_id = $1 ORDER BY key", businessID)
+	if err != nil {
+		log.Println("Error retrieving attribute schema:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var defs []*AttributeDefinition
+	for rows.Next() {
+		def := &AttributeDefinition{}
+		if err := rows.Scan(&def.ID, &def.Key, &def.Label, &def.Type, pq.Array(&def.Options), &def.CreatedBy, &def.CreatedDate); err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+	return defs, rows.Err()
+}
+
+func (ar *attributeSchemaRepo) GetSchema(businessID string) (AttributeSchema, error) {
+	defs, err := ar.ListAttributes(businessID)
+	if err != nil {
+		return nil, err
+	}
+	schema := make(AttributeSchema, len(defs))
+	for _, def := range defs {
+		schema[def.Key] = def
+	}
+	return schema, nil
+}
+
+func (ar *attributeSchemaRepo) SaveAttribute(businessID string, def *AttributeDefinition) error {
+	if err := def.validate(); err != nil {
+		return err
+	}
+	def.CreatedDate = time.Now()
+	err := ar.db.QueryRow(`INSERT INTO public.customer_attribute_schema (business_id, key, label, type, options, created_by, created_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (business_id, key) DO UPDATE SET label = EXCLUDED.label, type = EXCLUDED.type, options = EXCLUDED.options
+		RETURNING id, created_date`,
+		businessID, def.Key, def.Label, def.Type, pq.Array(def.Options), def.CreatedBy, def.CreatedDate).Scan(&def.ID, &def.CreatedDate)
+	if err != nil {
+		log.Println("Error saving attribute definition:", err)
+	}
+	return err
+}
+
+func (ar *attributeSchemaRepo) DeleteAttribute(businessID, key string) (bool, error) {
+	result, err := ar.db.Exec("DELETE FROM public.customer_attribute_schema WHERE business_id = $1 AND key = $2", businessID, key)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (def *AttributeDefinition) validate() error {
+	def.Key = strings.TrimSpace(def.Key)
+	if !attributeKeyPattern.MatchString(def.Key) {
+		return fmt.Errorf("%w: key %q must be lower case letters, digits and underscores", ErrInvalidAttribute, def.Key)
+	}
+	def.Type = AttributeType(strings.ToLower(string(def.Type)))
+	switch def.Type {
+	case AttributeString, AttributeNumber, AttributeDate, AttributeBoolean:
+		def.Options = nil
+	case AttributeEnum:
+		var options []string
+		for _, option := range def.Options {
+			if option = strings.TrimSpace(option); option != "" {
+				options = append(options, option)
+			}
+		}
+		if len(options) == 0 {
+			return fmt.Errorf("%w: enum %q needs at least one option", ErrInvalidAttribute, def.Key)
+		}
+		def.Options = options
+	default:
+		return fmt.Errorf("%w: unknown type %q, use string, number, date, boolean or enum", ErrInvalidAttribute, def.Type)
+	}
+	return nil
+}
+
+// Validate converts attribute values to their declared types. Empty strings
+// are dropped and nil values are kept so that updates can remove a key.
+func (s AttributeSchema) Validate(attrs map[string]interface{}) (map[string]interface{}, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]interface{}, len(attrs))
+	for key, value := range attrs {
+		if value == nil {
+			out[key] = nil
+			continue
+		}
+		if text, ok := value.(string); ok && strings.TrimSpace(text) == "" {
+			continue
+		}
+		def, ok := s[key]
+		if !ok {
+			text, err := attributeText(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidAttribute, key, err)
+			}
+			out[key] = text
+			continue
+		}
+		converted, err := def.convert(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidAttribute, key, err)
+		}
+		out[key] = converted
+	}
+	return out, nil
+}
+
+func attributeText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", errors.New("expected a single value")
+}
+
+func (def *AttributeDefinition) convert(value interface{}) (interface{}, error) {
+	text, err := attributeText(value)
+	if err != nil {
+		return nil, err
+	}
+	switch def.Type {
+	case AttributeNumber:
+		if number, ok := value.(float64); ok {
+			return number, nil
+		}
+		number, err := strconv.ParseFloat(strings.ReplaceAll(text, ",", ""), 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number, got %q", text)
+		}
+		return number, nil
+	case AttributeBoolean:
+		if flag, ok := value.(bool); ok {
+			return flag, nil
+		}
+		switch strings.ToLower(text) {
+		case "true", "yes", "y", "1":
+			return true, nil
+		case "false", "no", "n", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("expected true or false, got %q", text)
+	case AttributeDate:
+		for _, layout := range []string{"2006-01-02", time.RFC3339, "02/01/2006"} {
+			if date, err := time.Parse(layout, text); err == nil {
+				return date.Format("2006-01-02"), nil
+			}
+		}
+		return nil, fmt.Errorf("expected a date as YYYY-MM-DD, got %q", text)
+	case AttributeEnum:
+		for _, option := range def.Options {
+			if strings.EqualFold(option, text) {
+				return option, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not one of %s", text, strings.Join(def.Options, ", "))
+	}
+	return text, nil
+}
@@ -0,0 +1,172 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// CustomerFilter narrows the set of customers returned by listing, export and
+// bulk operations. Zero values mean "no restriction".
+type CustomerFilter struct {
+	GIDs        []string
+	Search      string
+	CountryCode int
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// Tags restricts to customers carrying every listed tag.
+	Tags []string
+	// Attributes restricts to customers whose custom attributes have these
+	// values, compared as text.
+	Attributes map[string]string
+	// Segment is the GID of a saved segment whose expression must match.
+	Segment string
+	// Expression is an ad-hoc segment expression, see Segment.
+	Expression string
+	// Archived selects soft deleted customers, see ArchivedOnly.
+	Archived string
+}
+
+// lastInboundSQL is the time of the latest WhatsApp message received from
+// customer "c". Inbound messages are linked by customer_gid when stored, so
+// only that indexed column is compared.
+const lastInboundSQL = `(SELECT MAX(to_timestamp((w.message_data::jsonb -> 'messages' -> 0 ->> 'timestamp')::bigint))
+	FROM whatsapp_data w WHERE w.customer_gid = c.gid)`
+
+// CustomerExport is one customer as written by ExportCustomers.
+type CustomerExport struct {
+	ID              int                    `json:"id"`
+	GID             string                 `json:"gid"`
+	Name            string                 `json:"name"`
+	PhoneNumber     string                 `json:"phone_number"`
+	NormalizedPhone string                 `json:"normalized_phone"`
+	CountryCode     int                    `json:"country_code"`
+	Email           string                 `json:"email"`
+	Attributes      map[string]interface{} `json:"attributes"`
+	Tags            []string               `json:"tags"`
+	OptInStatus     string                 `json:"opt_in_status"`
+	Language        string                 `json:"language"`
+	Timezone        string                 `json:"timezone"`
+	WaProfileName   string                 `json:"wa_profile_name"`
+	FirstSeenAt     *time.Time             `json:"first_seen_at"`
+	LastSeenAt      *time.Time             `json:"last_seen_at"`
+	CreatedDate     time.Time              `json:"created_date"`
+	LastInboundAt   *time.Time             `json:"last_inbound_at"`
+}
+
+// customerWhere builds the WHERE clause for the filter on the customer table
+// aliased as "c", numbering placeholders after the given arguments.
+func customerWhere(db *sql.DB, f CustomerFilter, args []interface{}) (string, []interface{}, error) {
+	var conditions []string
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if condition := archivedCondition(f.Archived); condition != "" {
+		conditions = append(conditions, condition)
+	}
+
+	if f.GIDs != nil {
+		add("c.gid::text = ANY($%d)", pq.Array(f.GIDs))
+	}
+	if f.Search != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Search) + "%"
+		args = append(args, pattern)
+		n := len(args)
+		conditions = append(conditions, fmt.Sprintf("(c.name ILIKE $%d OR c.phone_number ILIKE $%d OR c.normalized_phone ILIKE $%d OR c.email ILIKE $%d)", n, n, n, n))
+	}
+	if f.CountryCode != 0 {
+		add("c.country_code = $%d", f.CountryCode)
+	}
+	if !f.CreatedFrom.IsZero() {
+		add("c.created_date >= $%d", f.CreatedFrom)
+	}
+	if !f.CreatedTo.IsZero() {
+		add("c.created_date < $%d", f.CreatedTo)
+	}
+	for key, value := range f.Attributes {
+		args = append(args, key, value)
+		conditions = append(conditions, fmt.Sprintf("c.attributes ->> $%d = $%d", len(args)-1, len(args)))
+	}
+	for _, tag := range f.Tags {
+		add("EXISTS (SELECT 1 FROM public.customer_tags ct JOIN public.tags t ON t.id = ct.tag_id WHERE ct.customer_id = c.id AND lower(t.name) = lower($%d))", tag)
+	}
+
+	expressions := []string{}
+	if f.Segment != "" {
+		if _, err := uuid.Parse(f.Segment); err != nil {
+			return "", nil, ErrSegmentNotFound
+		}
+		var expression string
+		err := db.QueryRow("SELECT expression FROM public.segments WHERE gid = $1", f.Segment).Scan(&expression)
+		if err == sql.ErrNoRows {
+			return "", nil, ErrSegmentNotFound
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		expressions = append(expressions, expression)
+	}
+	if f.Expression != "" {
+		expressions = append(expressions, f.Expression)
+	}
+	for _, expression := range expressions {
+		condition, compiledArgs, err := CompileSegment(expression, args)
+		if err != nil {
+			return "", nil, err
+		}
+		args = compiledArgs
+		conditions = append(conditions, condition)
+	}
+
+	if len(conditions) == 0 {
+		return "", args, nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// ExportCustomers streams every customer matching the filter to fn, one row
+// at a time, so large tables are never held in memory.
+func (cu *customerRepo) ExportCustomers(filter CustomerFilter, fn func(*CustomerExport) error) error {
+	where, args, err := customerWhere(cu.db, filter, nil)
+	if err != nil {
+		return err
+	}
+	query := `SELECT c.id, c.gid, c.name, c.phone_number, COALESCE(c.normalized_phone, ''), c.country_code, COALESCE(c.email, ''), c.attributes,
+		ARRAY(SELECT t.name FROM public.customer_tags ct JOIN public.tags t ON t.id = ct.tag_id WHERE ct.customer_id = c.id ORDER BY t.name),
+		c.opt_in_status, c.language, c.timezone, c.wa_profile_name, c.first_seen_at, c.last_seen_at, c.created_date, ` + lastInboundSQL + `
+		FROM public.customer c` + where + " ORDER BY c.id"
+
+	rows, err := cu.db.Query(query, args...)
+	if err != nil {
+		log.Println("Error exporting customers:", err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var customer CustomerExport
+		var attributes []byte
+		err := rows.Scan(&customer.ID, &customer.GID, &customer.Name, &customer.PhoneNumber, &customer.NormalizedPhone,
+			&customer.CountryCode, &customer.Email, &attributes, pq.Array(&customer.Tags), &customer.OptInStatus, &customer.Language, &customer.Timezone,
+			&customer.WaProfileName, &customer.FirstSeenAt, &customer.LastSeenAt, &customer.CreatedDate, &customer.LastInboundAt)
+		if err != nil {
+			log.Println("Error scanning customer row:", err)
+			return err
+		}
+		if err := json.Unmarshal(attributes, &customer.Attributes); err != nil {
+			log.Println("Error decoding customer attributes:", err)
+		}
+		if err := fn(&customer); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,641 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"whatbot/utils"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ImportMode controls how an uploaded contact file is written to the database.
+type ImportMode string
+
+const (
+	// ImportModeDryRun validates the file and returns a preview without writing anything.
+	ImportModeDryRun ImportMode = "dry_run"
+	// ImportModeAtomic writes every row in a single transaction, or nothing at all.
+	ImportModeAtomic ImportMode = "atomic"
+	// ImportModeBestEffort inserts row by row and skips rows that fail.
+	ImportModeBestEffort ImportMode = "best_effort"
+)
+
+// Row statuses reported by an import.
+const (
+	ImportRowNew       = "new"
+	ImportRowDuplicate = "duplicate"
+	ImportRowInvalid   = "invalid"
+)
+
+// DuplicatePolicy decides what happens to rows whose phone number already
+// belongs to a customer.
+type DuplicatePolicy string
+
+const (
+	// DuplicateSkip leaves the existing customer untouched.
+	DuplicateSkip DuplicatePolicy = "skip"
+	// DuplicateUpdate overwrites the existing customer with the uploaded values.
+	DuplicateUpdate DuplicatePolicy = "update"
+	// DuplicateMerge only fills fields that are empty on the existing customer.
+	DuplicateMerge DuplicatePolicy = "merge"
+)
+
+// Row actions reported once an import has been written (or, for a dry run,
+// would be written).
+const (
+	ImportActionCreated = "created"
+	ImportActionUpdated = "updated"
+	ImportActionSkipped = "skipped"
+)
+
+// ImportOptions carries the per-upload settings of a contact import.
+type ImportOptions struct {
+	Mode        ImportMode
+	OnDuplicate DuplicatePolicy
+
+	// Mapping maps contact fields to header names or column indexes. When
+	// empty, columns are detected from the header.
+	Mapping            map[string]string
+	Header             HeaderMode
+	Delimiter          rune
+	Encoding           string
+	DefaultCountryCode int
+	// Tags are added to every created or updated customer, on top of any
+	// tags column in the file.
+	Tags []string
+	// Schema converts unmapped columns to their declared attribute types.
+	Schema AttributeSchema
+	// Consent is recorded for every created or updated customer whose row
+	// has no opt_in column value; empty leaves consent unchanged.
+	Consent string
+
+	// Sheet names the worksheet of an XLSX upload; the first sheet is used
+	// when empty.
+	Sheet string
+
+	// Progress, when set, is called as rows are checked against existing
+	// customers and again as they are written, with the phase. Returning an
+	// error (normally ErrImportCancelled) stops the import.
+	Progress func(phase string, processed, total int) error
+}
+
+// Phases reported to ImportOptions.Progress.
+const (
+	ImportPhaseChecking = "checking"
+	ImportPhaseWriting  = "writing"
+)
+
+// classifyBatchSize is how many rows classifyRows looks up at once.
+const classifyBatchSize = 500
+
+var (
+	// ErrImportRejected is returned by an atomic import that was rolled back.
+	ErrImportRejected = errors.New("import rejected, no rows were written")
+	// ErrImportCancelled is returned when the Progress callback stops an import.
+	ErrImportCancelled = errors.New("import cancelled")
+	// ErrInvalidFile is returned when an uploaded file cannot be read with the
+	// given options.
+	ErrInvalidFile = errors.New("invalid import file")
+)
+
+// ImportRow describes the outcome for a single line of an uploaded file.
+type ImportRow struct {
+	Line    int       `json:"line"`
+	Status  string    `json:"status"`
+	Action  string    `json:"action,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Contact *Contacts `json:"contact,omitempty"`
+}
+
+// ImportReport summarises an import or a dry-run preview.
+type ImportReport struct {
+	Mode        ImportMode      `json:"mode"`
+	OnDuplicate DuplicatePolicy `json:"on_duplicate"`
+	Committed   bool            `json:"committed"`
+	New         int             `json:"new"`
+	Duplicate   int             `json:"duplicate"`
+	Invalid     int             `json:"invalid"`
+	Created     int             `json:"created"`
+	Updated     int             `json:"updated"`
+	Skipped     int             `json:"skipped"`
+	Date        string          `json:"date"`
+	Rows        []ImportRow     `json:"rows"`
+}
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx.
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// ParseImportMode converts a form value into an ImportMode. An empty value
+// selects ImportModeBestEffort, which matches the historical behaviour.
+func ParseImportMode(mode string) (ImportMode, error) {
+	switch ImportMode(strings.ToLower(strings.TrimSpace(mode))) {
+	case "", ImportModeBestEffort:
+		return ImportModeBestEffort, nil
+	case ImportModeDryRun:
+		return ImportModeDryRun, nil
+	case ImportModeAtomic:
+		return ImportModeAtomic, nil
+	}
+	return "", fmt.Errorf("unknown import mode %q", mode)
+}
+
+// ParseDuplicatePolicy converts a form value into a DuplicatePolicy. An empty
+// value selects DuplicateSkip.
+func ParseDuplicatePolicy(policy string) (DuplicatePolicy, error) {
+	switch DuplicatePolicy(strings.ToLower(strings.TrimSpace(policy))) {
+	case "", DuplicateSkip:
+		return DuplicateSkip, nil
+	case DuplicateUpdate:
+		return DuplicateUpdate, nil
+	case DuplicateMerge:
+		return DuplicateMerge, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q", policy)
+}
+
+// ImportContacts parses a contact file of the given format and runs every
+// record through the same validation, normalization and insertion pipeline.
+func (cu *contactImporter) ImportContacts(file io.Reader, format ContactFormat, userID int, requestedIp string, opts ImportOptions) (*ImportReport, error) {
+	var source recordSource
+	var err error
+	switch format {
+	case FormatXLSX:
+		source, err = newXLSXSource(file, opts.Sheet)
+	case FormatVCard:
+		// vCards always produce the synthetic vCardHeader
+		source, err = newVCardSource(file)
+		opts.Header, opts.Mapping = HeaderPresent, nil
+	default:
+		source = newCSVSource(file, opts)
+	}
+	if err != nil {
+		log.Println("Error opening contact file:", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFile, err)
+	}
+
+	first, firstLine, err := source.Read()
+	if err != nil {
+		log.Println("Error reading contact file header:", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFile, err)
+	}
+
+	// Detect the header row unless the uploader told us
+	var header []string
+	switch opts.Header {
+	case HeaderPresent:
+		header = first
+	case HeaderAbsent:
+	default:
+		if looksLikeHeader(first) {
+			header = first
+		}
+	}
+
+	layout, err := resolveLayout(header, len(first), opts.Mapping)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidFile, err)
+	}
+
+	report := &ImportReport{Mode: opts.Mode, OnDuplicate: opts.OnDuplicate}
+	addRow := func(line int, record []string) {
+		row := ImportRow{Line: line, Status: ImportRowNew}
+		row.Contact, err = parseContactRecord(layout, record, opts.DefaultCountryCode, opts.Schema)
+		if err != nil {
+			log.Println("Invalid contact record:", record)
+			row.Status = ImportRowInvalid
+			row.Error = err.Error()
+		} else {
+			row.Contact.TAGS = NormalizeTags(append(row.Contact.TAGS, opts.Tags...))
+			if row.Contact.CONSENT == "" {
+				row.Contact.CONSENT = opts.Consent
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	if header == nil {
+		addRow(firstLine, first)
+	}
+
+	// Read and validate each remaining record
+	for {
+		record, line, err := source.Read()
+		if err == io.EOF {
+			// End of file
+			break
+		}
+		if err != nil {
+			log.Println("Error reading contact record:", err)
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFile, err)
+		}
+		addRow(line, record)
+	}
+
+	if err := cu.fillCountryCodes(report.Rows); err != nil {
+		log.Println("Error resolving country codes:", err)
+		return nil, err
+	}
+
+	progress := opts.Progress
+	if progress == nil {
+		progress = func(string, int, int) error { return nil }
+	}
+	if err := classifyRows(cu.db, report.Rows, progress); err != nil {
+		if err == ErrImportCancelled {
+			return report, err
+		}
+		log.Println("Error checking for duplicate customers:", err)
+		return nil, err
+	}
+	if err := progress(ImportPhaseWriting, 0, len(report.Rows)); err != nil {
+		return report, err
+	}
+
+	switch opts.Mode {
+	case ImportModeDryRun:
+		for i := range report.Rows {
+			report.Rows[i].Action = plannedAction(report.Rows[i], opts.OnDuplicate)
+		}
+		report.count()
+		return report, progress(ImportPhaseWriting, len(report.Rows), len(report.Rows))
+
+	case ImportModeAtomic:
+		report.count()
+		if report.Invalid > 0 {
+			return report, ErrImportRejected
+		}
+
+		tx, err := cu.db.Begin()
+		if err != nil {
+			log.Println("Error starting transaction:", err)
+			return nil, err
+		}
+		if err := writeRows(tx, report.Rows, userID, requestedIp, opts.OnDuplicate, true, progress); err != nil {
+			tx.Rollback()
+			for i := range report.Rows {
+				report.Rows[i].Action = ""
+			}
+			report.count()
+			if err == ErrImportCancelled {
+				return report, err
+			}
+			return report, ErrImportRejected
+		}
+		if err := tx.Commit(); err != nil {
+			log.Println("Error committing transaction:", err)
+			return nil, err
+		}
+
+	default:
+		// Rows written before a cancellation stay in place
+		err := writeRows(cu.db, report.Rows, userID, requestedIp, opts.OnDuplicate, false, progress)
+		report.Committed = true
+		report.count()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	report.Committed = true
+	report.count()
+	return report, nil
+}
+
+// fillCountryCodes sets the country code of contacts that were given as
+// international numbers without one, using the longest matching calling code
+// from public.country_codes.
+func (cu *contactImporter) fillCountryCodes(rows []ImportRow) error {
+	var codes []string
+	for i := range rows {
+		contact := rows[i].Contact
+		if rows[i].Status == ImportRowInvalid || contact.COUNTRY_CODE != 0 {
+			continue
+		}
+		if codes == nil {
+			dbRows, err := cu.db.Query("SELECT DISTINCT country_code::text FROM public.country_codes")
+			if err != nil {
+				return err
+			}
+			for dbRows.Next() {
+				var code string
+				if err := dbRows.Scan(&code); err != nil {
+					dbRows.Close()
+					return err
+				}
+				codes = append(codes, code)
+			}
+			dbRows.Close()
+			if err := dbRows.Err(); err != nil {
+				return err
+			}
+		}
+
+		digits := strings.TrimPrefix(contact.NORMALIZED_PHONE, "+")
+		best := ""
+		for _, code := range codes {
+			if strings.HasPrefix(digits, code) && len(code) > len(best) {
+				best = code
+			}
+		}
+		if best == "" {
+			rows[i].Status = ImportRowInvalid
+			rows[i].Error = "could not determine the country code of " + contact.PHONE_NUMBER
+			continue
+		}
+		contact.COUNTRY_CODE, _ = strconv.Atoi(best)
+	}
+	return nil
+}
+
+// parseContactRecord validates a raw record using the resolved column layout.
+// defaultCountryCode is used when the file has no country code column.
+func parseContactRecord(layout *columnLayout, record []string, defaultCountryCode int, schema AttributeSchema) (*Contacts, error) {
+	countryCode := defaultCountryCode
+	if value := strings.TrimPrefix(layout.cell(record, FieldCountryCode), "+"); value != "" {
+		cc, err := strconv.Atoi(value)
+		if err != nil || cc <= 0 {
+			return nil, fmt.Errorf("invalid country code %q", value)
+		}
+		countryCode = cc
+	}
+
+	phone := layout.cell(record, FieldPhone)
+	if phone == "" {
+		return nil, errors.New("phone number is required")
+	}
+	for _, r := range phone {
+		if (r < '0' || r > '9') && !strings.ContainsRune("+-() ", r) {
+			return nil, fmt.Errorf("invalid phone number %q", phone)
+		}
+	}
+	normalized, err := utils.NormalizePhone(countryCode, phone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid phone number %q: %v", phone, err)
+	}
+
+	email := layout.cell(record, FieldEmail)
+	if email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return nil, fmt.Errorf("invalid email %q", email)
+		}
+	}
+
+	attributes, err := schema.Validate(layout.attributes(record))
+	if err != nil {
+		return nil, err
+	}
+
+	consent, err := ParseConsent(layout.cell(record, FieldOptIn))
+	if err != nil {
+		return nil, err
+	}
+	language, err := ParseLanguage(layout.cell(record, FieldLanguage))
+	if err != nil {
+		return nil, err
+	}
+	timezone, err := ParseTimezone(layout.cell(record, FieldTimezone))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Contacts{
+		COUNTRY_CODE:     countryCode,
+		PHONE_NUMBER:     phone,
+		NORMALIZED_PHONE: normalized,
+		NAME:             layout.cell(record, FieldName),
+		EMAIL:            email,
+		TAGS:             SplitTags(layout.cell(record, FieldTags)),
+		ATTRIBUTES:       attributes,
+		LANGUAGE:         language,
+		TIMEZONE:         timezone,
+		CONSENT:          consent,
+	}, nil
+}
+
+// classifyRows marks every row as new, duplicate or invalid. Duplicates are
+// detected both against the customer table and earlier lines of the file.
+// Rows are looked up in batches, reporting progress after each.
+func classifyRows(db *sql.DB, rows []ImportRow, progress func(string, int, int) error) error {
+	key, err := tombstoneKey()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]int)
+	for start := 0; start < len(rows); start += classifyBatchSize {
+		end := start + classifyBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		// Duplicates within the file first, then one lookup for the rest
+		var batch []*ImportRow
+		var phones, hashes []string
+		for i := start; i < end; i++ {
+			row := &rows[i]
+			if row.Status == ImportRowInvalid {
+				continue
+			}
+			phone := row.Contact.NORMALIZED_PHONE
+			if line, ok := seen[phone]; ok {
+				row.Status = ImportRowDuplicate
+				row.Error = fmt.Sprintf("duplicate of line %d", line)
+				continue
+			}
+			seen[phone] = row.Line
+			batch = append(batch, row)
+			phones = append(phones, phone)
+			hashes = append(hashes, phoneHash(key, phone))
+		}
+
+		if len(batch) > 0 {
+			erased, err := queryStringSet(db, "SELECT phone_hash FROM public.customer_tombstones WHERE phone_hash = ANY($1)", hashes)
+			if err != nil {
+				return err
+			}
+			existing, err := queryStringSet(db, "SELECT normalized_phone FROM public.customer WHERE normalized_phone = ANY($1)", phones)
+			if err != nil {
+				return err
+			}
+			for i, row := range batch {
+				switch {
+				case erased[hashes[i]]:
+					row.Status = ImportRowInvalid
+					row.Error = ErrTombstoned.Error()
+				case existing[phones[i]]:
+					row.Status = ImportRowDuplicate
+				default:
+					row.Status = ImportRowNew
+				}
+			}
+		}
+
+		if err := progress(ImportPhaseChecking, end, len(rows)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryStringSet runs a query selecting one text column with values as $1
+// and returns the values found.
+func queryStringSet(db *sql.DB, query string, values []string) (map[string]bool, error) {
+	rows, err := db.Query(query, pq.Array(values))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		found[value] = true
+	}
+	return found, rows.Err()
+}
+
+// plannedAction returns what writing the row would do under the given policy,
+// without touching the database.
+func plannedAction(row ImportRow, policy DuplicatePolicy) string {
+	switch {
+	case row.Status == ImportRowNew:
+		return ImportActionCreated
+	case row.Status == ImportRowDuplicate && row.Error == "" && policy != DuplicateSkip:
+		return ImportActionUpdated
+	case row.Status == ImportRowDuplicate:
+		return ImportActionSkipped
+	}
+	return ""
+}
+
+// upsertContact writes a contact according to the duplicate policy and
+// reports whether a customer was created, updated or skipped. Opting in a
+// customer who opted out by keyword skips the row with ErrKeywordOptOut.
+func upsertContact(db dbExecutor, contact *Contacts, userID int, requestedIp string, policy DuplicatePolicy) (string, error) {
+	attributes := []byte("{}")
+	if len(contact.ATTRIBUTES) > 0 {
+		var err error
+		if attributes, err = json.Marshal(contact.ATTRIBUTES); err != nil {
+			return "", err
+		}
+	}
+
+	// An opt-in from the file must not reverse a keyword opt-out, so such
+	// rows are left alone
+	if contact.CONSENT == ConsentOptedIn {
+		optedOut, err := optedOutByKeyword(db, "c.normalized_phone = $1", contact.NORMALIZED_PHONE)
+		if err != nil {
+			return "", err
+		}
+		if optedOut {
+			return ImportActionSkipped, ErrKeywordOptOut
+		}
+	}
+
+	// Rows without a language or timezone get the defaults of their country
+	query := "INSERT INTO public.customer (gid, phone_number, name, created_date, country_code, email,uploaded_by,requested_ip,normalized_phone,attributes,language,timezone) VALUES ($1, $2, $3, $4, $5, $6,$7,$8,$9,$10," +
+		"COALESCE(NULLIF($11, ''), " + countryDefaultSQL("default_language", 5) + "), COALESCE(NULLIF($12, ''), " + countryDefaultSQL("default_timezone", 5) + ")) "
+	switch policy {
+	case DuplicateUpdate:
+		query += "ON CONFLICT (normalized_phone) DO UPDATE SET phone_number = EXCLUDED.phone_number, name = EXCLUDED.name, country_code = EXCLUDED.country_code, email = EXCLUDED.email, attributes = customer.attributes || EXCLUDED.attributes, " +
+			"language = CASE WHEN $11 <> '' OR customer.language = '' THEN EXCLUDED.language ELSE customer.language END, timezone = CASE WHEN $12 <> '' OR customer.timezone = '' THEN EXCLUDED.timezone ELSE customer.timezone END "
+	case DuplicateMerge:
+		query += "ON CONFLICT (normalized_phone) DO UPDATE SET name = COALESCE(NULLIF(customer.name, ''), EXCLUDED.name), email = COALESCE(NULLIF(customer.email, ''), EXCLUDED.email), attributes = EXCLUDED.attributes || customer.attributes, " +
+			"language = COALESCE(NULLIF(customer.language, ''), EXCLUDED.language), timezone = COALESCE(NULLIF(customer.timezone, ''), EXCLUDED.timezone) "
+	default:
+		query += "ON CONFLICT (normalized_phone) DO NOTHING "
+	}
+	query += "RETURNING id, (xmax = 0)"
+
+	var customerID int
+	var inserted bool
+	err := db.QueryRow(query, uuid.New(), contact.PHONE_NUMBER, contact.NAME, time.Now(), contact.COUNTRY_CODE, contact.EMAIL, userID, requestedIp, contact.NORMALIZED_PHONE, string(attributes), contact.LANGUAGE, contact.TIMEZONE).Scan(&customerID, &inserted)
+	if err == sql.ErrNoRows {
+		return ImportActionSkipped, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := tagCustomer(db, customerID, contact.TAGS, userID); err != nil {
+		return "", err
+	}
+	if contact.CONSENT != "" {
+		change := ConsentChange{Status: contact.CONSENT, Source: ConsentSourceImport, ChangedBy: userID, RequestedIP: requestedIp}
+		if err := recordConsent(db, customerID, change); err != nil {
+			return "", err
+		}
+	}
+	if inserted {
+		return ImportActionCreated, nil
+	}
+	return ImportActionUpdated, nil
+}
+
+// writeRows upserts every row that plannedAction does not skip. With
+// stopOnError the first failure is returned; otherwise the row is marked
+// invalid and the import carries on. An error from progress always stops.
+func writeRows(db dbExecutor, rows []ImportRow, userID int, requestedIp string, policy DuplicatePolicy, stopOnError bool, progress func(string, int, int) error) error {
+	for i := range rows {
+		row := &rows[i]
+		row.Action = plannedAction(*row, policy)
+		if row.Action != "" && row.Action != ImportActionSkipped {
+			action, err := upsertContact(db, row.Contact, userID, requestedIp, policy)
+			if err == ErrKeywordOptOut {
+				row.Action = action
+				row.Error = err.Error()
+			} else if err != nil {
+				log.Println("Error inserting data into the database:", err)
+				row.Status = ImportRowInvalid
+				row.Action = ""
+				row.Error = err.Error()
+				if stopOnError {
+					return err
+				}
+			} else {
+				row.Action = action
+			}
+		}
+
+		if err := progress(ImportPhaseWriting, i+1, len(rows)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (report *ImportReport) count() {
+	report.New, report.Duplicate, report.Invalid = 0, 0, 0
+	report.Created, report.Updated, report.Skipped = 0, 0, 0
+	for _, row := range report.Rows {
+		switch row.Status {
+		case ImportRowNew:
+			report.New++
+		case ImportRowDuplicate:
+			report.Duplicate++
+		case ImportRowInvalid:
+			report.Invalid++
+		}
+		switch row.Action {
+		case ImportActionCreated:
+			report.Created++
+		case ImportActionUpdated:
+			report.Updated++
+		case ImportActionSkipped:
+			report.Skipped++
+		}
+	}
+	report.Date = time.Now().Format(time.RFC3339)
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"log"
+	"strings"
+	"time"
+	"whatbot/utils"
+
+	"github.com/google/uuid"
+)
+
+// TouchInboundContact creates or refreshes the customer behind an inbound
+// WhatsApp contact. The profile name is stored as wa_profile_name and never
+// overwrites our own name. Numbers erased on request are ignored.
+func (cu *customerRepo) TouchInboundContact(waID, profileName string, seenAt time.Time) (bool, error) {
+	normalized, err := utils.NormalizePhone(0, "+"+strings.TrimPrefix(waID, "+"))
+	if err != nil {
+		return false, err
+	}
+	erased, err := isTombstoned(cu.db, normalized)
+	if err != nil || erased {
+		return false, err
+	}
+
+	digits := strings.TrimPrefix(normalized, "+")
+	var inserted bool
+	err = cu.db.QueryRow(`WITH country AS (
+			SELECT country_code, default_language, default_timezone FROM public.country_codes
+			WHERE $2 LIKE country_code::text || '%' ORDER BY length(country_code::text) DESC, id LIMIT 1
+		)
+		INSERT INTO public.customer (gid, phone_number, name, created_date, country_code, normalized_phone, wa_profile_name, first_seen_at, last_seen_at, language, timezone)
+		VALUES ($1, $2, '', $3, (SELECT country_code FROM country), $4, $5, $6, $6,
+			COALESCE((SELECT default_language FROM country), ''), COALESCE((SELECT default_timezone FROM country), ''))
+		ON CONFLICT (normalized_phone) DO UPDATE SET
+			wa_profile_name = COALESCE(NULLIF(EXCLUDED.wa_profile_name, ''), customer.wa_profile_name),
+			first_seen_at = LEAST(customer.first_seen_at, EXCLUDED.first_seen_at),
+			last_seen_at = GREATEST(customer.last_seen_at, EXCLUDED.last_seen_at)
+		RETURNING (xmax = 0)`,
+		uuid.New(), digits, time.Now(), normalized, strings.TrimSpace(profileName), seenAt).Scan(&inserted)
+	if err != nil {
+		log.Println("Error saving inbound contact:", err)
+		return false, err
+	}
+	return inserted, nil
+}
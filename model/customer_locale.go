@@ -0,0 +1,113 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultTemplateLanguage is used for template sends when neither the
+// request nor the customer has a language.
+const DefaultTemplateLanguage = "en_US"
+
+var languagePattern = regexp.MustCompile(`^([A-Za-z]{2,3})(?:[-_]([A-Za-z]{2}))?$`)
+
+// ParseLanguage normalizes a language code to the form WhatsApp templates use,
+// e.g. "en-us" -> "en_US". Empty values are returned as is.
+func ParseLanguage(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	match := languagePattern.FindStringSubmatch(value)
+	if match == nil {
+		return "", fmt.Errorf("invalid language %q, expected a code such as en or en_US", value)
+	}
+	language := strings.ToLower(match[1])
+	if match[2] != "" {
+		language += "_" + strings.ToUpper(match[2])
+	}
+	return language, nil
+}
+
+// ParseTimezone checks an IANA timezone name such as "Asia/Kolkata". Empty
+// values are returned as is.
+func ParseTimezone(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if _, err := time.LoadLocation(value); err != nil || strings.EqualFold(value, "local") {
+		return "", fmt.Errorf("invalid timezone %q, expected a name such as Asia/Kolkata", value)
+	}
+	return value, nil
+}
+
+// countryDefaultSQL selects the default_language or default_timezone of the
+// country code bound to placeholder n, or ” when it has none.
+func countryDefaultSQL(column string, n int) string {
+	return fmt.Sprintf("COALESCE((SELECT cc.%[1]s FROM public.country_codes cc WHERE cc.country_code = $%[2]d AND cc.%[1]s IS NOT NULL ORDER BY cc.id LIMIT 1), '')", column, n)
+}
+
+// QuietHours is a daily window, in the recipient's local time, during which
+// messages are held back. Start and End are "HH:MM"; the window may cross
+// midnight. A zero value never matches.
+type QuietHours struct {
+	Start string
+	End   string
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether now falls inside the window in the given timezone,
+// falling back to fallbackTimezone and then UTC. It also returns the local
+// time at which the window ends.
+func (q QuietHours) Contains(now time.Time, timezone, fallbackTimezone string) (bool, time.Time, error) {
+	if q.Start == "" || q.End == "" {
+		return false, time.Time{}, nil
+	}
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	end, err := parseClock(q.End)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	location := time.UTC
+	for _, name := range []string{timezone, fallbackTimezone} {
+		if name == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			location = loc
+			break
+		}
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	var inside bool
+	if start <= end {
+		inside = minute >= start && minute < end
+	} else {
+		inside = minute >= start || minute < end
+	}
+	if !inside {
+		return false, time.Time{}, nil
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, location)
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return true, until, nil
+}
@@ -0,0 +1,387 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"whatbot/utils"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Ways the duplicate finder can match customers.
+const (
+	MatchPhone = "phone"
+	MatchEmail = "email"
+	MatchName  = "name"
+)
+
+// nameSimilarity is the minimum similarity, between 0 and 1, for two
+// customer names to count as the same person.
+const nameSimilarity = 0.85
+
+// maxNameBucket caps the customers compared pairwise for fuzzy names; larger
+// buckets only match on identical names.
+const maxNameBucket = 2000
+
+// ErrInvalidMerge is returned for merge requests that name unknown customers
+// or list the survivor among the customers to merge.
+var ErrInvalidMerge = errors.New("invalid merge request")
+
+// ErrUnknownMatch is returned by FindDuplicates for an unsupported match.
+var ErrUnknownMatch = errors.New("unknown duplicate match")
+
+// DuplicateCandidate is a customer that belongs to a duplicate group.
+type DuplicateCandidate struct {
+	GID             string    `json:"gid"`
+	Name            string    `json:"name"`
+	PhoneNumber     string    `json:"phone_number"`
+	NormalizedPhone string    `json:"normalized_phone"`
+	CountryCode     int       `json:"country_code"`
+	Email           string    `json:"email"`
+	CreatedDate     time.Time `json:"created_date"`
+}
+
+// DuplicateGroup is a set of customers that look like the same person.
+type DuplicateGroup struct {
+	Match     string               `json:"match"`
+	Key       string               `json:"key"`
+	Customers []DuplicateCandidate `json:"customers"`
+}
+
+type CustomerMergeRepository interface {
+	// FindDuplicates groups customers by the given matches (MatchPhone,
+	// MatchEmail, MatchName), returning at most limit groups.
+	FindDuplicates(matches []string, limit int) ([]DuplicateGroup, error)
+	// MergeCustomers folds the merged customers into the survivor and
+	// deletes them. Fields empty on the survivor are filled from the merged
+	// records; messages, tags and consent history move to the survivor.
+	MergeCustomers(survivorGID string, mergedGIDs []string, userID int, requestedIp string) (*Customer, error)
+}
+
+type customerMergeRepo struct {
+	db *sql.DB
+}
+
+func NewCustomerMergeRepository(db *sql.DB) CustomerMergeRepository {
+	return &customerMergeRepo{db: db}
+}
+
+func (mr *customerMergeRepo) FindDuplicates(matches []string, limit int) ([]DuplicateGroup, error) {
+	rows, err := mr.db.Query("SELECT gid, name, phone_number, COALESCE(normalized_phone, ''), COALESCE(country_code, 0), COALESCE(email, ''), created_date FROM public.customer WHERE deleted_at IS NULL ORDER BY id")
+	if err != nil {
+		log.Println("Error retrieving customers for duplicate check:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []DuplicateCandidate
+	for rows.Next() {
+		var c DuplicateCandidate
+		if err := rows.Scan(&c.GID, &c.Name, &c.PhoneNumber, &c.NormalizedPhone, &c.CountryCode, &c.Email, &c.CreatedDate); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var groups []DuplicateGroup
+	for _, match := range matches {
+		switch match {
+		case MatchPhone:
+			groups = append(groups, groupBy(candidates, MatchPhone, func(c DuplicateCandidate) string {
+				if c.NormalizedPhone != "" {
+					return c.NormalizedPhone
+				}
+				// Older duplicates were left without a normalized phone
+				normalized, _ := utils.NormalizePhone(c.CountryCode, c.PhoneNumber)
+				return normalized
+			})...)
+		case MatchEmail:
+			groups = append(groups, groupBy(candidates, MatchEmail, func(c DuplicateCandidate) string {
+				return strings.ToLower(strings.TrimSpace(c.Email))
+			})...)
+		case MatchName:
+			groups = append(groups, groupByName(candidates)...)
+		default:
+			return nil, fmt.Errorf("%w %q, use phone, email or name", ErrUnknownMatch, match)
+		}
+		if limit > 0 && len(groups) >= limit {
+			return groups[:limit], nil
+		}
+	}
+	return groups, nil
+}
+
+// groupBy returns the groups of two or more candidates sharing a non-empty key.
+func groupBy(candidates []DuplicateCandidate, match string, key func(DuplicateCandidate) string) []DuplicateGroup {
+	byKey := make(map[string][]DuplicateCandidate)
+	var keys []string
+	for _, c := range candidates {
+		k := key(c)
+		if k == "" {
+			continue
+		}
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], c)
+	}
+
+	var groups []DuplicateGroup
+	for _, k := range keys {
+		if len(byKey[k]) > 1 {
+			groups = append(groups, DuplicateGroup{Match: match, Key: k, Customers: byKey[k]})
+		}
+	}
+	return groups
+}
+
+// normalizeName lower-cases a name, drops punctuation and sorts its words so
+// that "Krishnan, Hari" and "hari krishnan" compare equal.
+func normalizeName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// groupByName joins customers with identical or similar normalized names.
+// Only names starting with the same letter are compared.
+func groupByName(candidates []DuplicateCandidate) []DuplicateGroup {
+	parent := make([]int, len(candidates))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) {
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[rb] = ra
+		}
+	}
+
+	names := make([]string, len(candidates))
+	buckets := make(map[rune][]int)
+	exact := make(map[string]int)
+	for i, c := range candidates {
+		names[i] = normalizeName(c.Name)
+		if len([]rune(names[i])) < 3 {
+			continue
+		}
+		if first, ok := exact[names[i]]; ok {
+			union(first, i)
+			continue
+		}
+		exact[names[i]] = i
+		initial := []rune(names[i])[0]
+		buckets[initial] = append(buckets[initial], i)
+	}
+
+	for _, bucket := range buckets {
+		if len(bucket) > maxNameBucket {
+			continue
+		}
+		for x := 0; x < len(bucket); x++ {
+			for y := x + 1; y < len(bucket); y++ {
+				if similarity(names[bucket[x]], names[bucket[y]]) >= nameSimilarity {
+					union(bucket[x], bucket[y])
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]DuplicateCandidate)
+	var roots []int
+	for i := range candidates {
+		if len([]rune(names[i])) < 3 {
+			continue
+		}
+		root := find(i)
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], candidates[i])
+	}
+
+	var groups []DuplicateGroup
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			groups = append(groups, DuplicateGroup{Match: MatchName, Key: names[root], Customers: members[root]})
+		}
+	}
+	return groups
+}
+
+// similarity is 1 minus the Levenshtein distance divided by the longer length.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return 1 - float64(previous[len(rb)])/float64(longest)
+}
+
+func (mr *customerMergeRepo) MergeCustomers(survivorGID string, mergedGIDs []string, userID int, requestedIp string) (*Customer, error) {
+	if _, err := uuid.Parse(survivorGID); err != nil {
+		return nil, fmt.Errorf("%w: unknown survivor %q", ErrInvalidMerge, survivorGID)
+	}
+	if len(mergedGIDs) == 0 {
+		return nil, fmt.Errorf("%w: no customers to merge", ErrInvalidMerge)
+	}
+	seen := map[string]bool{survivorGID: true}
+	for _, gid := range mergedGIDs {
+		if _, err := uuid.Parse(gid); err != nil {
+			return nil, fmt.Errorf("%w: unknown customer %q", ErrInvalidMerge, gid)
+		}
+		if seen[gid] {
+			return nil, fmt.Errorf("%w: customer %s is listed twice or is the survivor", ErrInvalidMerge, gid)
+		}
+		seen[gid] = true
+	}
+
+	tx, err := mr.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	type mergeRow struct {
+		id          int
+		gid         string
+		phone       string
+		normalized  sql.NullString
+		countryCode int
+	}
+	rows, err := tx.Query("SELECT id, gid, phone_number, normalized_phone, COALESCE(country_code, 0) FROM public.customer WHERE gid::text = ANY($1) ORDER BY id FOR UPDATE",
+		pq.Array(append([]string{survivorGID}, mergedGIDs...)))
+	if err != nil {
+		return nil, err
+	}
+	var survivor *mergeRow
+	var merged []*mergeRow
+	for rows.Next() {
+		row := &mergeRow{}
+		if err := rows.Scan(&row.id, &row.gid, &row.phone, &row.normalized, &row.countryCode); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if row.gid == survivorGID {
+			survivor = row
+		} else {
+			merged = append(merged, row)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if survivor == nil || len(merged) != len(mergedGIDs) {
+		return nil, fmt.Errorf("%w: one or more customers were not found", ErrInvalidMerge)
+	}
+
+	phone := survivor.normalized
+	for _, m := range merged {
+		// Messages from numbers that were never normalized are matched by
+		// the number the customer would normalize to
+		senderPhone := m.normalized.String
+		if senderPhone == "" {
+			senderPhone, _ = utils.NormalizePhone(m.countryCode, m.phone)
+		}
+
+		statements := []struct {
+			query string
+			args  []interface{}
+		}{
+			{`INSERT INTO public.customer_merge_audit (survivor_gid, merged_gid, merged_data, merged_by, requested_ip, created_date)
+				SELECT $1, c.gid, to_jsonb(c) || jsonb_build_object('tags', ARRAY(SELECT t.name FROM public.customer_tags ct JOIN public.tags t ON t.id = ct.tag_id WHERE ct.customer_id = c.id)), $2, $3, $4
+				FROM public.customer c WHERE c.id = $5`,
+				[]interface{}{survivor.gid, userID, requestedIp, time.Now(), m.id}},
+			{`UPDATE public.customer s SET
+				name = COALESCE(NULLIF(s.name, ''), m.name),
+				email = COALESCE(NULLIF(s.email, ''), m.email),
+				language = COALESCE(NULLIF(s.language, ''), m.language),
+				timezone = COALESCE(NULLIF(s.timezone, ''), m.timezone),
+				country_code = COALESCE(s.country_code, m.country_code),
+				attributes = m.attributes || s.attributes,
+				opt_in_status = CASE WHEN m.opt_in_status = 'opted_out' THEN 'opted_out' WHEN s.opt_in_status = 'unknown' THEN m.opt_in_status ELSE s.opt_in_status END,
+				opt_in_updated_at = GREATEST(s.opt_in_updated_at, m.opt_in_updated_at)
+				FROM public.customer m WHERE s.id = $1 AND m.id = $2`,
+				[]interface{}{survivor.id, m.id}},
+			{`INSERT INTO public.customer_tags (customer_id, tag_id, created_by, created_date)
+				SELECT $1, tag_id, created_by, created_date FROM public.customer_tags WHERE customer_id = $2
+				ON CONFLICT DO NOTHING`,
+				[]interface{}{survivor.id, m.id}},
+			{"UPDATE public.customer_consent_history SET customer_id = $1 WHERE customer_id = $2",
+				[]interface{}{survivor.id, m.id}},
+			{"UPDATE whatsapp_data SET customer_gid = $1 WHERE customer_gid = $2 OR (customer_gid IS NULL AND '+' || sender_phone_number = $3)",
+				[]interface{}{survivor.gid, m.gid, senderPhone}},
+			{"UPDATE public.outbound_messages SET customer_gid = $1 WHERE customer_gid = $2 OR (customer_gid IS NULL AND recipient_phone = $3)",
+				[]interface{}{survivor.gid, m.gid, senderPhone}},
+			{"DELETE FROM public.customer WHERE id = $1",
+				[]interface{}{m.id}},
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+				log.Println("Error merging customer:", err)
+				return nil, err
+			}
+		}
+
+		if !phone.Valid && m.normalized.Valid {
+			phone = m.normalized
+		}
+	}
+
+	// The survivor takes over a normalized phone only once the merged
+	// customer holding it is gone
+	if !survivor.normalized.Valid && phone.Valid {
+		if _, err := tx.Exec("UPDATE public.customer SET normalized_phone = $1 WHERE id = $2", phone.String, survivor.id); err != nil {
+			return nil, err
+		}
+	}
+
+	customer, err := scanCustomer(tx.QueryRow("SELECT "+customerColumns+" FROM public.customer c WHERE c.id = $1", survivor.id))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return customer, nil
+}
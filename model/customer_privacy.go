@@ -0,0 +1,435 @@
+package model
+
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// How EraseCustomer removes a customer.
+const (
+	// ErasureDelete deletes the customer and every message tied to it.
+	ErasureDelete = "erase"
+	// ErasurePseudonymize keeps the records for reporting but replaces every
+	// personal value with a pseudonym or "[redacted]".
+	ErasurePseudonymize = "pseudonymize"
+)
+
+const redacted = "[redacted]"
+
+var (
+	// ErrTombstoned is returned when a phone number belongs to an erased customer.
+	ErrTombstoned = errors.New("this phone number was erased on request and cannot be added again")
+	// ErrNoTombstoneSecret is returned when config.json has no Tombstone-Secret.
+	ErrNoTombstoneSecret = errors.New("Tombstone-Secret is not set")
+)
+
+// scrubKeepKeys are JSON keys whose values are kept when a JSON object
+// mentioning the customer is redacted.
+var scrubKeepKeys = map[string]bool{"id": true, "timestamp": true, "type": true, "status": true, "line": true, "action": true}
+
+type PrivacyRepository interface {
+	// ExportCustomerData writes everything stored about a customer as a zip
+	// archive of JSON files to the writer returned by open, which is only
+	// called once the customer has been found.
+	ExportCustomerData(gid string, open func() io.Writer) error
+	// EraseCustomer removes or pseudonymizes a customer in every table that
+	// refers to it and leaves a tombstone for its phone number.
+	EraseCustomer(gid, mode, reason string, userID int, requestedIp string) error
+	IsTombstoned(normalizedPhone string) (bool, error)
+}
+
+type privacyRepo struct {
+	db *sql.DB
+}
+
+func NewPrivacyRepository(db *sql.DB) PrivacyRepository {
+	return &privacyRepo{db: db}
+}
+
+// tombstoneSecret is set once at startup by SetTombstoneSecret.
+var tombstoneSecret []byte
+
+// SetTombstoneSecret sets the key of tombstone hashes. It must be called
+// before the server starts.
+func SetTombstoneSecret(secret string) {
+	tombstoneSecret = []byte(secret)
+}
+
+// tombstoneKey returns the key set by SetTombstoneSecret.
+func tombstoneKey() ([]byte, error) {
+	if len(tombstoneSecret) == 0 {
+		return nil, ErrNoTombstoneSecret
+	}
+	return tombstoneSecret, nil
+}
+
+// phoneHash is the value stored in customer_tombstones for a normalized
+// phone: an HMAC-SHA256 under the tombstone key.
+func phoneHash(key []byte, normalizedPhone string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(normalizedPhone))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isTombstoned(db dbExecutor, normalizedPhone string) (bool, error) {
+	key, err := tombstoneKey()
+	if err != nil {
+		return false, err
+	}
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM public.customer_tombstones WHERE phone_hash = $1)", phoneHash(key, normalizedPhone)).Scan(&exists)
+	return exists, err
+}
+
+func (pr *privacyRepo) IsTombstoned(normalizedPhone string) (bool, error) {
+	return isTombstoned(pr.db, normalizedPhone)
+}
+
+type privacySubject struct {
+	id         int
+	gid        string
+	phone      string
+	normalized string
+	email      string
+}
+
+// needles are the strings that identify the customer inside JSON blobs.
+func (s *privacySubject) needles() []string {
+	var needles []string
+	for _, value := range []string{s.normalized, strings.TrimPrefix(s.normalized, "+"), s.phone, s.email} {
+		if len(strings.TrimSpace(value)) >= 5 {
+			needles = append(needles, strings.TrimSpace(value))
+		}
+	}
+	return needles
+}
+
+func loadSubject(db dbExecutor, gid string) (*privacySubject, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return nil, sql.ErrNoRows
+	}
+	s := &privacySubject{}
+	err := db.QueryRow("SELECT id, gid, phone_number, COALESCE(normalized_phone, ''), COALESCE(email, '') FROM public.customer WHERE gid = $1", gid).
+		Scan(&s.id, &s.gid, &s.phone, &s.normalized, &s.email)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// rawJSON returns data as a JSON value, quoting it when it is not valid JSON.
+func rawJSON(data []byte) json.RawMessage {
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	quoted, _ := json.Marshal(string(data))
+	return quoted
+}
+
+// queryJSON runs a query whose single column is a JSON document per row.
+func queryJSON(db *sql.DB, query string, args ...interface{}) ([]json.RawMessage, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := []json.RawMessage{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		documents = append(documents, rawJSON(data))
+	}
+	return documents, rows.Err()
+}
+
+// mediaTypes are the inbound message types that carry an attachment.
+var mediaTypes = []string{"image", "audio", "video", "document", "sticker"}
+
+// exportReadme explains the archive, in particular that media files are not
+// part of it.
+const exportReadme = `This archive holds everything WhatBot stores about the customer.
+
+profile.json            the customer record, attributes and tags
+consent_history.json    every opt-in and opt-out
+inbound_messages.json   messages received from the customer
+media.json              attachments of those messages
+outbound_messages.json  messages sent to the customer
+merges.json             customers merged into this one
+
+WhatBot does not download or keep media files. media.json lists each
+attachment by its WhatsApp media id, type, file name, caption and checksum;
+the files themselves are held by WhatsApp and expire there.
+`
+
+func (pr *privacyRepo) ExportCustomerData(gid string, open func() io.Writer) error {
+	subject, err := loadSubject(pr.db, gid)
+	if err != nil {
+		return err
+	}
+	phone := strings.TrimPrefix(subject.normalized, "+")
+
+	files := []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{"profile.json", `SELECT to_jsonb(c) || jsonb_build_object('tags', ARRAY(SELECT t.name FROM public.customer_tags ct JOIN public.tags t ON t.id = ct.tag_id WHERE ct.customer_id = c.id ORDER BY t.name))
+			FROM public.customer c WHERE c.id = $1`, []interface{}{subject.id}},
+		{"consent_history.json", "SELECT to_jsonb(h) - 'customer_id' FROM public.customer_consent_history h WHERE h.customer_id = $1 ORDER BY h.created_date, h.id", []interface{}{subject.id}},
+		{"inbound_messages.json", "SELECT jsonb_build_object('gid', w.gid, 'phone_number_id', w.phone_number_id, 'sender_phone_number', w.sender_phone_number, 'message_data', w.message_data::jsonb) FROM whatsapp_data w WHERE w.customer_gid = $1 OR w.sender_phone_number = $2", []interface{}{subject.gid, phone}},
+		{"media.json", `SELECT jsonb_build_object('message_gid', w.gid, 'message_id', m ->> 'id', 'timestamp', m ->> 'timestamp', 'type', m ->> 'type',
+				'media_id', m -> (m ->> 'type') ->> 'id', 'mime_type', m -> (m ->> 'type') ->> 'mime_type', 'sha256', m -> (m ->> 'type') ->> 'sha256',
+				'filename', m -> (m ->> 'type') ->> 'filename', 'caption', m -> (m ->> 'type') ->> 'caption')
+			FROM whatsapp_data w CROSS JOIN LATERAL jsonb_array_elements(CASE WHEN jsonb_typeof(w.message_data::jsonb -> 'messages') = 'array'
+				THEN w.message_data::jsonb -> 'messages' ELSE '[]'::jsonb END) m
+			WHERE (w.customer_gid = $1 OR w.sender_phone_number = $2) AND m ->> 'type' = ANY($3)`, []interface{}{subject.gid, phone, pq.Array(mediaTypes)}},
+		{"outbound_messages.json", "SELECT to_jsonb(o) FROM public.outbound_messages o WHERE o.customer_gid = $1 OR o.recipient_phone = $2 ORDER BY o.created_date", []interface{}{subject.gid, subject.normalized}},
+		{"merges.json", "SELECT to_jsonb(m) FROM public.customer_merge_audit m WHERE m.survivor_gid = $1 ORDER BY m.created_date", []interface{}{subject.gid}},
+	}
+
+	archive := zip.NewWriter(open())
+	readme, err := archive.CreateHeader(&zip.FileHeader{Name: "README.txt", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(readme, exportReadme); err != nil {
+		return err
+	}
+	for _, file := range files {
+		documents, err := queryJSON(pr.db, file.query, file.args...)
+		if err != nil {
+			log.Println("Error exporting customer data:", err)
+			return err
+		}
+		var content interface{} = documents
+		if file.name == "profile.json" && len(documents) == 1 {
+			content = documents[0]
+		}
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return err
+		}
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func (pr *privacyRepo) EraseCustomer(gid, mode, reason string, userID int, requestedIp string) error {
+	if mode != ErasureDelete && mode != ErasurePseudonymize {
+		return fmt.Errorf("unknown erasure mode %q, use %s or %s", mode, ErasureDelete, ErasurePseudonymize)
+	}
+
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	subject, err := loadSubject(tx, gid)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("SELECT 1 FROM public.customer WHERE id = $1 FOR UPDATE", subject.id); err != nil {
+		return err
+	}
+	key, err := tombstoneKey()
+	if err != nil {
+		return err
+	}
+	needles := subject.needles()
+	phone := strings.TrimPrefix(subject.normalized, "+")
+	hash := phoneHash(key, subject.normalized)
+	// Pseudonyms fit the 16 character phone columns
+	pseudonym := "x" + phoneHash(key, subject.gid)[:12]
+
+	if subject.normalized != "" {
+		_, err = tx.Exec("INSERT INTO public.customer_tombstones (phone_hash, erased_gid, mode, reason, erased_by, requested_ip, created_date) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (phone_hash) DO NOTHING",
+			hash, subject.gid, mode, reason, userID, requestedIp, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Inbound messages
+	if mode == ErasureDelete {
+		_, err = tx.Exec("DELETE FROM whatsapp_data WHERE customer_gid = $1 OR sender_phone_number = $2", subject.gid, phone)
+	} else {
+		err = scrubRows(tx, "SELECT gid, message_data FROM whatsapp_data WHERE customer_gid = $1 OR sender_phone_number = $2", []interface{}{subject.gid, phone},
+			"UPDATE whatsapp_data SET message_data = $1 WHERE gid = $2", pseudonym, needles)
+		if err == nil {
+			_, err = tx.Exec("UPDATE whatsapp_data SET sender_phone_number = $1, customer_gid = $2 WHERE customer_gid = $2 OR sender_phone_number = $3", pseudonym, subject.gid, phone)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Outbound messages
+	if mode == ErasureDelete {
+		_, err = tx.Exec("DELETE FROM public.outbound_messages WHERE customer_gid = $1 OR recipient_phone = $2", subject.gid, subject.normalized)
+	} else {
+		_, err = tx.Exec("UPDATE public.outbound_messages SET recipient_phone = $1, parameters = '[]' WHERE customer_gid = $2 OR recipient_phone = $3", pseudonym, subject.gid, subject.normalized)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Merge snapshots of customers folded into this one
+	if _, err := tx.Exec("UPDATE public.customer_merge_audit SET merged_data = '{}' WHERE survivor_gid = $1 OR merged_gid = $1", subject.gid); err != nil {
+		return err
+	}
+
+	// Import reports keep the uploaded rows
+	for _, column := range []string{"report", "errors"} {
+		query := fmt.Sprintf("SELECT gid, %s FROM public.import_jobs WHERE %s::text LIKE ANY($1)", column, column)
+		var patterns []string
+		for _, needle := range needles {
+			patterns = append(patterns, "%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(needle)+"%")
+		}
+		update := fmt.Sprintf("UPDATE public.import_jobs SET %s = $1 WHERE gid = $2", column)
+		if err := scrubRows(tx, query, []interface{}{pq.Array(patterns)}, update, pseudonym, needles); err != nil {
+			return err
+		}
+	}
+
+	if mode == ErasureDelete {
+		_, err = tx.Exec("DELETE FROM public.customer WHERE id = $1", subject.id)
+	} else {
+		_, err = tx.Exec(`UPDATE public.customer SET name = '', email = NULL, phone_number = $1, normalized_phone = NULL,
+			attributes = '{}', requested_ip = '', wa_profile_name = '' WHERE id = $2`, pseudonym, subject.id)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM public.customer_consent_history WHERE customer_id = $1", subject.id)
+		}
+	}
+	if err != nil {
+		log.Println("Error erasing customer:", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// scrubRows loads (gid, json) rows, redacts the customer in each document and
+// writes changed documents back with update ($1 document, $2 gid).
+func scrubRows(tx *sql.Tx, query string, args []interface{}, update, pseudonym string, needles []string) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	type scrubbed struct {
+		gid  string
+		data []byte
+	}
+	var changed []scrubbed
+	for rows.Next() {
+		var gid string
+		var data []byte
+		if err := rows.Scan(&gid, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		var document interface{}
+		if data == nil || json.Unmarshal(data, &document) != nil {
+			continue
+		}
+		if scrubJSON(document, needles, pseudonym) {
+			data, err := json.Marshal(document)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			changed = append(changed, scrubbed{gid, data})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range changed {
+		if _, err := tx.Exec(update, string(row.data), row.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubJSON redacts, in place, every JSON object that mentions one of the
+// needles: values containing a needle become the pseudonym, other strings
+// become "[redacted]" and nested values are dropped. Keys in scrubKeepKeys
+// are left alone. It reports whether anything changed.
+func scrubJSON(value interface{}, needles []string, pseudonym string) bool {
+	mentions := func(text string) bool {
+		for _, needle := range needles {
+			if strings.Contains(text, needle) {
+				return true
+			}
+		}
+		return false
+	}
+
+	changed := false
+	switch v := value.(type) {
+	case []interface{}:
+		for i, item := range v {
+			if text, ok := item.(string); ok && mentions(text) {
+				v[i] = pseudonym
+				changed = true
+			} else if scrubJSON(item, needles, pseudonym) {
+				changed = true
+			}
+		}
+	case map[string]interface{}:
+		matched := false
+		for _, item := range v {
+			if text, ok := item.(string); ok && mentions(text) {
+				matched = true
+				break
+			}
+		}
+		for key, item := range v {
+			if !matched {
+				if scrubJSON(item, needles, pseudonym) {
+					changed = true
+				}
+				continue
+			}
+			if scrubKeepKeys[strings.ToLower(key)] {
+				continue
+			}
+			switch item := item.(type) {
+			case string:
+				if mentions(item) {
+					v[key] = pseudonym
+				} else if item != "" {
+					v[key] = redacted
+				}
+			case map[string]interface{}, []interface{}:
+				v[key] = nil
+			}
+		}
+		changed = changed || matched
+	}
+	return changed
+}
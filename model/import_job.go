@@ -0,0 +1,198 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Import job statuses.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// maxJobErrors caps the number of row errors kept on a job, and
+// maxPreviewRows the rows kept on the report of a dry run.
+const (
+	maxJobErrors   = 1000
+	maxPreviewRows = 10000
+)
+
+// ImportJob tracks a contact import that runs in the background.
+type ImportJob struct {
+	ID              int             `json:"id"`
+	GID             string          `json:"gid"`
+	Status          string          `json:"status"`
+	Phase           string          `json:"phase"`
+	Format          ContactFormat   `json:"format"`
+	Mode            ImportMode      `json:"mode"`
+	OnDuplicate     DuplicatePolicy `json:"on_duplicate"`
+	FileName        string          `json:"file_name"`
+	TotalRows       int             `json:"total_rows"`
+	ProcessedRows   int             `json:"processed_rows"`
+	Created         int             `json:"created"`
+	Updated         int             `json:"updated"`
+	Skipped         int             `json:"skipped"`
+	Invalid         int             `json:"invalid"`
+	Errors          json.RawMessage `json:"errors"`
+	Report          json.RawMessage `json:"report,omitempty"`
+	ErrorMessage    string          `json:"error_message,omitempty"`
+	CancelRequested bool            `json:"cancel_requested"`
+	CreatedBy       int             `json:"created_by"`
+	RequestedIP     string          `json:"-"`
+	CreatedDate     time.Time       `json:"created_date"`
+	StartedAt       *time.Time      `json:"started_at,omitempty"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+}
+
+// ImportJobRepository stores import jobs. A finished job keeps the counts
+// of its report and the failed rows only, or for a dry run the status and
+// planned action of every row.
+type ImportJobRepository interface {
+	CreateJob(job *ImportJob) error
+	GetJob(gid string) (*ImportJob, error)
+	StartJob(gid string) error
+	// UpdateProgress records progress within the phase (ImportPhaseChecking
+	// or ImportPhaseWriting) and reports whether cancellation has been
+	// requested.
+	UpdateProgress(gid, phase string, processed, total int) (bool, error)
+	FinishJob(gid, status string, report *ImportReport, message string) error
+	// RequestCancel flags a queued or running job. It returns false when the
+	// job has already finished.
+	RequestCancel(gid string) (bool, error)
+	// FailInterruptedJobs marks jobs left running by a previous process as failed.
+	FailInterruptedJobs() error
+}
+
+type importJobRepo struct {
+	db *sql.DB
+}
+
+func NewImportJobRepository(db *sql.DB) ImportJobRepository {
+	return &importJobRepo{db: db}
+}
+
+const importJobColumns = "id, gid, status, phase, format, mode, on_duplicate, file_name, total_rows, processed_rows, created_count, updated_count, skipped_count, invalid_count, errors, report, error_message, cancel_requested, created_by, requested_ip, created_date, started_at, finished_at"
+
+func (jr *importJobRepo) CreateJob(job *ImportJob) error {
+	job.GID = uuid.New().String()
+	job.Status = JobQueued
+	job.CreatedDate = time.Now()
+	job.Errors = json.RawMessage("[]")
+	err := jr.db.QueryRow("INSERT INTO public.import_jobs (gid, status, format, mode, on_duplicate, file_name, created_by, requested_ip, created_date) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		job.GID, job.Status, job.Format, job.Mode, job.OnDuplicate, job.FileName, job.CreatedBy, job.RequestedIP, job.CreatedDate).Scan(&job.ID)
+	if err != nil {
+		log.Println("Error creating import job:", err)
+		return err
+	}
+	return nil
+}
+
+func (jr *importJobRepo) GetJob(gid string) (*ImportJob, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return nil, sql.ErrNoRows
+	}
+	job := &ImportJob{}
+	var rowErrors, report []byte
+	var startedAt, finishedAt sql.NullTime
+	err := jr.db.QueryRow("SELECT "+importJobColumns+" FROM public.import_jobs WHERE gid = $1", gid).Scan(
+		&job.ID, &job.GID, &job.Status, &job.Phase, &job.Format, &job.Mode, &job.OnDuplicate, &job.FileName,
+		&job.TotalRows, &job.ProcessedRows, &job.Created, &job.Updated, &job.Skipped, &job.Invalid,
+		&rowErrors, &report, &job.ErrorMessage, &job.CancelRequested, &job.CreatedBy, &job.RequestedIP,
+		&job.CreatedDate, &startedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	job.Errors = rowErrors
+	if report != nil {
+		job.Report = report
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, nil
+}
+
+func (jr *importJobRepo) StartJob(gid string) error {
+	_, err := jr.db.Exec("UPDATE public.import_jobs SET status = $1, started_at = $2 WHERE gid = $3 AND status = $4",
+		JobRunning, time.Now(), gid, JobQueued)
+	return err
+}
+
+func (jr *importJobRepo) UpdateProgress(gid, phase string, processed, total int) (bool, error) {
+	var cancelRequested bool
+	err := jr.db.QueryRow("UPDATE public.import_jobs SET phase = $1, processed_rows = $2, total_rows = $3 WHERE gid = $4 RETURNING cancel_requested",
+		phase, processed, total, gid).Scan(&cancelRequested)
+	return cancelRequested, err
+}
+
+func (jr *importJobRepo) FinishJob(gid, status string, report *ImportReport, message string) error {
+	var reportJSON interface{}
+	errorsJSON := []byte("[]")
+	var created, updated, skipped, invalid int
+	if report != nil {
+		// Only the counts and the failed rows are kept, or every row of a
+		// dry run for its preview; the contacts of the upload are not
+		// copied onto the job
+		rowErrors, rows := []ImportRow{}, []ImportRow{}
+		for _, row := range report.Rows {
+			kept := ImportRow{Line: row.Line, Status: row.Status, Action: row.Action, Error: row.Error}
+			if row.Error != "" && len(rowErrors) < maxJobErrors {
+				rowErrors = append(rowErrors, kept)
+			}
+			if report.Mode == ImportModeDryRun && len(rows) < maxPreviewRows {
+				rows = append(rows, kept)
+			}
+		}
+		if report.Mode != ImportModeDryRun {
+			rows = rowErrors
+		}
+		summary := *report
+		summary.Rows = rows
+		data, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		reportJSON = string(data)
+		if errorsJSON, err = json.Marshal(rowErrors); err != nil {
+			return err
+		}
+		created, updated, skipped, invalid = report.Created, report.Updated, report.Skipped, report.Invalid
+	}
+
+	_, err := jr.db.Exec("UPDATE public.import_jobs SET status = $1, report = $2, errors = $3, error_message = $4, created_count = $5, updated_count = $6, skipped_count = $7, invalid_count = $8, finished_at = $9 WHERE gid = $10",
+		status, reportJSON, string(errorsJSON), message, created, updated, skipped, invalid, time.Now(), gid)
+	if err != nil {
+		log.Println("Error finishing import job:", err)
+	}
+	return err
+}
+
+func (jr *importJobRepo) RequestCancel(gid string) (bool, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return false, nil
+	}
+	result, err := jr.db.Exec("UPDATE public.import_jobs SET cancel_requested = TRUE WHERE gid = $1 AND status IN ($2, $3)",
+		gid, JobQueued, JobRunning)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (jr *importJobRepo) FailInterruptedJobs() error {
+	_, err := jr.db.Exec("UPDATE public.import_jobs SET status = $1, error_message = $2, finished_at = $3 WHERE status IN ($4, $5)",
+		JobFailed, "interrupted by a server restart", time.Now(), JobQueued, JobRunning)
+	return err
+}
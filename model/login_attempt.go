@@ -0,0 +1,165 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// LoginAttemptWindow is how far back failed attempts are counted.
+	LoginAttemptWindow = 15 * time.Minute
+	// After LoginFreeAttempts failures every further attempt on an account
+	// has to wait twice as long as the previous one, up to LoginMaxDelay.
+	// LoginMaxAccountFailures failures lock the account for
+	// LoginLockoutDuration.
+	LoginFreeAttempts       = 3
+	LoginMaxDelay           = time.Minute
+	LoginMaxAccountFailures = 10
+	LoginLockoutDuration    = 15 * time.Minute
+	// The same applies to a client address trying many accounts, with
+	// higher limits since offices share addresses.
+	LoginFreeAttemptsPerIP = 10
+	LoginMaxFailuresPerIP  = 50
+	loginAttemptRetention  = 24 * time.Hour
+)
+
+var (
+	ErrAccountInactive   = errors.New("account is disabled")
+	ErrAccountNotStarted = errors.New("account is not active yet")
+	ErrAccountExpired    = errors.New("account has expired")
+)
+
+// LoginAllowed returns nil when the user may log in at now, or why not.
+func (u *User) LoginAllowed(now time.Time) error {
+	switch {
+	case !u.Active:
+		return ErrAccountInactive
+	case !u.StartDate.IsZero() && now.Before(u.StartDate):
+		return ErrAccountNotStarted
+	case !u.EndDate.IsZero() && !now.Before(u.EndDate):
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+type LoginAttemptRepository interface {
+	// BeginLoginAttempt returns how long a login for username from ip has to
+	// wait because of earlier failures. When it may go ahead, the attempt is
+	// recorded as failed and its id returned, so that concurrent attempts
+	// count against each other; SucceedLoginAttempt marks it succeeded once
+	// the login is complete.
+	BeginLoginAttempt(username, ip string) (int64, time.Duration, error)
+	SucceedLoginAttempt(id int64) error
+	PurgeLoginAttempts() (int64, error)
+}
+
+type loginAttemptRepo struct {
+	db *sql.DB
+}
+
+func NewLoginAttemptRepository(db *sql.DB) LoginAttemptRepository {
+	return &loginAttemptRepo{db: db}
+}
+
+func normalizeLoginName(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// loginDelay is how long to wait after the last of failures failed
+// attempts.
+func loginDelay(failures, free, max int, last, now time.Time) time.Duration {
+	var delay time.Duration
+	switch {
+	case failures >= max:
+		delay = LoginLockoutDuration
+	case failures >= free:
+		delay = LoginMaxDelay
+		if shift := failures - free; shift < 6 {
+			delay = time.Second << shift
+			if delay > LoginMaxDelay {
+				delay = LoginMaxDelay
+			}
+		}
+	default:
+		return 0
+	}
+	if wait := last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (la *loginAttemptRepo) BeginLoginAttempt(username, ip string) (int64, time.Duration, error) {
+	username = normalizeLoginName(username)
+	tx, err := la.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// Attempts on the same account or from the same address are serialised,
+	// always in this order, so that each one sees the failures before it
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(1, hashtext($1)), pg_advisory_xact_lock(2, hashtext($2))", username, ip); err != nil {
+		log.Println("Error locking login attempts:", err)
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	since := now.Add(-LoginAttemptWindow)
+
+	// Failures of the account count since its last successful login
+	var accountFailures int
+	var accountLast sql.NullTime
+	err = tx.QueryRow(`SELECT COUNT(*), MAX(created_date) FROM public.login_attempts
+		WHERE username = $1 AND NOT succeeded AND created_date > $2
+			AND created_date > COALESCE((SELECT MAX(created_date) FROM public.login_attempts WHERE username = $1 AND succeeded), '-infinity')`,
+		username, since).Scan(&accountFailures, &accountLast)
+	if err != nil {
+		log.Println("Error counting login attempts:", err)
+		return 0, 0, err
+	}
+	var ipFailures int
+	var ipLast sql.NullTime
+	err = tx.QueryRow("SELECT COUNT(*), MAX(created_date) FROM public.login_attempts WHERE ip = $1 AND NOT succeeded AND created_date > $2",
+		ip, since).Scan(&ipFailures, &ipLast)
+	if err != nil {
+		log.Println("Error counting login attempts:", err)
+		return 0, 0, err
+	}
+
+	wait := loginDelay(accountFailures, LoginFreeAttempts, LoginMaxAccountFailures, accountLast.Time, now)
+	if ipWait := loginDelay(ipFailures, LoginFreeAttemptsPerIP, LoginMaxFailuresPerIP, ipLast.Time, now); ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		return 0, wait, nil
+	}
+
+	var id int64
+	err = tx.QueryRow("INSERT INTO public.login_attempts (username, ip, succeeded, created_date) VALUES ($1, $2, false, $3) RETURNING id",
+		username, ip, now).Scan(&id)
+	if err != nil {
+		log.Println("Error recording login attempt:", err)
+		return 0, 0, err
+	}
+	return id, 0, tx.Commit()
+}
+
+func (la *loginAttemptRepo) SucceedLoginAttempt(id int64) error {
+	_, err := la.db.Exec("UPDATE public.login_attempts SET succeeded = true WHERE id = $1", id)
+	if err != nil {
+		log.Println("Error recording login attempt:", err)
+	}
+	return err
+}
+
+func (la *loginAttemptRepo) PurgeLoginAttempts() (int64, error) {
+	result, err := la.db.Exec("DELETE FROM public.login_attempts WHERE created_date < $1", time.Now().Add(-loginAttemptRetention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -25,30 +25,128 @@ type Message struct {
 	MessageStatus string `json:"message_status"`
 }
 
-func SendMsg(templatename string, recPhone string) (*WhatsAppMessageData, error) {
+// TemplateParameter is one body parameter of a template message. Source
+// reads the value from the recipient ("name", "email", "phone" or
+// "attr.<key>"), otherwise Text is sent as is. Default is used when the
+// source is empty.
+type TemplateParameter struct {
+	Source  string `json:"source,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Default string `json:"default,omitempty"`
+}
+
+// NeedsCustomer reports whether any parameter is read from the recipient.
+func NeedsCustomer(params []TemplateParameter) bool {
+	for _, param := range params {
+		if param.Source != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveTemplateParameters returns the text of each parameter for the given
+// customer, which may be nil when no parameter has a source.
+func ResolveTemplateParameters(customer *Customer, params []TemplateParameter) ([]string, error) {
+	values := make([]string, len(params))
+	for i, param := range params {
+		if param.Source == "" {
+			values[i] = param.Text
+			continue
+		}
+		if customer == nil {
+			return nil, fmt.Errorf("parameter %d: recipient is not a known customer", i+1)
+		}
+
+		var value string
+		switch source := strings.ToLower(param.Source); {
+		case source == "name":
+			value = customer.NAME
+		case source == "email":
+			value = customer.EMAIL
+		case source == "phone":
+			value = customer.NORMALIZED_PHONE.String
+		case strings.HasPrefix(source, "attr."):
+			if attr, ok := customer.ATTRIBUTES[param.Source[len("attr."):]]; ok && attr != nil {
+				value, _ = attributeText(attr)
+			}
+		default:
+			return nil, fmt.Errorf("parameter %d: unknown source %q", i+1, param.Source)
+		}
+
+		if value == "" {
+			value = param.Default
+		}
+		if value == "" {
+			return nil, fmt.Errorf("parameter %d: %s is empty for this customer", i+1, param.Source)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// SendMsg sends a template message in the given language; parameters fill
+// the body placeholders in order.
+func SendMsg(templatename string, recPhone string, language string, parameters []string) (*WhatsAppMessageData, error) {
+	config, err := envconfig.LoadConfig("config.json")
+	if err != nil {
+		return nil, err
+	}
+	bodyParameters := make([]map[string]string, len(parameters))
+	for i, text := range parameters {
+		bodyParameters[i] = map[string]string{"type": "text", "text": text}
+	}
+	// The payload is marshalled so that names, numbers and languages
+	// containing quotes cannot change its structure
+	payload, err := json.Marshal(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"recipient_type":    "individual",
+		"to":                recPhone,
+		"type":              "template",
+		"template": map[string]interface{}{
+			"name":     templatename,
+			"language": map[string]string{"code": language},
+			"components": []map[string]interface{}{
+				{"type": "body", "parameters": bodyParameters},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return postMessage(config, string(payload))
+}
+
+// SendAuthenticationCode sends a one-time code with an authentication
+// template, which carries the code in its body and its copy-code button.
+func SendAuthenticationCode(templatename string, recPhone string, language string, code string) (*WhatsAppMessageData, error) {
 	config, err := envconfig.LoadConfig("config.json")
 	if err != nil {
 		return nil, err
 	}
-	payloadFormat := `{
+	codeParameter := []map[string]string{{"type": "text", "text": code}}
+	payload, err := json.Marshal(map[string]interface{}{
 		"messaging_product": "whatsapp",
-		"recipient_type": "individual",
-		"to": "%s",
-		"type": "template",
-		"template": {
-			"name": "%s",
-			"language": {
-				"code": "en_US"
+		"recipient_type":    "individual",
+		"to":                recPhone,
+		"type":              "template",
+		"template": map[string]interface{}{
+			"name":     templatename,
+			"language": map[string]string{"code": language},
+			"components": []map[string]interface{}{
+				{"type": "body", "parameters": codeParameter},
+				{"type": "button", "sub_type": "url", "index": "0", "parameters": codeParameter},
 			},
-			"components": [
-				{
-					"type": "body",
-					"parameters": []
-				}
-			]
-		}
-	}`
-	payload := fmt.Sprintf(payloadFormat, recPhone, templatename)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return postMessage(config, string(payload))
+}
+
+// postMessage sends a message payload to the Cloud API.
+func postMessage(config *envconfig.Config, payload string) (*WhatsAppMessageData, error) {
 	requestBody := strings.NewReader(payload)
 	url := fmt.Sprintf("%s/%s/%s/messages", config.Url, config.Version, config.PhoneNumberId)
 	request, err := http.NewRequest("POST", url, requestBody)
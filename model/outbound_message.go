@@ -0,0 +1,73 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Outbound message statuses.
+const (
+	OutboundSent    = "sent"
+	OutboundFailed  = "failed"
+	OutboundBlocked = "blocked"
+)
+
+// OutboundMessage records a message we sent, or tried to send, to a number.
+type OutboundMessage struct {
+	ID             int       `json:"id"`
+	GID            string    `json:"gid"`
+	CustomerGID    string    `json:"customer_gid,omitempty"`
+	RecipientPhone string    `json:"recipient_phone"`
+	TemplateName   string    `json:"template_name"`
+	Parameters     []string  `json:"parameters"`
+	WaMessageID    string    `json:"wa_message_id,omitempty"`
+	Status         string    `json:"status"`
+	ErrorMessage   string    `json:"error_message,omitempty"`
+	SentBy         int       `json:"sent_by,omitempty"`
+	CreatedDate    time.Time `json:"created_date"`
+}
+
+type OutboundMessageRepository interface {
+	// LogOutbound stores the message, linking it to the customer that owns
+	// the recipient phone when there is one.
+	LogOutbound(msg *OutboundMessage) error
+}
+
+type outboundMessageRepo struct {
+	db *sql.DB
+}
+
+func NewOutboundMessageRepository(db *sql.DB) OutboundMessageRepository {
+	return &outboundMessageRepo{db: db}
+}
+
+func (om *outboundMessageRepo) LogOutbound(msg *OutboundMessage) error {
+	msg.GID = uuid.New().String()
+	msg.CreatedDate = time.Now()
+	parameters, err := json.Marshal(msg.Parameters)
+	if err != nil {
+		return err
+	}
+	if msg.Parameters == nil {
+		parameters = []byte("[]")
+	}
+
+	var sentBy interface{}
+	if msg.SentBy != 0 {
+		sentBy = msg.SentBy
+	}
+	var customerGID sql.NullString
+	err = om.db.QueryRow(`INSERT INTO public.outbound_messages (gid, customer_gid, recipient_phone, template_name, parameters, wa_message_id, status, error_message, sent_by, created_date)
+		VALUES ($1, (SELECT gid FROM public.customer WHERE normalized_phone = $2), $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, customer_gid`,
+		msg.GID, msg.RecipientPhone, msg.TemplateName, string(parameters), msg.WaMessageID, msg.Status, msg.ErrorMessage, sentBy, msg.CreatedDate).Scan(&msg.ID, &customerGID)
+	if err != nil {
+		log.Println("Error logging outbound message:", err)
+		return err
+	}
+	msg.CustomerGID = customerGID.String
+	return nil
+}
@@ -0,0 +1,189 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Roles seeded by migration 018.
+const (
+	RoleAdmin           = "admin"
+	RoleCampaignManager = "campaign_manager"
+	RoleAgent           = "agent"
+	RoleReadOnly        = "read_only"
+)
+
+// Permissions checked by the API routes.
+const (
+	PermCustomersRead    = "customers:read"
+	PermCustomersWrite   = "customers:write"
+	PermCustomersDelete  = "customers:delete"
+	PermCustomersImport  = "customers:import"
+	PermCustomersExport  = "customers:export"
+	PermAttributesManage = "attributes:manage"
+	PermSegmentsManage   = "segments:manage"
+	PermPrivacyManage    = "privacy:manage"
+	PermMessagesSend     = "messages:send"
+	PermTemplatesRead    = "templates:read"
+	PermTemplatesManage  = "templates:manage"
+	PermUsersManage      = "users:manage"
+	PermAPIKeysManage    = "api_keys:manage"
+)
+
+var (
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrLastAdmin is returned when a change would leave no active admin.
+	ErrLastAdmin = errors.New("at least one active admin is required")
+)
+
+// Role is a named set of permissions.
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserRoles is a user with the roles assigned to them.
+type UserRoles struct {
+	UserID   int      `json:"user_id"`
+	GID      string   `json:"gid"`
+	Name     string   `json:"name"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Active   bool     `json:"active"`
+	Roles    []string `json:"roles"`
+}
+
+type RoleRepository interface {
+	ListRoles() ([]Role, error)
+	ListUserRoles() ([]UserRoles, error)
+	// SetUserRoles replaces the roles of the user and signs them out, so
+	// that their next tokens carry the new permissions. It returns
+	// ErrUnknownRole, ErrLastAdmin, or sql.ErrNoRows for unknown users.
+	SetUserRoles(userID int, roles []string, assignedBy int) error
+}
+
+type roleRepo struct {
+	db *sql.DB
+}
+
+func NewRoleRepository(db *sql.DB) RoleRepository {
+	return &roleRepo{db: db}
+}
+
+func (rr *roleRepo) ListRoles() ([]Role, error) {
+	rows, err := rr.db.Query(`SELECT r.name, r.description,
+			ARRAY(SELECT rp.permission FROM public.role_permissions rp WHERE rp.role_name = r.name ORDER BY rp.permission)
+		FROM public.roles r ORDER BY r.name`)
+	if err != nil {
+		log.Println("Error listing roles:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, &role.Description, pq.Array(&role.Permissions)); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (rr *roleRepo) ListUserRoles() ([]UserRoles, error) {
+	rows, err := rr.db.Query(`SELECT u.id, u.gid, u.users_name, u.login_user_name, COALESCE(u.email, ''), COALESCE(u.active, false),
+			ARRAY(SELECT ur.role_name FROM public.user_roles ur WHERE ur.user_id = u.id ORDER BY ur.role_name)
+		FROM public.users u ORDER BY u.id`)
+	if err != nil {
+		log.Println("Error listing user roles:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserRoles{}
+	for rows.Next() {
+		var user UserRoles
+		err := rows.Scan(&user.UserID, &user.GID, &user.Name, &user.Username, &user.Email, &user.Active, pq.Array(&user.Roles))
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// assignRoles adds roles to a user inside tx.
+func assignRoles(tx *sql.Tx, userID int, roles []string, assignedBy int) error {
+	var by sql.NullInt64
+	if assignedBy != 0 {
+		by = sql.NullInt64{Int64: int64(assignedBy), Valid: true}
+	}
+	for _, role := range roles {
+		_, err := tx.Exec("INSERT INTO public.user_roles (user_id, role_name, assigned_by, created_date) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			userID, role, by, time.Now())
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			return ErrUnknownRole
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rr *roleRepo) SetUserRoles(userID int, roles []string, assignedBy int) error {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Role changes are serialised so two admins cannot demote each other
+	// at the same time
+	if _, err := tx.Exec("LOCK TABLE public.user_roles IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		log.Println("Error locking user roles:", err)
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM public.users WHERE id = $1)", userID).Scan(&exists); err != nil {
+		log.Println("Error reading user:", err)
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec("DELETE FROM public.user_roles WHERE user_id = $1", userID); err != nil {
+		log.Println("Error updating user roles:", err)
+		return err
+	}
+	if err := assignRoles(tx, userID, roles, assignedBy); err != nil {
+		if err != ErrUnknownRole {
+			log.Println("Error updating user roles:", err)
+		}
+		return err
+	}
+
+	var admins int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM public.user_roles ur JOIN public.users u ON u.id = ur.user_id
+		WHERE ur.role_name = $1 AND COALESCE(u.active, false)`, RoleAdmin).Scan(&admins)
+	if err != nil {
+		log.Println("Error counting admins:", err)
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+
+	if _, err := revokeFamilies(tx, "r.user_id = $1", userID); err != nil {
+		log.Println("Error revoking sessions:", err)
+		return err
+	}
+	return tx.Commit()
+}
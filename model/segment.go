@@ -0,0 +1,526 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Segment is a saved customer filter, e.g.
+//
+//	tag = "kerala" AND (last_inbound_at < -30d OR last_inbound_at = null)
+//
+// Expressions combine comparisons with AND, OR, NOT and parentheses. Fields
+// are listed in segmentFields; "tag" matches customers carrying a tag.
+// Values are quoted strings, numbers, null, dates (YYYY-MM-DD) or relative
+// times such as -30d, -12h or -2w. Operators are =, !=, <>, <, <=, >, >=
+// and ~, a case-insensitive "contains"; anything else is rejected.
+type Segment struct {
+	ID          int       `json:"id"`
+	GID         string    `json:"gid"`
+	Name        string    `json:"name"`
+	Expression  string    `json:"expression"`
+	CreatedBy   int       `json:"created_by"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+type SegmentRepository interface {
+	ListSegments() ([]Segment, error)
+	GetSegment(gid string) (*Segment, error)
+	CreateSegment(segment *Segment) error
+	DeleteSegment(gid string) (bool, error)
+}
+
+type segmentRepo struct {
+	db *sql.DB
+}
+
+func NewSegmentRepository(db *sql.DB) SegmentRepository {
+	return &segmentRepo{db: db}
+}
+
+var (
+	// ErrInvalidExpression wraps every segment expression compile error.
+	ErrInvalidExpression = errors.New("invalid segment expression")
+	// ErrSegmentNotFound is returned when a filter names an unknown segment.
+	ErrSegmentNotFound = errors.New("segment not found")
+)
+
+const maxExpressionLength = 2000
+
+type fieldKind int
+
+const (
+	kindText fieldKind = iota
+	kindNumber
+	kindTime
+)
+
+type segmentField struct {
+	sql  string
+	kind fieldKind
+}
+
+// segmentFields maps expression fields to SQL on the customer table aliased "c".
+var segmentFields = map[string]segmentField{
+	"name":            {"c.name", kindText},
+	"wa_profile_name": {"c.wa_profile_name", kindText},
+	"email":           {"c.email", kindText},
+	"phone":           {"c.normalized_phone", kindText},
+	"country_code":    {"c.country_code", kindNumber},
+	"opt_in_status":   {"c.opt_in_status", kindText},
+	"language":        {"c.language", kindText},
+	"timezone":        {"c.timezone", kindText},
+	"created_date":    {"c.created_date", kindTime},
+	"last_inbound_at": {lastInboundSQL, kindTime},
+	"first_seen_at":   {"c.first_seen_at", kindTime},
+	"last_seen_at":    {"c.last_seen_at", kindTime},
+}
+
+func (sr *segmentRepo) ListSegments() ([]Segment, error) {
+	rows, err := sr.db.Query("SELECT id, gid, name, expression, created_by, created_date FROM public.segments ORDER BY name")
+	if err != nil {
+		log.Println("Error retrieving segments:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []Segment
+	for rows.Next() {
+		var segment Segment
+		if err := rows.Scan(&segment.ID, &segment.GID, &segment.Name, &segment.Expression, &segment.CreatedBy, &segment.CreatedDate); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, rows.Err()
+}
+
+func (sr *segmentRepo) GetSegment(gid string) (*Segment, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return nil, sql.ErrNoRows
+	}
+	segment := &Segment{}
+	err := sr.db.QueryRow("SELECT id, gid, name, expression, created_by, created_date FROM public.segments WHERE gid = $1", gid).
+		Scan(&segment.ID, &segment.GID, &segment.Name, &segment.Expression, &segment.CreatedBy, &segment.CreatedDate)
+	if err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
+
+func (sr *segmentRepo) CreateSegment(segment *Segment) error {
+	if _, _, err := CompileSegment(segment.Expression, nil); err != nil {
+		return err
+	}
+	segment.GID = uuid.New().String()
+	segment.CreatedDate = time.Now()
+	return sr.db.QueryRow("INSERT INTO public.segments (gid, name, expression, created_by, created_date) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		segment.GID, segment.Name, segment.Expression, segment.CreatedBy, segment.CreatedDate).Scan(&segment.ID)
+}
+
+func (sr *segmentRepo) DeleteSegment(gid string) (bool, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return false, nil
+	}
+	result, err := sr.db.Exec("DELETE FROM public.segments WHERE gid = $1", gid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// CompileSegment turns a segment expression into a SQL condition on the
+// customer table aliased "c". Placeholders are numbered after args.
+func CompileSegment(expression string, args []interface{}) (string, []interface{}, error) {
+	if len(expression) > maxExpressionLength {
+		return "", nil, fmt.Errorf("%w: longer than %d characters", ErrInvalidExpression, maxExpressionLength)
+	}
+	tokens, err := lexSegment(expression)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidExpression, err)
+	}
+	p := &segmentParser{tokens: tokens, args: args, now: time.Now()}
+	condition, err := p.parseOr(0)
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidExpression, err)
+	}
+	return condition, p.args, nil
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokString
+	tokNumber
+	tokRelative
+	tokOperator
+	tokLParen
+	tokRParen
+)
+
+type segmentToken struct {
+	kind tokenKind
+	text string
+}
+
+// operatorRunes make up operators; a run of them must be one of
+// segmentOperators.
+const operatorRunes = "=!<>~"
+
+var segmentOperators = map[string]bool{
+	"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true, "~": true,
+}
+
+func lexSegment(input string) ([]segmentToken, error) {
+	var tokens []segmentToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, segmentToken{tokLParen, "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, segmentToken{tokRParen, ")"})
+			i++
+		case r == '"' || r == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				b.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, segmentToken{tokString, b.String()})
+			i = j + 1
+		case strings.ContainsRune(operatorRunes, r):
+			j := i + 1
+			for j < len(runes) && strings.ContainsRune(operatorRunes, runes[j]) {
+				j++
+			}
+			op := string(runes[i:j])
+			if !segmentOperators[op] {
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			tokens = append(tokens, segmentToken{tokOperator, op})
+			i = j
+		case r == '-' || unicode.IsDigit(r):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == '-') {
+				j++
+			}
+			kind := tokNumber
+			if j < len(runes) && strings.ContainsRune("hdw", runes[j]) {
+				j++
+				kind = tokRelative
+			}
+			tokens = append(tokens, segmentToken{kind, string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_' || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, segmentToken{tokIdent, string(runes[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+type segmentParser struct {
+	tokens []segmentToken
+	pos    int
+	args   []interface{}
+	now    time.Time
+}
+
+const maxExpressionDepth = 32
+
+func (p *segmentParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokIdent && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+func (p *segmentParser) next() (segmentToken, error) {
+	if p.pos >= len(p.tokens) {
+		return segmentToken{}, errors.New("unexpected end of expression")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *segmentParser) parseOr(depth int) (string, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return "", err
+	}
+	for p.peekKeyword("OR") {
+		p.pos++
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + " OR " + right + ")"
+	}
+	return left, nil
+}
+
+func (p *segmentParser) parseAnd(depth int) (string, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return "", err
+	}
+	for p.peekKeyword("AND") {
+		p.pos++
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + " AND " + right + ")"
+	}
+	return left, nil
+}
+
+func (p *segmentParser) parseUnary(depth int) (string, error) {
+	if depth > maxExpressionDepth {
+		return "", errors.New("expression is nested too deeply")
+	}
+	if p.peekKeyword("NOT") {
+		p.pos++
+		inner, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return "", err
+		}
+		return "(NOT " + inner + ")", nil
+	}
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokLParen {
+		p.pos++
+		inner, err := p.parseOr(depth + 1)
+		if err != nil {
+			return "", err
+		}
+		if tok, err := p.next(); err != nil || tok.kind != tokRParen {
+			return "", errors.New("missing \")\"")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *segmentParser) placeholder(value interface{}) string {
+	p.args = append(p.args, value)
+	return "$" + strconv.Itoa(len(p.args))
+}
+
+func (p *segmentParser) parseComparison() (string, error) {
+	fieldTok, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if fieldTok.kind != tokIdent {
+		return "", fmt.Errorf("expected a field name, got %q", fieldTok.text)
+	}
+	opTok, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if opTok.kind != tokOperator {
+		return "", fmt.Errorf("expected an operator after %s, got %q", fieldTok.text, opTok.text)
+	}
+	op := opTok.text
+	if op == "<>" {
+		op = "!="
+	}
+	valueTok, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	isNull := valueTok.kind == tokIdent && strings.EqualFold(valueTok.text, "null")
+
+	name := strings.ToLower(fieldTok.text)
+	if name == "tag" {
+		return p.tagCondition(op, valueTok, isNull)
+	}
+	if strings.HasPrefix(name, "attr.") {
+		return p.attributeCondition(fieldTok.text[len("attr."):], op, valueTok, isNull)
+	}
+
+	field, ok := segmentFields[name]
+	if !ok {
+		return "", fmt.Errorf("unknown field %q", fieldTok.text)
+	}
+
+	if isNull {
+		// Empty text counts as null
+		switch {
+		case op == "=" && field.kind == kindText:
+			return "(" + field.sql + " IS NULL OR " + field.sql + " = '')", nil
+		case op == "!=" && field.kind == kindText:
+			return "(" + field.sql + " IS NOT NULL AND " + field.sql + " <> '')", nil
+		case op == "=":
+			return field.sql + " IS NULL", nil
+		case op == "!=":
+			return field.sql + " IS NOT NULL", nil
+		}
+		return "", fmt.Errorf("null can only be compared with = or !=")
+	}
+
+	if op == "~" {
+		if field.kind != kindText || valueTok.kind != tokString {
+			return "", fmt.Errorf("~ needs a text field and a quoted value")
+		}
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(valueTok.text)
+		return field.sql + " ILIKE " + p.placeholder("%"+escaped+"%"), nil
+	}
+
+	value, err := p.fieldValue(field, valueTok)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", fieldTok.text, err)
+	}
+	if op == "!=" && field.kind == kindText {
+		// Customers without a value differ from it too
+		op = "IS DISTINCT FROM"
+	}
+	return field.sql + " " + op + " " + p.placeholder(value), nil
+}
+
+func (p *segmentParser) fieldValue(field segmentField, tok segmentToken) (interface{}, error) {
+	switch field.kind {
+	case kindNumber:
+		if tok.kind != tokNumber {
+			return nil, fmt.Errorf("expected a number, got %q", tok.text)
+		}
+		return strconv.ParseFloat(tok.text, 64)
+	case kindTime:
+		if tok.kind == tokRelative {
+			return p.relativeTime(tok.text)
+		}
+		if tok.kind == tokString {
+			for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+				if t, err := time.Parse(layout, tok.text); err == nil {
+					return t, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("expected a date or relative time such as -30d, got %q", tok.text)
+	}
+	if tok.kind != tokString && tok.kind != tokNumber {
+		return nil, fmt.Errorf("expected a quoted value, got %q", tok.text)
+	}
+	return tok.text, nil
+}
+
+func (p *segmentParser) relativeTime(text string) (time.Time, error) {
+	unit := text[len(text)-1]
+	amount, err := strconv.Atoi(text[:len(text)-1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid relative time %q", text)
+	}
+	switch unit {
+	case 'h':
+		return p.now.Add(time.Duration(amount) * time.Hour), nil
+	case 'w':
+		return p.now.AddDate(0, 0, amount*7), nil
+	}
+	return p.now.AddDate(0, 0, amount), nil
+}
+
+func (p *segmentParser) tagCondition(op string, tok segmentToken, isNull bool) (string, error) {
+	if op != "=" && op != "!=" {
+		return "", errors.New("tag can only be compared with = or !=")
+	}
+	if isNull {
+		condition := "EXISTS (SELECT 1 FROM public.customer_tags ct WHERE ct.customer_id = c.id)"
+		if op == "=" {
+			condition = "NOT " + condition
+		}
+		return condition, nil
+	}
+	if tok.kind != tokString {
+		return "", fmt.Errorf("tag needs a quoted value, got %q", tok.text)
+	}
+	condition := "EXISTS (SELECT 1 FROM public.customer_tags ct JOIN public.tags t ON t.id = ct.tag_id WHERE ct.customer_id = c.id AND lower(t.name) = lower(" + p.placeholder(tok.text) + "))"
+	if op == "!=" {
+		condition = "NOT " + condition
+	}
+	return condition, nil
+}
+
+// attributeCondition compares a custom attribute. The value decides how: numbers
+// compare numerically, true and false match booleans, relative times compare
+// with date attributes and anything else compares as text.
+func (p *segmentParser) attributeCondition(key, op string, tok segmentToken, isNull bool) (string, error) {
+	if key == "" {
+		return "", errors.New("attr. needs an attribute key")
+	}
+	value := "c.attributes -> " + p.placeholder(key)
+	text := "(c.attributes ->> " + p.placeholder(key) + ")"
+
+	switch {
+	case isNull:
+		switch op {
+		case "=":
+			return value + " IS NULL", nil
+		case "!=":
+			return value + " IS NOT NULL", nil
+		}
+		return "", errors.New("null can only be compared with = or !=")
+
+	case tok.kind == tokIdent && (strings.EqualFold(tok.text, "true") || strings.EqualFold(tok.text, "false")):
+		if op != "=" && op != "!=" {
+			return "", errors.New("booleans can only be compared with = or !=")
+		}
+		condition := value + " = " + p.placeholder(strings.ToLower(tok.text)) + "::jsonb"
+		if op == "!=" {
+			condition = "NOT COALESCE(" + condition + ", FALSE)"
+		}
+		return condition, nil
+
+	case op == "~":
+		if tok.kind != tokString {
+			return "", errors.New("~ needs a quoted value")
+		}
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(tok.text)
+		return text + " ILIKE " + p.placeholder("%"+escaped+"%"), nil
+
+	case tok.kind == tokNumber:
+		number, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return "", fmt.Errorf("attr.%s: expected a number, got %q", key, tok.text)
+		}
+		// Values that are not numbers never match instead of failing the cast
+		return "CASE WHEN jsonb_typeof(" + value + ") = 'number' THEN " + text + "::numeric END " + op + " " + p.placeholder(number), nil
+
+	case tok.kind == tokRelative:
+		date, err := p.relativeTime(tok.text)
+		if err != nil {
+			return "", err
+		}
+		return text + " " + op + " " + p.placeholder(date.Format("2006-01-02")), nil
+
+	case tok.kind == tokString:
+		return text + " " + op + " " + p.placeholder(tok.text), nil
+	}
+	return "", fmt.Errorf("attr.%s: unexpected value %q", key, tok.text)
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompileSegment(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		args       []interface{}
+		want       string
+		wantArgs   int
+	}{
+		{"text equals", `name = "Asha"`, nil, "c.name = $1", 1},
+		{"not equals", `language != "ml"`, nil, "c.language IS DISTINCT FROM $1", 1},
+		{"angle not equals", `language <> "ml"`, nil, "c.language IS DISTINCT FROM $1", 1},
+		{"email not equals", `email != "a@example.com"`, nil, "c.email IS DISTINCT FROM $1", 1},
+		{"number compare", `country_code >= 91`, nil, "c.country_code >= $1", 1},
+		{"less than", `country_code < 91`, nil, "c.country_code < $1", 1},
+		{"contains", `name ~ "an"`, nil, "c.name ILIKE $1", 1},
+		{"relative time", `created_date < -30d`, nil, "c.created_date < $1", 1},
+		{"date", `created_date > "2024-01-31"`, nil, "c.created_date > $1", 1},
+		{"no email", `email = null`, nil, "(c.email IS NULL OR c.email = '')", 0},
+		{"has email", `email != null`, nil, "(c.email IS NOT NULL AND c.email <> '')", 0},
+		{"number null", `country_code = null`, nil, "c.country_code IS NULL", 0},
+		{"not null", `first_seen_at != null`, nil, "c.first_seen_at IS NOT NULL", 0},
+		{"placeholders follow args", `name = "Asha"`, []interface{}{1, 2}, "c.name = $3", 3},
+		{"and or", `name = "a" AND (language = "ml" OR language = "en")`, nil,
+			"(c.name = $1 AND (c.language = $2 OR c.language = $3))", 3},
+		{"not", `NOT name = "a"`, nil, "(NOT c.name = $1)", 1},
+		{"tag", `tag = "kerala"`, nil, "EXISTS (SELECT 1 FROM public.customer_tags ct JOIN public.tags t", 1},
+		{"no tags", `tag = null`, nil, "NOT EXISTS (SELECT 1 FROM public.customer_tags ct WHERE ct.customer_id = c.id)", 0},
+		{"attribute number", `attr.orders > 3`, nil, "::numeric END > $3", 3},
+		{"attribute boolean", `attr.vip = true`, nil, "c.attributes -> $1 = $3::jsonb", 3},
+		{"operator without spaces", `country_code>=91`, nil, "c.country_code >= $1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, args, err := CompileSegment(tt.expression, tt.args)
+			if err != nil {
+				t.Fatalf("CompileSegment(%q) error: %v", tt.expression, err)
+			}
+			if !strings.Contains(condition, tt.want) {
+				t.Errorf("CompileSegment(%q) = %q, want it to contain %q", tt.expression, condition, tt.want)
+			}
+			if len(args) != tt.wantArgs {
+				t.Errorf("CompileSegment(%q) returned %d args, want %d", tt.expression, len(args), tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestCompileSegmentRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+	}{
+		{"double equals", `name == "a"`},
+		{"tilde equals", `name ~= "a"`},
+		{"bang less", `country_code !< 3`},
+		{"operator followed by tilde", `name >=~ "a"`},
+		{"bare bang", `name ! "a"`},
+		{"unknown field", `password = "a"`},
+		{"missing value", `name =`},
+		{"missing operator", `name "a"`},
+		{"unbalanced parenthesis", `(name = "a"`},
+		{"trailing token", `name = "a" "b"`},
+		{"unterminated string", `name = "a`},
+		{"null with less than", `email < null`},
+		{"contains on number", `country_code ~ "9"`},
+		{"tag with less than", `tag < "a"`},
+		{"number field with text", `country_code = "x"`},
+		{"empty attribute key", `attr. = "a"`},
+		{"too long", strings.Repeat("a", maxExpressionLength+1)},
+		{"too deep", strings.Repeat("NOT ", maxExpressionDepth+2) + `name = "a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := CompileSegment(tt.expression, nil)
+			if !errors.Is(err, ErrInvalidExpression) {
+				t.Errorf("CompileSegment(%q) error = %v, want ErrInvalidExpression", tt.expression, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxTagLength is the longest tag name accepted.
+const maxTagLength = 100
+
+type Tag struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Customers   int       `json:"customers"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+type TagRepository interface {
+	ListTags() ([]Tag, error)
+	// AssignTags adds the tags to every customer matching the filter and
+	// returns the number of new assignments.
+	AssignTags(filter CustomerFilter, tags []string, userID int) (int64, error)
+	// RemoveTags removes the tags from every customer matching the filter.
+	RemoveTags(filter CustomerFilter, tags []string) (int64, error)
+}
+
+type tagRepo struct {
+	db *sql.DB
+}
+
+func NewTagRepository(db *sql.DB) TagRepository {
+	return &tagRepo{db: db}
+}
+
+// NormalizeTags trims tag names, drops empty ones and removes
+// case-insensitive duplicates, keeping the first spelling.
+func NormalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(tag), " ")
+		if tag == "" || len(tag) > maxTagLength || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// SplitTags splits a "a; b, c" style list into normalized tag names.
+func SplitTags(value string) []string {
+	return NormalizeTags(strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }))
+}
+
+func lowerTags(tags []string) []string {
+	lowered := make([]string, len(tags))
+	for i, tag := range tags {
+		lowered[i] = strings.ToLower(tag)
+	}
+	return lowered
+}
+
+// ensureTags creates any tags that do not exist yet.
+func ensureTags(db dbExecutor, tags []string) error {
+	for _, tag := range tags {
+		if _, err := db.Exec("INSERT INTO public.tags (name, created_date) VALUES ($1, $2) ON CONFLICT ((lower(name))) DO NOTHING", tag, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagCustomer attaches tags to a single customer.
+func tagCustomer(db dbExecutor, customerID int, tags []string, userID int) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	if err := ensureTags(db, tags); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO public.customer_tags (customer_id, tag_id, created_by, created_date) SELECT $1, t.id, $2, $3 FROM public.tags t WHERE lower(t.name) = ANY($4) ON CONFLICT DO NOTHING",
+		customerID, userID, time.Now(), pq.Array(lowerTags(tags)))
+	return err
+}
+
+func (tr *tagRepo) ListTags() ([]Tag, error) {
+	rows, err := tr.db.Query("SELECT t.id, t.name, t.created_date, COUNT(ct.customer_id) FROM public.tags t LEFT JOIN public.customer_tags ct ON ct.tag_id = t.id GROUP BY t.id ORDER BY lower(t.name)")
+	if err != nil {
+		log.Println("Error retrieving tags:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.CreatedDate, &tag.Customers); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (tr *tagRepo) AssignTags(filter CustomerFilter, tags []string, userID int) (int64, error) {
+	tags = NormalizeTags(tags)
+	if len(tags) == 0 {
+		return 0, nil
+	}
+
+	where, args, err := customerWhere(tr.db, filter, []interface{}{pq.Array(lowerTags(tags)), userID, time.Now()})
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := tr.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := ensureTags(tx, tags); err != nil {
+		log.Println("Error creating tags:", err)
+		return 0, err
+	}
+	result, err := tx.Exec("INSERT INTO public.customer_tags (customer_id, tag_id, created_by, created_date) SELECT c.id, t.id, $2, $3 FROM public.customer c CROSS JOIN public.tags t"+
+		andWhere(where, "lower(t.name) = ANY($1)")+" ON CONFLICT DO NOTHING", args...)
+	if err != nil {
+		log.Println("Error assigning tags:", err)
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (tr *tagRepo) RemoveTags(filter CustomerFilter, tags []string) (int64, error) {
+	tags = NormalizeTags(tags)
+	if len(tags) == 0 {
+		return 0, nil
+	}
+
+	where, args, err := customerWhere(tr.db, filter, []interface{}{pq.Array(lowerTags(tags))})
+	if err != nil {
+		return 0, err
+	}
+	result, err := tr.db.Exec("DELETE FROM public.customer_tags WHERE tag_id IN (SELECT id FROM public.tags WHERE lower(name) = ANY($1)) AND customer_id IN (SELECT c.id FROM public.customer c"+where+")", args...)
+	if err != nil {
+		log.Println("Error removing tags:", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// andWhere appends condition to a clause built by customerWhere.
+func andWhere(where, condition string) string {
+	if where == "" {
+		return " WHERE " + condition
+	}
+	return where + " AND " + condition
+}
@@ -0,0 +1,269 @@
+package model
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Purposes of one-time codes.
+const (
+	OTPPurposeMobile = "verify_mobile"
+	OTPPurposeLogin  = "login"
+)
+
+const (
+	OTPLength = 6
+	OTPExpiry = 5 * time.Minute
+	// OTPMaxAttempts wrong guesses spend a code.
+	OTPMaxAttempts = 5
+	// A new code can be requested every OTPResendInterval, and at most
+	// OTPMaxPerHour times an hour.
+	OTPResendInterval = time.Minute
+	OTPMaxPerHour     = 5
+
+	LoginChallengeExpiry = 10 * time.Minute
+	// LoginChallengeMaxAttempts wrong second factors end a pending login.
+	LoginChallengeMaxAttempts = 5
+)
+
+var (
+	ErrOTPRateLimited      = errors.New("too many codes requested, please wait before asking for another")
+	ErrOTPAttemptsExceeded = errors.New("too many wrong attempts, please request a new code")
+	// ErrInvalidChallenge is returned for unknown, expired, completed or
+	// exhausted login challenges.
+	ErrInvalidChallenge = errors.New("login expired, please sign in again")
+)
+
+type TwoFactorRepository interface {
+	// CreateOTP replaces the user's outstanding code for purpose with a new
+	// one and returns it. It returns ErrOTPRateLimited when codes are
+	// requested too often.
+	CreateOTP(userID int, purpose string) (string, error)
+	// VerifyOTP spends the user's code for purpose when it matches. It
+	// returns ErrInvalidCode or ErrOTPAttemptsExceeded otherwise.
+	VerifyOTP(userID int, purpose, code string) error
+	SetMobileVerified(userID int) error
+	SetMobileOTP(userID int, enabled bool) error
+
+	// CreateLoginChallenge records that the user passed the first login
+	// step and returns the token to complete it with.
+	CreateLoginChallenge(userID int, requestedIp string) (string, error)
+	// LoginChallengeUser returns the user of a pending challenge, or
+	// ErrInvalidChallenge.
+	LoginChallengeUser(token string) (int, error)
+	// FailLoginChallenge counts a wrong second factor against the challenge.
+	FailLoginChallenge(token string) error
+	// CompleteLoginChallenge ends the challenge, which can then not be used
+	// again, and returns its user.
+	CompleteLoginChallenge(token string) (int, error)
+
+	// BeginTOTPEnrollment stores a new pending authenticator secret for the
+	// user and returns it. ErrTOTPEnabled is returned when TOTP is on.
+	BeginTOTPEnrollment(userID int) (string, error)
+	// ConfirmTOTP turns TOTP on when code matches the pending secret and
+	// returns a new set of recovery codes.
+	ConfirmTOTP(userID int, code string) ([]string, error)
+	// VerifyTOTP returns ErrInvalidCode unless code is current and has not
+	// been used before.
+	VerifyTOTP(userID int, code string) error
+	// DisableTOTP turns TOTP off and drops the recovery codes.
+	DisableTOTP(userID int) error
+	RegenerateRecoveryCodes(userID int) ([]string, error)
+	// UseRecoveryCode spends one of the user's recovery codes, or returns
+	// ErrInvalidCode.
+	UseRecoveryCode(userID int, code string) error
+	// ResetTwoFactor turns every second factor of the user off, for users
+	// who lost their device.
+	ResetTwoFactor(userID int) error
+}
+
+type twoFactorRepo struct {
+	db *sql.DB
+}
+
+func NewTwoFactorRepository(db *sql.DB) TwoFactorRepository {
+	return &twoFactorRepo{db: db}
+}
+
+func newOTP() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < OTPLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", OTPLength, n), nil
+}
+
+func (tf *twoFactorRepo) CreateOTP(userID int, purpose string) (string, error) {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Serialise requests of the same user so the limits hold
+	if _, err := tx.Exec("SELECT id FROM public.users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		log.Println("Error locking user:", err)
+		return "", err
+	}
+	now := time.Now()
+	var recent int
+	var last sql.NullTime
+	err = tx.QueryRow(`SELECT COUNT(*), MAX(created_date) FROM public.user_otp_codes
+		WHERE user_id = $1 AND purpose = $2 AND created_date > $3`, userID, purpose, now.Add(-time.Hour)).Scan(&recent, &last)
+	if err != nil {
+		log.Println("Error counting one-time codes:", err)
+		return "", err
+	}
+	if recent >= OTPMaxPerHour || (last.Valid && now.Sub(last.Time) < OTPResendInterval) {
+		return "", ErrOTPRateLimited
+	}
+
+	code, err := newOTP()
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("UPDATE public.user_otp_codes SET consumed_at = $1 WHERE user_id = $2 AND purpose = $3 AND consumed_at IS NULL",
+		now, userID, purpose)
+	if err != nil {
+		log.Println("Error replacing one-time code:", err)
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO public.user_otp_codes (user_id, purpose, code_hash, expires_at, created_date) VALUES ($1, $2, $3, $4, $5)",
+		userID, purpose, string(hash), now.Add(OTPExpiry), now)
+	if err != nil {
+		log.Println("Error creating one-time code:", err)
+		return "", err
+	}
+	return code, tx.Commit()
+}
+
+func (tf *twoFactorRepo) VerifyOTP(userID int, purpose, code string) error {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id, attempts int
+	var hash string
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT id, code_hash, attempts, expires_at FROM public.user_otp_codes
+		WHERE user_id = $1 AND purpose = $2 AND consumed_at IS NULL ORDER BY id DESC LIMIT 1 FOR UPDATE`, userID, purpose).
+		Scan(&id, &hash, &attempts, &expiresAt)
+	if err == sql.ErrNoRows {
+		return ErrInvalidCode
+	}
+	if err != nil {
+		log.Println("Error reading one-time code:", err)
+		return err
+	}
+	if !expiresAt.After(time.Now()) {
+		return ErrInvalidCode
+	}
+	if attempts >= OTPMaxAttempts {
+		return ErrOTPAttemptsExceeded
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) != nil {
+		if _, err := tx.Exec("UPDATE public.user_otp_codes SET attempts = attempts + 1 WHERE id = $1", id); err != nil {
+			log.Println("Error counting one-time code attempt:", err)
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if attempts+1 >= OTPMaxAttempts {
+			return ErrOTPAttemptsExceeded
+		}
+		return ErrInvalidCode
+	}
+
+	if _, err := tx.Exec("UPDATE public.user_otp_codes SET consumed_at = $1 WHERE id = $2", time.Now(), id); err != nil {
+		log.Println("Error spending one-time code:", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tf *twoFactorRepo) SetMobileVerified(userID int) error {
+	now := time.Now()
+	_, err := tf.db.Exec("UPDATE public.users SET mobile_verified = true, mobile_verified_date = $1, updated_date = $1 WHERE id = $2", now, userID)
+	if err != nil {
+		log.Println("Error verifying mobile:", err)
+	}
+	return err
+}
+
+func (tf *twoFactorRepo) SetMobileOTP(userID int, enabled bool) error {
+	_, err := tf.db.Exec("UPDATE public.users SET mobile_otp_enabled = $1, updated_date = $2 WHERE id = $3", enabled, time.Now(), userID)
+	if err != nil {
+		log.Println("Error updating login codes:", err)
+	}
+	return err
+}
+
+func (tf *twoFactorRepo) CreateLoginChallenge(userID int, requestedIp string) (string, error) {
+	token, err := newOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = tf.db.Exec("INSERT INTO public.login_challenges (token_hash, user_id, expires_at, requested_ip, created_date) VALUES ($1, $2, $3, $4, $5)",
+		hashToken(token), userID, time.Now().Add(LoginChallengeExpiry), requestedIp, time.Now())
+	if err != nil {
+		log.Println("Error creating login challenge:", err)
+		return "", err
+	}
+	return token, nil
+}
+
+func (tf *twoFactorRepo) LoginChallengeUser(token string) (int, error) {
+	var userID int
+	err := tf.db.QueryRow(`SELECT user_id FROM public.login_challenges
+		WHERE token_hash = $1 AND completed_at IS NULL AND expires_at > $2 AND attempts < $3`,
+		hashToken(token), time.Now(), LoginChallengeMaxAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidChallenge
+	}
+	if err != nil {
+		log.Println("Error reading login challenge:", err)
+	}
+	return userID, err
+}
+
+func (tf *twoFactorRepo) FailLoginChallenge(token string) error {
+	_, err := tf.db.Exec("UPDATE public.login_challenges SET attempts = attempts + 1 WHERE token_hash = $1", hashToken(token))
+	if err != nil {
+		log.Println("Error updating login challenge:", err)
+	}
+	return err
+}
+
+func (tf *twoFactorRepo) CompleteLoginChallenge(token string) (int, error) {
+	var userID int
+	now := time.Now()
+	err := tf.db.QueryRow(`UPDATE public.login_challenges SET completed_at = $1
+		WHERE token_hash = $2 AND completed_at IS NULL AND expires_at > $1 AND attempts < $3 RETURNING user_id`,
+		now, hashToken(token), LoginChallengeMaxAttempts).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidChallenge
+	}
+	if err != nil {
+		log.Println("Error completing login challenge:", err)
+	}
+	return userID, err
+}
@@ -0,0 +1,306 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"whatbot/utils"
+)
+
+// RecoveryCodeCount is how many recovery codes a user gets at a time.
+const RecoveryCodeCount = 10
+
+var (
+	ErrTOTPEnabled    = errors.New("authenticator app is already enabled")
+	ErrTOTPNotPending = errors.New("start authenticator setup first")
+	// ErrNoTOTPKey is returned when config.json has no valid
+	// TOTP-Encryption-Key.
+	ErrNoTOTPKey = errors.New("TOTP-Encryption-Key must be a base64 encoded 32-byte key")
+)
+
+// totpAEAD is set once at startup by SetTOTPEncryptionKey.
+var totpAEAD cipher.AEAD
+
+// SetTOTPEncryptionKey sets the base64 encoded 32-byte key authenticator
+// secrets are encrypted with. It must be called before the server starts;
+// without a key, authenticator apps can neither be set up nor used.
+func SetTOTPEncryptionKey(encoded string) error {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return ErrNoTOTPKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	totpAEAD = aead
+	return nil
+}
+
+// totpCipher returns the cipher set by SetTOTPEncryptionKey.
+func totpCipher() (cipher.AEAD, error) {
+	if totpAEAD == nil {
+		return nil, ErrNoTOTPKey
+	}
+	return totpAEAD, nil
+}
+
+// sealTOTPSecret encrypts a secret for the totp_secret column. The user ID
+// is authenticated with it, so a secret cannot be copied to another user.
+func sealTOTPSecret(userID int, secret string) (string, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(strconv.Itoa(userID)))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openTOTPSecret decrypts a totp_secret value written by sealTOTPSecret.
+func openTOTPSecret(userID int, stored string) (string, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed authenticator secret")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(userID)))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// normalizeRecoveryCode drops the dash and spaces users may type.
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// replaceRecoveryCodes drops the user's recovery codes and stores a new set,
+// returned as "xxxxx-xxxxx".
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM public.user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, RecoveryCodeCount)
+	now := time.Now()
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := recoveryEncoding.EncodeToString(b)[:10]
+		_, err := tx.Exec("INSERT INTO public.user_recovery_codes (user_id, code_hash, created_date) VALUES ($1, $2, $3)",
+			userID, hashToken(code), now)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+func (tf *twoFactorRepo) BeginTOTPEnrollment(userID int) (string, error) {
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealTOTPSecret(userID, secret)
+	if err != nil {
+		log.Println("Error encrypting authenticator secret:", err)
+		return "", err
+	}
+	result, err := tf.db.Exec("UPDATE public.users SET totp_secret = $1 WHERE id = $2 AND NOT totp_enabled", sealed, userID)
+	if err != nil {
+		log.Println("Error starting authenticator setup:", err)
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", ErrTOTPEnabled
+	}
+	return secret, nil
+}
+
+func (tf *twoFactorRepo) ConfirmTOTP(userID int, code string) ([]string, error) {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	err = tx.QueryRow("SELECT totp_secret, totp_enabled FROM public.users WHERE id = $1 FOR UPDATE", userID).Scan(&secret, &enabled)
+	if err != nil {
+		log.Println("Error reading authenticator secret:", err)
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+	if !secret.Valid || secret.String == "" {
+		return nil, ErrTOTPNotPending
+	}
+	plain, err := openTOTPSecret(userID, secret.String)
+	if err != nil {
+		log.Println("Error decrypting authenticator secret:", err)
+		return nil, err
+	}
+	step, ok := utils.ValidateTOTP(plain, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE public.users SET totp_enabled = true, totp_enabled_date = $1, totp_last_step = $2, updated_date = $1 WHERE id = $3",
+		now, step, userID)
+	if err != nil {
+		log.Println("Error enabling authenticator:", err)
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		log.Println("Error creating recovery codes:", err)
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func (tf *twoFactorRepo) VerifyTOTP(userID int, code string) error {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	var lastStep int64
+	err = tx.QueryRow("SELECT totp_secret, totp_enabled, totp_last_step FROM public.users WHERE id = $1 FOR UPDATE", userID).
+		Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		log.Println("Error reading authenticator secret:", err)
+		return err
+	}
+	if !enabled || !secret.Valid {
+		return ErrInvalidCode
+	}
+	plain, err := openTOTPSecret(userID, secret.String)
+	if err != nil {
+		log.Println("Error decrypting authenticator secret:", err)
+		return err
+	}
+	step, ok := utils.ValidateTOTP(plain, code, time.Now())
+	if !ok || step <= lastStep {
+		return ErrInvalidCode
+	}
+	if _, err := tx.Exec("UPDATE public.users SET totp_last_step = $1 WHERE id = $2", step, userID); err != nil {
+		log.Println("Error updating authenticator step:", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tf *twoFactorRepo) DisableTOTP(userID int) error {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE public.users SET totp_enabled = false, totp_secret = NULL, totp_enabled_date = NULL, updated_date = $1 WHERE id = $2",
+		time.Now(), userID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM public.user_recovery_codes WHERE user_id = $1", userID)
+	}
+	if err != nil {
+		log.Println("Error disabling authenticator:", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (tf *twoFactorRepo) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var enabled bool
+	if err := tx.QueryRow("SELECT totp_enabled FROM public.users WHERE id = $1 FOR UPDATE", userID).Scan(&enabled); err != nil {
+		log.Println("Error reading authenticator state:", err)
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrTOTPNotPending
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		log.Println("Error creating recovery codes:", err)
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func (tf *twoFactorRepo) UseRecoveryCode(userID int, code string) error {
+	result, err := tf.db.Exec(`UPDATE public.user_recovery_codes SET used_at = $1
+		WHERE id = (SELECT id FROM public.user_recovery_codes WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL LIMIT 1)`,
+		time.Now(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		log.Println("Error using recovery code:", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (tf *twoFactorRepo) ResetTwoFactor(userID int) error {
+	tx, err := tf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE public.users SET totp_enabled = false, totp_secret = NULL, totp_enabled_date = NULL,
+		mobile_otp_enabled = false, updated_date = $1 WHERE id = $2`, time.Now(), userID)
+	if err != nil {
+		log.Println("Error resetting second factors:", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM public.user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		log.Println("Error resetting second factors:", err)
+		return err
+	}
+	if _, err := revokeFamilies(tx, "r.user_id = $1", userID); err != nil {
+		log.Println("Error revoking sessions:", err)
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,104 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+// withTestTOTPKey sets a random TOTP encryption key for the test.
+func withTestTOTPKey(t *testing.T) {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	previous := totpAEAD
+	t.Cleanup(func() { totpAEAD = previous })
+	if err := SetTOTPEncryptionKey(base64.StdEncoding.EncodeToString(key)); err != nil {
+		t.Fatalf("SetTOTPEncryptionKey error: %v", err)
+	}
+}
+
+func TestSetTOTPEncryptionKey(t *testing.T) {
+	previous := totpAEAD
+	t.Cleanup(func() { totpAEAD = previous })
+	for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if err := SetTOTPEncryptionKey(key); err != ErrNoTOTPKey {
+			t.Errorf("SetTOTPEncryptionKey(%q) error = %v, want ErrNoTOTPKey", key, err)
+		}
+	}
+}
+
+func TestSealTOTPSecret(t *testing.T) {
+	withTestTOTPKey(t)
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+	sealed, err := sealTOTPSecret(7, secret)
+	if err != nil {
+		t.Fatalf("sealTOTPSecret error: %v", err)
+	}
+	if sealed == secret {
+		t.Fatal("sealTOTPSecret stored the secret in plain text")
+	}
+	again, _ := sealTOTPSecret(7, secret)
+	if again == sealed {
+		t.Error("sealTOTPSecret reused a nonce")
+	}
+
+	opened, err := openTOTPSecret(7, sealed)
+	if err != nil {
+		t.Fatalf("openTOTPSecret error: %v", err)
+	}
+	if opened != secret {
+		t.Errorf("openTOTPSecret = %q, want %q", opened, secret)
+	}
+	if _, err := openTOTPSecret(8, sealed); err == nil {
+		t.Error("openTOTPSecret opened a secret sealed for another user")
+	}
+	if _, err := openTOTPSecret(7, secret); err == nil {
+		t.Error("openTOTPSecret opened a plain text secret")
+	}
+	if _, err := openTOTPSecret(7, "AAAA"); err == nil {
+		t.Error("openTOTPSecret opened a truncated value")
+	}
+}
+
+func TestSealTOTPSecretWithoutKey(t *testing.T) {
+	previous := totpAEAD
+	t.Cleanup(func() { totpAEAD = previous })
+	totpAEAD = nil
+
+	if _, err := sealTOTPSecret(7, "secret"); err != ErrNoTOTPKey {
+		t.Errorf("sealTOTPSecret error = %v, want ErrNoTOTPKey", err)
+	}
+	if _, err := openTOTPSecret(7, "secret"); err != ErrNoTOTPKey {
+		t.Errorf("openTOTPSecret error = %v, want ErrNoTOTPKey", err)
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	// Recovery codes are stored as the hash of the ten characters and shown
+	// as "xxxxx-xxxxx"; every way of typing the code must match the hash.
+	const stored = "abcde23456"
+	tests := []struct {
+		name  string
+		typed string
+		want  bool
+	}{
+		{"as shown", "abcde-23456", true},
+		{"without dash", "abcde23456", true},
+		{"upper case", "ABCDE-23456", true},
+		{"spaces", " abcde 23456 ", true},
+		{"other code", "abcde-23457", false},
+		{"half a code", "abcde", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hashToken(normalizeRecoveryCode(tt.typed)) == hashToken(stored)
+			if got != tt.want {
+				t.Errorf("recovery code %q matches = %v, want %v", tt.typed, got, tt.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ package model
 
 			"time"
 
+			"github.com/lib/pq"
 			"golang.org/x/crypto/bcrypt"
 		)
 
@@ -27,15 +28,39 @@ type User struct {
 	ChangePassword          bool
 	MobileVerifiedDate      time.Time
 	MobileVerified          bool
+	MobileOTPEnabled        bool
+	TOTPEnabled             bool
 	PasswordChangedDate     time.Time
 	EmailVerified           bool
 	EmailVerifiedDate       time.Time
 	EmailVerificationCode   string
 	EmailVerificationExpiry time.Time
+	// Roles and the permissions they grant
+	Roles       []string
+	Permissions []string
 }
 
 type UserRepository interface {
 	AuthenticateUser(username, password string) (*User, error)
+	// GetUserByID returns sql.ErrNoRows when there is no such user.
+	GetUserByID(id int) (*User, error)
+	// RegisterUser returns ErrUsernameTaken or ErrEmailTaken for duplicates
+	// and ErrInvalidInvite or ErrInviteEmailMismatch for bad invitations.
+	RegisterUser(registration Registration) (*User, error)
+	// ChangePassword returns ErrWrongPassword when current is wrong and a
+	// *PasswordPolicyError when the new password is rejected.
+	ChangePassword(userID int, current, password string) error
+	// CreatePasswordReset returns the user with this login name or email and
+	// a reset code, or a nil user when there is no such active user or the
+	// reset limits of the user or the address are reached.
+	CreatePasswordReset(login, requestedIp string, expiresAt time.Time) (*User, string, error)
+	// ResetPassword returns ErrInvalidCode for unknown, used or expired
+	// codes. It ends every session of the user.
+	ResetPassword(code, password string) (*User, error)
+	// CreateEmailVerification replaces the user's email verification code.
+	CreateEmailVerification(userID int, expiresAt time.Time) (*User, string, error)
+	// VerifyEmail returns ErrInvalidCode for unknown or expired codes.
+	VerifyEmail(code string) (*User, error)
 }
 
 type userRepo struct {
@@ -46,11 +71,20 @@ func NewUserRepository(db *sql.DB) UserRepository {
 	return &userRepo{db: db}
 }
 
+// dummyPasswordHash is compared against when there is no such user.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
 func (ur *userRepo) AuthenticateUser(username, password string) (*User, error) {
 	// Query the database to retrieve the user based on the username
 	user := &User{}
-	err := ur.db.QueryRow("SELECT id,gid,users_name,login_user_name, login_user_password FROM public.users WHERE login_user_name = $1", username).
+	err := ur.db.QueryRow("SELECT id,gid,users_name,login_user_name, login_user_password FROM public.users WHERE lower(login_user_name) = lower($1)", username).
 		Scan(&user.ID,&user.GID, &user.UserName, &user.LoginUserName, &user.LoginUserPasswordHash)
+	if err == sql.ErrNoRows {
+		// An unknown username is answered like a wrong password, and takes
+		// as long, so that usernames cannot be told apart
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
 	if err != nil {
 		log.Println("Error retrieving user from database:", err)
 		return nil, err
@@ -64,5 +98,43 @@ func (ur *userRepo) AuthenticateUser(username, password string) (*User, error) {
 	if err != nil {
 		return nil, nil // Invalid credentials
 	}
-	return user, nil // Authentication successful
+	return ur.GetUserByID(user.ID) // Authentication successful
+}
+
+// userColumns are the columns read by scanUser, from "public.users u".
+const userColumns = `u.id, u.gid, u.users_name, u.login_user_name, COALESCE(u.email, ''), COALESCE(u.mobile, ''), COALESCE(u.gender, ''),
+	u.date_of_birth, u.start_date, u.end_date, COALESCE(u.active, false), COALESCE(u.change_password, false),
+	COALESCE(u.email_verified, false), u.email_verified_date, COALESCE(u.mobile_verified, false), u.mobile_verified_date, u.mobile_otp_enabled, u.totp_enabled,
+	u.password_changed_date, u.created_date, u.updated_date,
+	ARRAY(SELECT ur.role_name FROM public.user_roles ur WHERE ur.user_id = u.id ORDER BY ur.role_name),
+	ARRAY(SELECT DISTINCT rp.permission FROM public.user_roles ur JOIN public.role_permissions rp ON rp.role_name = ur.role_name
+		WHERE ur.user_id = u.id ORDER BY rp.permission)`
+
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	var dateOfBirth, startDate, endDate, emailVerifiedDate, mobileVerifiedDate, passwordChangedDate, createdDate, updatedDate sql.NullTime
+	err := row.Scan(&user.ID, &user.GID, &user.UserName, &user.LoginUserName, &user.Email, &user.Mobile, &user.Gender,
+		&dateOfBirth, &startDate, &endDate, &user.Active, &user.ChangePassword,
+		&user.EmailVerified, &emailVerifiedDate, &user.MobileVerified, &mobileVerifiedDate, &user.MobileOTPEnabled, &user.TOTPEnabled,
+		&passwordChangedDate, &createdDate, &updatedDate, pq.Array(&user.Roles), pq.Array(&user.Permissions))
+	if err != nil {
+		return nil, err
+	}
+	user.DateOfBirth = dateOfBirth.Time
+	user.StartDate = startDate.Time
+	user.EndDate = endDate.Time
+	user.EmailVerifiedDate = emailVerifiedDate.Time
+	user.MobileVerifiedDate = mobileVerifiedDate.Time
+	user.PasswordChangedDate = passwordChangedDate.Time
+	user.CreatedDate = createdDate.Time
+	user.UpdatedDate = updatedDate.Time
+	return user, nil
+}
+
+func (ur *userRepo) GetUserByID(id int) (*User, error) {
+	user, err := scanUser(ur.db.QueryRow("SELECT "+userColumns+" FROM public.users u WHERE u.id = $1", id))
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error retrieving user from database:", err)
+	}
+	return user, err
 }
@@ -0,0 +1,210 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A user can be sent a reset code every PasswordResetInterval and at most
+// PasswordResetMaxPerHour times an hour; one address can request at most
+// PasswordResetMaxPerAddress codes an hour.
+const (
+	PasswordResetInterval      = time.Minute
+	PasswordResetMaxPerHour    = 5
+	PasswordResetMaxPerAddress = 20
+)
+
+var (
+	ErrWrongPassword = errors.New("current password is incorrect")
+	// ErrInvalidCode is returned for unknown, used or expired verification
+	// and reset codes.
+	ErrInvalidCode = errors.New("invalid or expired code")
+)
+
+// setPassword validates and stores a new password for the user, clearing
+// the forced password change. It must run in a transaction with the user's
+// row locked.
+func setPassword(tx *sql.Tx, userID int, password string) error {
+	var login, email, hash string
+	err := tx.QueryRow("SELECT login_user_name, COALESCE(email, ''), login_user_password FROM public.users WHERE id = $1 FOR UPDATE", userID).
+		Scan(&login, &email, &hash)
+	if err != nil {
+		return err
+	}
+	if err := ValidatePassword(password, login, email); err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+		return &PasswordPolicyError{"must differ from the current password"}
+	}
+
+	newHash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = tx.Exec(`UPDATE public.users SET login_user_password = $1, change_password = false, password_changed_date = $2, updated_date = $2
+		WHERE id = $3`, newHash, now, userID)
+	return err
+}
+
+func (ur *userRepo) ChangePassword(userID int, current, password string) error {
+	tx, err := ur.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	err = tx.QueryRow("SELECT login_user_password FROM public.users WHERE id = $1 FOR UPDATE", userID).Scan(&hash)
+	if err != nil {
+		log.Println("Error retrieving user from database:", err)
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(current)) != nil {
+		return ErrWrongPassword
+	}
+	if err := setPassword(tx, userID, password); err != nil {
+		if _, ok := err.(*PasswordPolicyError); !ok {
+			log.Println("Error changing password:", err)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func (ur *userRepo) CreatePasswordReset(login, requestedIp string, expiresAt time.Time) (*User, string, error) {
+	tx, err := ur.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM public.users u
+		WHERE (lower(u.login_user_name) = lower($1) OR lower(u.email) = lower($1)) AND COALESCE(u.active, false)
+		ORDER BY u.id LIMIT 1`, strings.TrimSpace(login)))
+	if err == sql.ErrNoRows || (err == nil && user.Email == "") {
+		return nil, "", nil
+	}
+	if err != nil {
+		log.Println("Error retrieving user from database:", err)
+		return nil, "", err
+	}
+
+	// Serialise requests of the same user so the limits hold
+	if _, err := tx.Exec("SELECT id FROM public.users WHERE id = $1 FOR UPDATE", user.ID); err != nil {
+		log.Println("Error locking user:", err)
+		return nil, "", err
+	}
+	now := time.Now()
+	var recent, fromAddress int
+	var last sql.NullTime
+	err = tx.QueryRow(`SELECT COUNT(*) FILTER (WHERE user_id = $1), MAX(created_date) FILTER (WHERE user_id = $1),
+			COUNT(*) FILTER (WHERE requested_ip = $2)
+		FROM public.password_resets WHERE (user_id = $1 OR requested_ip = $2) AND created_date > $3`,
+		user.ID, requestedIp, now.Add(-time.Hour)).Scan(&recent, &last, &fromAddress)
+	if err != nil {
+		log.Println("Error counting password resets:", err)
+		return nil, "", err
+	}
+	if recent >= PasswordResetMaxPerHour || fromAddress >= PasswordResetMaxPerAddress ||
+		(last.Valid && now.Sub(last.Time) < PasswordResetInterval) {
+		// Answered like an unknown account so the limit does not reveal it
+		log.Printf("Password reset for user %d from %s rate limited\n", user.ID, requestedIp)
+		return nil, "", nil
+	}
+
+	code, err := newOpaqueToken(24)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = tx.Exec("INSERT INTO public.password_resets (user_id, token_hash, expires_at, requested_ip, created_date) VALUES ($1, $2, $3, $4, $5)",
+		user.ID, hashToken(code), expiresAt, requestedIp, now)
+	if err != nil {
+		log.Println("Error creating password reset:", err)
+		return nil, "", err
+	}
+	return user, code, tx.Commit()
+}
+
+func (ur *userRepo) ResetPassword(code, password string) (*User, error) {
+	tx, err := ur.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var resetID, userID int
+	err = tx.QueryRow(`SELECT id, user_id FROM public.password_resets
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now() FOR UPDATE`, hashToken(code)).Scan(&resetID, &userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidCode
+	}
+	if err != nil {
+		log.Println("Error reading password reset:", err)
+		return nil, err
+	}
+
+	if err := setPassword(tx, userID, password); err != nil {
+		if _, ok := err.(*PasswordPolicyError); !ok {
+			log.Println("Error resetting password:", err)
+		}
+		return nil, err
+	}
+	// Every outstanding code of the user is spent, and whoever knew the old
+	// password is signed out
+	_, err = tx.Exec("UPDATE public.password_resets SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL", time.Now(), userID)
+	if err != nil {
+		log.Println("Error resetting password:", err)
+		return nil, err
+	}
+	if _, err := revokeFamilies(tx, "r.user_id = $1", userID); err != nil {
+		log.Println("Error revoking sessions:", err)
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ur.GetUserByID(userID)
+}
+
+func (ur *userRepo) CreateEmailVerification(userID int, expiresAt time.Time) (*User, string, error) {
+	code, err := newOpaqueToken(24)
+	if err != nil {
+		return nil, "", err
+	}
+	result, err := ur.db.Exec("UPDATE public.users SET email_verification_code = $1, email_verification_expiry = $2 WHERE id = $3",
+		hashToken(code), expiresAt, userID)
+	if err != nil {
+		log.Println("Error creating email verification:", err)
+		return nil, "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, "", sql.ErrNoRows
+	}
+	user, err := ur.GetUserByID(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, code, nil
+}
+
+func (ur *userRepo) VerifyEmail(code string) (*User, error) {
+	var userID int
+	err := ur.db.QueryRow(`UPDATE public.users SET email_verified = true, email_verified_date = $1, updated_date = $1,
+			email_verification_code = NULL, email_verification_expiry = NULL
+		WHERE email_verification_code = $2 AND email_verification_expiry > $1 RETURNING id`, time.Now(), hashToken(code)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidCode
+	}
+	if err != nil {
+		log.Println("Error verifying email:", err)
+		return nil, err
+	}
+	return ur.GetUserByID(userID)
+}
@@ -0,0 +1,309 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength is the shortest password accepted by ValidatePassword.
+const MinPasswordLength = 10
+
+var (
+	ErrUsernameTaken = errors.New("username is already taken")
+	ErrEmailTaken    = errors.New("an account with this email already exists")
+	// ErrInvalidInvite is returned for unknown, expired, revoked or already
+	// accepted invitations.
+	ErrInvalidInvite = errors.New("invalid or expired invitation")
+	// ErrInviteEmailMismatch is returned when an invitation is used to
+	// register a different email address than the one invited.
+	ErrInviteEmailMismatch = errors.New("email does not match the invitation")
+)
+
+// PasswordPolicyError describes why a password was rejected.
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password " + e.Reason
+}
+
+// ValidatePassword checks a new password against the password policy: at
+// least MinPasswordLength characters, with upper and lower case letters and a
+// digit, and not containing the username or the local part of the email.
+func ValidatePassword(password, username, email string) error {
+	if len([]rune(password)) < MinPasswordLength {
+		return &PasswordPolicyError{fmt.Sprintf("must be at least %d characters long", MinPasswordLength)}
+	}
+	if len(password) > 72 {
+		// bcrypt ignores everything after 72 bytes
+		return &PasswordPolicyError{"must be at most 72 bytes long"}
+	}
+	var upper, lower, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !upper || !lower || !digit {
+		return &PasswordPolicyError{"must contain upper and lower case letters and a digit"}
+	}
+
+	lowered := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(email, "@")
+	for _, personal := range []string{username, localPart} {
+		personal = strings.ToLower(strings.TrimSpace(personal))
+		if len(personal) >= 3 && strings.Contains(lowered, personal) {
+			return &PasswordPolicyError{"must not contain your username or email"}
+		}
+	}
+	return nil
+}
+
+// HashPassword hashes a password the way AuthenticateUser expects.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Registration is a new user account. InviteToken is optional for
+// self-registration.
+type Registration struct {
+	Name        string
+	Username    string
+	Email       string
+	Mobile      string
+	Gender      string
+	DateOfBirth time.Time
+	Password    string
+	InviteToken string
+}
+
+// defaultRole is the role of users who registered without an invitation.
+const defaultRole = RoleReadOnly
+
+// UserInvite is an invitation sent by an admin to an email address.
+type UserInvite struct {
+	GID        string     `json:"gid"`
+	Email      string     `json:"email"`
+	Name       string     `json:"name"`
+	Role       string     `json:"role"`
+	InvitedBy  int        `json:"invited_by"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_date"`
+}
+
+type InviteRepository interface {
+	// CreateInvite stores an invitation to register with role and returns it
+	// with its token, which is only ever available here.
+	CreateInvite(email, name, role string, invitedBy int, expiresAt time.Time) (*UserInvite, string, error)
+	// GetInvite returns the pending invitation of a token, or
+	// ErrInvalidInvite.
+	GetInvite(token string) (*UserInvite, error)
+	ListInvites() ([]UserInvite, error)
+	// RevokeInvite returns false when there is no pending invitation with
+	// this GID.
+	RevokeInvite(gid string) (bool, error)
+}
+
+type inviteRepo struct {
+	db *sql.DB
+}
+
+func NewInviteRepository(db *sql.DB) InviteRepository {
+	return &inviteRepo{db: db}
+}
+
+const inviteColumns = "gid, email, name, role_name, invited_by, expires_at, accepted_at, revoked_at, created_date"
+
+func scanInvite(row rowScanner) (*UserInvite, error) {
+	invite := &UserInvite{}
+	err := row.Scan(&invite.GID, &invite.Email, &invite.Name, &invite.Role, &invite.InvitedBy, &invite.ExpiresAt,
+		&invite.AcceptedAt, &invite.RevokedAt, &invite.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// emailRegistered reports whether a user already has this email.
+func emailRegistered(db dbExecutor, email string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM public.users WHERE lower(email) = lower($1))", email).Scan(&exists)
+	return exists, err
+}
+
+func (ir *inviteRepo) CreateInvite(email, name, role string, invitedBy int, expiresAt time.Time) (*UserInvite, string, error) {
+	registered, err := emailRegistered(ir.db, email)
+	if err != nil {
+		log.Println("Error checking invited email:", err)
+		return nil, "", err
+	}
+	if registered {
+		return nil, "", ErrEmailTaken
+	}
+
+	token, err := newOpaqueToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	invite, err := scanInvite(ir.db.QueryRow(`INSERT INTO public.user_invites (gid, email, name, role_name, token_hash, invited_by, expires_at, created_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING `+inviteColumns,
+		uuid.New(), email, name, role, hashToken(token), invitedBy, expiresAt, time.Now()))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		return nil, "", ErrUnknownRole
+	}
+	if err != nil {
+		log.Println("Error creating invite:", err)
+		return nil, "", err
+	}
+	return invite, token, nil
+}
+
+func (ir *inviteRepo) GetInvite(token string) (*UserInvite, error) {
+	invite, err := scanInvite(ir.db.QueryRow(`SELECT `+inviteColumns+` FROM public.user_invites
+		WHERE token_hash = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > now()`, hashToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidInvite
+	}
+	if err != nil {
+		log.Println("Error reading invite:", err)
+	}
+	return invite, err
+}
+
+func (ir *inviteRepo) ListInvites() ([]UserInvite, error) {
+	rows, err := ir.db.Query("SELECT " + inviteColumns + " FROM public.user_invites ORDER BY created_date DESC")
+	if err != nil {
+		log.Println("Error listing invites:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []UserInvite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, *invite)
+	}
+	return invites, rows.Err()
+}
+
+func (ir *inviteRepo) RevokeInvite(gid string) (bool, error) {
+	if _, err := uuid.Parse(gid); err != nil {
+		return false, nil
+	}
+	result, err := ir.db.Exec("UPDATE public.user_invites SET revoked_at = $1 WHERE gid = $2 AND accepted_at IS NULL AND revoked_at IS NULL",
+		time.Now(), gid)
+	if err != nil {
+		log.Println("Error revoking invite:", err)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RegisterUser creates an account, accepting the invitation when the
+// registration carries one; the email of an invited user is verified by the
+// invitation. The password must already satisfy ValidatePassword.
+func (ur *userRepo) RegisterUser(registration Registration) (*User, error) {
+	hash, err := HashPassword(registration.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := ur.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var inviteID int
+	role := defaultRole
+	if registration.InviteToken != "" {
+		var email string
+		err := tx.QueryRow(`SELECT id, email, role_name FROM public.user_invites
+			WHERE token_hash = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > now() FOR UPDATE`,
+			hashToken(registration.InviteToken)).Scan(&inviteID, &email, &role)
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidInvite
+		}
+		if err != nil {
+			log.Println("Error reading invite:", err)
+			return nil, err
+		}
+		if !strings.EqualFold(email, registration.Email) {
+			return nil, ErrInviteEmailMismatch
+		}
+	}
+
+	var taken bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM public.users WHERE lower(login_user_name) = lower($1))", registration.Username).Scan(&taken)
+	if err != nil {
+		log.Println("Error checking username:", err)
+		return nil, err
+	}
+	if taken {
+		return nil, ErrUsernameTaken
+	}
+	if taken, err = emailRegistered(tx, registration.Email); err != nil {
+		log.Println("Error checking email:", err)
+		return nil, err
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
+
+	var dateOfBirth sql.NullTime
+	if !registration.DateOfBirth.IsZero() {
+		dateOfBirth = sql.NullTime{Time: registration.DateOfBirth, Valid: true}
+	}
+	now := time.Now()
+	var id int
+	err = tx.QueryRow(`INSERT INTO public.users (gid, users_name, login_user_name, login_user_password, email, mobile, gender, date_of_birth,
+			start_date, active, change_password, email_verified, email_verified_date, mobile_verified, password_changed_date, created_date, updated_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, true, false, $10, CASE WHEN $10 THEN $9 END, false, $9, $9, $9) RETURNING id`,
+		uuid.New(), registration.Name, registration.Username, hash, registration.Email, registration.Mobile, registration.Gender,
+		dateOfBirth, now, inviteID != 0).Scan(&id)
+	if err != nil {
+		log.Println("Error registering user:", err)
+		return nil, err
+	}
+
+	if err := assignRoles(tx, id, []string{role}, 0); err != nil {
+		log.Println("Error assigning role:", err)
+		return nil, err
+	}
+	if inviteID != 0 {
+		_, err := tx.Exec("UPDATE public.user_invites SET accepted_at = $1, accepted_user_id = $2 WHERE id = $3", now, id, inviteID)
+		if err != nil {
+			log.Println("Error accepting invite:", err)
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ur.GetUserByID(id)
+}
@@ -0,0 +1,240 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked
+	// refresh tokens.
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused is returned when an already rotated refresh
+	// token is presented again; the whole session has been revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected, session revoked")
+)
+
+// AccessToken identifies an access token issued together with a refresh
+// token.
+type AccessToken struct {
+	JTI       string
+	ExpiresAt time.Time
+}
+
+// SessionClient describes where a session was started from.
+type SessionClient struct {
+	IP        string
+	UserAgent string
+}
+
+type SessionRepository interface {
+	// StartSession starts a new session for the user and returns its first
+	// refresh token, valid until expiresAt.
+	StartSession(userID int, access AccessToken, expiresAt time.Time, client SessionClient) (string, error)
+	// RotateRefreshToken exchanges a refresh token for a new one of the same
+	// session, returning the user it belongs to. The new token keeps the
+	// session's expiry.
+	RotateRefreshToken(refreshToken string, access AccessToken, client SessionClient) (int, string, error)
+	// EndSession revokes the session of the given access token, and the
+	// access token itself.
+	EndSession(userID int, access AccessToken) error
+	// RevokeAllSessions revokes every session of the user and returns how
+	// many there were.
+	RevokeAllSessions(userID int) (int64, error)
+	IsTokenRevoked(jti string) (bool, error)
+	// PurgeExpiredTokens drops refresh tokens and denylist entries that
+	// have expired anyway.
+	PurgeExpiredTokens() (int64, error)
+}
+
+type sessionRepo struct {
+	db *sql.DB
+}
+
+func NewSessionRepository(db *sql.DB) SessionRepository {
+	return &sessionRepo{db: db}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newOpaqueToken returns a random URL-safe token of n bytes of entropy.
+func newOpaqueToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func insertRefreshToken(db dbExecutor, userID int, familyID string, access AccessToken, expiresAt time.Time, client SessionClient) (string, error) {
+	token, err := newOpaqueToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`INSERT INTO public.user_refresh_tokens (user_id, family_id, token_hash, access_jti, access_expires_at, expires_at, requested_ip, user_agent, created_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		userID, familyID, hashToken(token), access.JTI, access.ExpiresAt, expiresAt, client.IP, client.UserAgent, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (sr *sessionRepo) StartSession(userID int, access AccessToken, expiresAt time.Time, client SessionClient) (string, error) {
+	token, err := insertRefreshToken(sr.db, userID, uuid.New().String(), access, expiresAt, client)
+	if err != nil {
+		log.Println("Error starting session:", err)
+	}
+	return token, err
+}
+
+// revokeFamilies revokes the sessions matching condition, which is written
+// against "public.user_refresh_tokens r", and denylists their access tokens
+// that have not expired yet.
+func revokeFamilies(db dbExecutor, condition string, args ...interface{}) (int64, error) {
+	_, err := db.Exec(`INSERT INTO public.revoked_tokens (jti, user_id, expires_at, created_date)
+		SELECT r.access_jti, r.user_id, r.access_expires_at, now() FROM public.user_refresh_tokens r
+		WHERE r.access_expires_at > now() AND r.family_id IN (SELECT r.family_id FROM public.user_refresh_tokens r WHERE `+condition+`)
+		ON CONFLICT (jti) DO NOTHING`, args...)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(`UPDATE public.user_refresh_tokens SET revoked_at = now()
+		WHERE revoked_at IS NULL AND family_id IN (SELECT r.family_id FROM public.user_refresh_tokens r WHERE `+condition+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (sr *sessionRepo) RotateRefreshToken(refreshToken string, access AccessToken, client SessionClient) (int, string, error) {
+	tx, err := sr.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		id, userID        int
+		familyID          string
+		expiresAt         time.Time
+		usedAt, revokedAt sql.NullTime
+	)
+	err = tx.QueryRow(`SELECT id, user_id, family_id, expires_at, used_at, revoked_at FROM public.user_refresh_tokens
+		WHERE token_hash = $1 FOR UPDATE`, hashToken(refreshToken)).Scan(&id, &userID, &familyID, &expiresAt, &usedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		log.Println("Error reading refresh token:", err)
+		return 0, "", err
+	}
+	if revokedAt.Valid || !expiresAt.After(time.Now()) {
+		return 0, "", ErrInvalidRefreshToken
+	}
+
+	// A token that was already exchanged has leaked: end the whole session
+	if usedAt.Valid {
+		if _, err := revokeFamilies(tx, "r.family_id = $1", familyID); err != nil {
+			log.Println("Error revoking reused session:", err)
+			return 0, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		log.Printf("Refresh token reuse for user %d, session %s revoked\n", userID, familyID)
+		return 0, "", ErrRefreshTokenReused
+	}
+
+	if _, err := tx.Exec("UPDATE public.user_refresh_tokens SET used_at = $1 WHERE id = $2", time.Now(), id); err != nil {
+		log.Println("Error rotating refresh token:", err)
+		return 0, "", err
+	}
+	token, err := insertRefreshToken(tx, userID, familyID, access, expiresAt, client)
+	if err != nil {
+		log.Println("Error rotating refresh token:", err)
+		return 0, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return userID, token, nil
+}
+
+func (sr *sessionRepo) EndSession(userID int, access AccessToken) error {
+	tx, err := sr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO public.revoked_tokens (jti, user_id, expires_at, created_date) VALUES ($1, $2, $3, now())
+		ON CONFLICT (jti) DO NOTHING`, access.JTI, userID, access.ExpiresAt)
+	if err != nil {
+		log.Println("Error revoking access token:", err)
+		return err
+	}
+	if _, err := revokeFamilies(tx, "r.access_jti = $1 AND r.user_id = $2", access.JTI, userID); err != nil {
+		log.Println("Error ending session:", err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sr *sessionRepo) RevokeAllSessions(userID int) (int64, error) {
+	tx, err := sr.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var sessions int64
+	err = tx.QueryRow(`SELECT COUNT(DISTINCT family_id) FROM public.user_refresh_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()`, userID).Scan(&sessions)
+	if err != nil {
+		log.Println("Error counting sessions:", err)
+		return 0, err
+	}
+	if _, err := revokeFamilies(tx, "r.user_id = $1", userID); err != nil {
+		log.Println("Error revoking sessions:", err)
+		return 0, err
+	}
+	return sessions, tx.Commit()
+}
+
+func (sr *sessionRepo) IsTokenRevoked(jti string) (bool, error) {
+	if _, err := uuid.Parse(jti); err != nil {
+		return true, nil
+	}
+	var revoked bool
+	err := sr.db.QueryRow("SELECT EXISTS (SELECT 1 FROM public.revoked_tokens WHERE jti = $1)", jti).Scan(&revoked)
+	if err != nil {
+		log.Println("Error checking token denylist:", err)
+	}
+	return revoked, err
+}
+
+func (sr *sessionRepo) PurgeExpiredTokens() (int64, error) {
+	denied, err := sr.db.Exec("DELETE FROM public.revoked_tokens WHERE expires_at < now()")
+	if err != nil {
+		return 0, err
+	}
+	refresh, err := sr.db.Exec("DELETE FROM public.user_refresh_tokens WHERE expires_at < now()")
+	if err != nil {
+		return 0, err
+	}
+	d, _ := denied.RowsAffected()
+	r, _ := refresh.RowsAffected()
+	return d + r, nil
+}
@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type claimsKey struct{}
+
+// TokenDenylist reports access tokens revoked before their expiry.
+type TokenDenylist interface {
+	IsTokenRevoked(jti string) (bool, error)
+}
+
+// APIKeyPrefix starts every API key, which tells them apart from JWTs.
+const APIKeyPrefix = "wb_"
+
+var (
+	ErrInvalidAPIKey           = httpError("Invalid or expired API key", http.StatusUnauthorized)
+	ErrAPIKeyAddressNotAllowed = httpError("API key is not allowed from this address", http.StatusForbidden)
+)
+
+// APIKeyVerifier checks API keys. VerifyAPIKey returns the claims the key
+// grants when used from ip, or ErrInvalidAPIKey or
+// ErrAPIKeyAddressNotAllowed.
+type APIKeyVerifier interface {
+	VerifyAPIKey(key, ip string) (*Claims, error)
+}
+
+// AuthMiddleware returns a middleware that rejects requests without a valid
+// "Authorization: Bearer" token, or whose token is on the denylist, and makes
+// the token's claims available through ClaimsFromContext. When apiKeys is not
+// nil, API keys are accepted too, as a Bearer token or in the "X-API-Key"
+// header.
+func AuthMiddleware(denylist TokenDenylist, apiKeys APIKeyVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, ok := bearerToken(r)
+			if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" && !ok {
+				tokenString, ok = key, true
+			}
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Authorization token is required", http.StatusUnauthorized)
+				return
+			}
+
+			var claims *Claims
+			var err error
+			if strings.HasPrefix(tokenString, APIKeyPrefix) {
+				if apiKeys == nil {
+					http.Error(w, "API keys cannot be used here", http.StatusForbidden)
+					return
+				}
+				claims, err = apiKeys.VerifyAPIKey(tokenString, ClientIP(r))
+				if err != nil {
+					if _, ok := err.(*httpErrorString); !ok {
+						log.Println("Error checking API key:", err)
+						http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+						return
+					}
+				}
+			} else {
+				claims, err = ParseToken(tokenString)
+				if err == nil && claims.ID == "" {
+					err = httpError("Invalid token", http.StatusUnauthorized)
+				}
+				if err == nil {
+					var revoked bool
+					revoked, err = denylist.IsTokenRevoked(claims.ID)
+					if err != nil {
+						log.Println("Error checking revoked tokens:", err)
+						http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+						return
+					}
+					if revoked {
+						err = httpError("Token has been revoked", http.StatusUnauthorized)
+					}
+				}
+			}
+			if err != nil {
+				status := http.StatusUnauthorized
+				if e, ok := err.(*httpErrorString); ok {
+					status = e.StatusCode()
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), status)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+// PasswordChangeGuard rejects requests whose token was issued to a user who
+// has to change their password first. It goes after AuthMiddleware.
+func PasswordChangeGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims := ClaimsFromContext(r.Context()); claims != nil && claims.PasswordChangeRequired {
+			http.Error(w, "Password change required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission returns a middleware that rejects requests whose token
+// does not grant permission. It goes after AuthMiddleware.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return RequireMethodPermission(permission, permission)
+}
+
+// RequireMethodPermission is RequirePermission for routes that read with GET
+// and change with other methods: read is needed for GET and HEAD requests,
+// write for the rest.
+func RequireMethodPermission(read, write string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			permission := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				permission = read
+			}
+			claims := ClaimsFromContext(r.Context())
+			if claims == nil || !claims.HasPermission(permission) {
+				http.Error(w, "Forbidden: requires the "+permission+" permission", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClaimsFromContext returns the claims stored by AuthMiddleware, or nil for
+// requests that did not pass through it.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+// trustedProxies are the reverse proxies whose forwarding headers ClientIP
+// believes.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the addresses or CIDR ranges of the reverse proxies
+// in front of the server. Without any, forwarding headers are ignored.
+func SetTrustedProxies(entries []string) error {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	trustedProxies = networks
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the caller. It is the peer address unless
+// the peer is a trusted proxy, in which case X-Forwarded-For is read from
+// the right and the first address that is not a trusted proxy wins;
+// X-Real-IP is used when a trusted proxy sends no X-Forwarded-For.
+func ClientIP(r *http.Request) string {
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	peer := net.ParseIP(client)
+	if peer == nil || !isTrustedProxy(peer) {
+		return client
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return client
+	}
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// Anything left of a malformed entry cannot be trusted
+			break
+		}
+		client = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// NormalizePhone converts a country calling code and a phone number as typed
+// by a user into E.164 form, e.g. (91, "095623 89444") -> "+919562389444".
+// Numbers written with a leading "+" or "00" are treated as international
+// and the country code is ignored.
+func NormalizePhone(countryCode int, phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	international := strings.HasPrefix(phone, "+") || strings.HasPrefix(phone, "00")
+
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	digits := b.String()
+
+	if international {
+		digits = strings.TrimPrefix(digits, "00")
+	} else {
+		if countryCode <= 0 {
+			return "", errors.New("country code is required for national numbers")
+		}
+		cc := strconv.Itoa(countryCode)
+		digits = strings.TrimLeft(digits, "0")
+		// National numbers are at most 10 digits; anything longer that starts
+		// with the country code already includes it.
+		if len(digits) > 10 && strings.HasPrefix(digits, cc) {
+			digits = digits[len(cc):]
+		}
+		digits = cc + digits
+	}
+
+	if len(digits) < 8 || len(digits) > 15 {
+		return "", errors.New("phone number must have between 8 and 15 digits")
+	}
+	return "+" + digits, nil
+}
@@ -0,0 +1,44 @@
+package utils
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		name        string
+		countryCode int
+		phone       string
+		want        string
+		wantErr     bool
+	}{
+		{"national", 91, "9562389444", "+919562389444", false},
+		{"national with trunk zero", 91, "095623 89444", "+919562389444", false},
+		{"national with punctuation", 1, "(415) 555-0132", "+14155550132", false},
+		{"country code already included", 91, "919562389444", "+919562389444", false},
+		{"plus prefix", 0, "+91 95623 89444", "+919562389444", false},
+		{"double zero prefix", 0, "0091 95623 89444", "+919562389444", false},
+		{"international ignores country code", 91, "+44 20 7946 0958", "+442079460958", false},
+		{"surrounding spaces", 91, "  9562389444 ", "+919562389444", false},
+		{"national without country code", 0, "9562389444", "", true},
+		{"too short", 91, "12345", "", true},
+		{"too long", 0, "+1234567890123456", "", true},
+		{"no digits", 91, "not a number", "", true},
+		{"empty", 91, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizePhone(tt.countryCode, tt.phone)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NormalizePhone(%d, %q) = %q, want an error", tt.countryCode, tt.phone, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizePhone(%d, %q) error: %v", tt.countryCode, tt.phone, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizePhone(%d, %q) = %q, want %q", tt.countryCode, tt.phone, got, tt.want)
+			}
+		})
+	}
+}
@@ -9,39 +9,83 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+// Claims are the claims of the tokens issued at login.
 type Claims struct {
-	UserID       string    `json:"user_id"`
+	UserID       int       `json:"userId"`
 	Username     string    `json:"username"`
-	UserGid      string    `json:"user_gid"`
+	UserGid      string    `json:"gid"`
 	CreationDate time.Time `json:"creation_date"`
+	// PasswordChangeRequired limits the token to changing the password.
+	PasswordChangeRequired bool `json:"pwd_change,omitempty"`
+	// Roles of the user and the permissions they grant, checked by
+	// RequirePermission.
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"perms,omitempty"`
+	// APIKey is the prefix of the API key the request was authenticated
+	// with; it is never part of a JWT.
+	APIKey string `json:"-"`
 	jwt.RegisteredClaims
 }
 
-func IsTokenValid(tokenString string) error {
+// HasRole reports whether the token was issued to a user with role.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the token grants permission.
+func (c *Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseToken verifies a token signed with the client key and returns its
+// claims. Errors carry the HTTP status to answer with.
+func ParseToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
 	// Parse the JWT token
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
 		return GetClientPublicKey(), nil
 	})
 	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			return httpError("Invalid token signature", http.StatusUnauthorized)
+		if validation, ok := err.(*jwt.ValidationError); ok && validation.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, httpError("Token has expired", http.StatusUnauthorized)
 		}
-		return httpError("Failed to parse token", http.StatusBadRequest)
+		if validation, ok := err.(*jwt.ValidationError); ok && validation.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			return nil, httpError("Invalid token signature", http.StatusUnauthorized)
+		}
+		return nil, httpError("Failed to parse token", http.StatusUnauthorized)
 	}
 	if !token.Valid {
-		return httpError("Invalid token", http.StatusUnauthorized)
+		return nil, httpError("Invalid token", http.StatusUnauthorized)
 	}
-	if claims.ExpiresAt.Time.Before(time.Now()) {
-		return httpError("Token has expired", http.StatusUnauthorized)
+	if claims.ExpiresAt == nil || claims.ExpiresAt.Time.Before(time.Now()) {
+		return nil, httpError("Token has expired", http.StatusUnauthorized)
 	}
 
 	if claims.CreationDate.IsZero() || time.Now().Before(claims.CreationDate) {
-		return httpError("Invalid token creation date", http.StatusUnauthorized)
+		return nil, httpError("Invalid token creation date", http.StatusUnauthorized)
 	}
-	return nil
+	return claims, nil
 }
+
+func IsTokenValid(tokenString string) error {
+	_, err := ParseToken(tokenString)
+	return err
+}
+
 func httpError(message string, statusCode int) error {
 	return &httpErrorString{message, statusCode}
 }
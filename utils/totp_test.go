@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B lists 8-digit codes; 6-digit codes are their
+	// last six digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode at %d error: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode at %d = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestTOTPCodeInvalidSecret(t *testing.T) {
+	if _, err := TOTPCode("not base32!", 1); err == nil {
+		t.Error("TOTPCode with an invalid secret returned no error")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := TOTPStep(now)
+	tests := []struct {
+		name   string
+		offset int64
+		want   bool
+	}{
+		{"current step", 0, true},
+		{"previous step", -TOTPSkew, true},
+		{"next step", TOTPSkew, true},
+		{"too old", -TOTPSkew - 1, false},
+		{"too new", TOTPSkew + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := TOTPCode(rfc6238Secret, current+tt.offset)
+			if err != nil {
+				t.Fatalf("TOTPCode error: %v", err)
+			}
+			step, ok := ValidateTOTP(rfc6238Secret, code, now)
+			if ok != tt.want {
+				t.Fatalf("ValidateTOTP(step %+d) = %v, want %v", tt.offset, ok, tt.want)
+			}
+			if ok && step != current+tt.offset {
+				t.Errorf("ValidateTOTP(step %+d) matched step %d, want %d", tt.offset, step, current+tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPInput(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"spaces", " 005 924 ", true},
+		{"too short", "05924", false},
+		{"too long", "0005924", false},
+		{"wrong code", "005925", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := ValidateTOTP(rfc6238Secret, tt.code, now); ok != tt.want {
+				t.Errorf("ValidateTOTP(%q) = %v, want %v", tt.code, ok, tt.want)
+			}
+		})
+	}
+}
@@ -90,6 +90,6 @@ func InsertWhatsappMsgData(db *sql.DB, jsonData []byte) error {
 	// _, err = db.Exec("INSERT INTO whatsapp_data (gid, sender_phone_number, message_body, message_timestamp, display_phone_number) VALUES ($1, $2, $3, $4, $5)", gid, from, msgBody, timestamp, phoneNumber)
 	// return err
 
-	_, err = db.Exec("INSERT INTO whatsapp_data (gid,bussiness_id,phone_number_id,sender_phone_number, message_data) VALUES ($1,$2,$3,$4,$5)", gid, bussinessId, phoneNumberID, from, string(jsonData))
+	_, err = db.Exec("INSERT INTO whatsapp_data (gid,bussiness_id,phone_number_id,sender_phone_number, message_data, customer_gid) VALUES ($1,$2,$3,$4,$5,(SELECT gid FROM public.customer WHERE normalized_phone = '+' || $4))", gid, bussinessId, phoneNumberID, from, string(jsonData))
 	return err
 }